@@ -0,0 +1,208 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+
+	"github.com/comalice/maelstrom/registry"
+	"github.com/go-chi/chi/v5"
+)
+
+// HireAgentReq hires an agent from the template <AgentsDir>/<template>.yaml.
+type HireAgentReq struct {
+	Template       string         `json:"template"`
+	InitialContext map[string]any `json:"initialContext,omitempty"`
+}
+
+// AgentResp describes a hired agent.
+type AgentResp struct {
+	ID         string         `json:"id"`
+	Template   string         `json:"template"`
+	Current    string         `json:"current"`
+	Pending    int            `json:"pending"`
+	Handled    int            `json:"handled"`
+	Supervisor string         `json:"supervisor,omitempty"` // hiring instance "mid/iid" or "agent:<id>"; empty for root
+	Context    map[string]any `json:"context,omitempty"`
+}
+
+func AgentsRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Post("/", hireAgent)
+	r.Get("/", listAgents)
+	r.Get("/{agentID}", getAgent)
+	r.Post("/{agentID}/messages", sendAgentMessage)
+	r.Get("/{agentID}/mailbox", getAgentMailbox)
+	r.Get("/{agentID}/history", getAgentHistory)
+	r.Delete("/{agentID}", retireAgent)
+	return r
+}
+
+func agentResp(a *registry.Agent, withContext bool) AgentResp {
+	info := a.Info()
+	resp := AgentResp{
+		ID:         info.ID,
+		Template:   info.Template,
+		Current:    info.Current,
+		Pending:    info.Pending,
+		Handled:    len(a.Handled()),
+		Supervisor: a.Supervisor().Target,
+	}
+	if withContext {
+		resp.Context = a.Context()
+	}
+	return resp
+}
+
+// agentError writes err with the status the orchestrator can act on: 429 when
+// the pool is full, 402 when it is over budget, 404 for unknown agents and templates.
+func agentError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, registry.ErrMaxAgents):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, registry.ErrBudgetExceeded):
+		status = http.StatusPaymentRequired
+	case errors.Is(err, registry.ErrAgentNotFound), errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func lookupAgent(w http.ResponseWriter, r *http.Request) (*registry.Agent, bool) {
+	a, err := registry.GlobalRegistry.Agent(chi.URLParam(r, "agentID"))
+	if err != nil {
+		agentError(w, err)
+		return nil, false
+	}
+	return a, true
+}
+
+func writeAgentJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("json encode", "err", err)
+	}
+}
+
+// @Summary Hire agent
+// @Description Start an agent from a template in AgentsDir
+// @Accept json
+// @Produce json
+// @Success 201 {object} AgentResp
+// @Failure 402 {string} string "budget exceeded"
+// @Failure 429 {string} string "max agents reached"
+// @Router /api/v1/agents [POST]
+func hireAgent(w http.ResponseWriter, r *http.Request) {
+	var req HireAgentReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	id, err := registry.GlobalRegistry.HireAgentWith(req.Template, req.InitialContext)
+	if err != nil {
+		agentError(w, err)
+		return
+	}
+	a, err := registry.GlobalRegistry.Agent(id)
+	if err != nil {
+		// Retired by one of its own start actions.
+		agentError(w, err)
+		return
+	}
+	writeAgentJSON(w, http.StatusCreated, agentResp(a, true))
+}
+
+// @Summary List agents
+// @Description List hired agents with their state
+// @Produce json
+// @Success 200 {array} AgentResp
+// @Router /api/v1/agents [GET]
+func listAgents(w http.ResponseWriter, r *http.Request) {
+	agents := registry.GlobalRegistry.Agents()
+	out := make([]AgentResp, 0, len(agents))
+	for _, a := range agents {
+		out = append(out, agentResp(a, false))
+	}
+	writeAgentJSON(w, http.StatusOK, out)
+}
+
+// @Summary Get agent
+// @Description Agent state and context
+// @Param agentID path string true "Agent ID"
+// @Produce json
+// @Success 200 {object} AgentResp
+// @Router /api/v1/agents/{agentID} [GET]
+func getAgent(w http.ResponseWriter, r *http.Request) {
+	a, ok := lookupAgent(w, r)
+	if !ok {
+		return
+	}
+	writeAgentJSON(w, http.StatusOK, agentResp(a, true))
+}
+
+// @Summary Message agent
+// @Description Append a message to the agent's mailbox: {"event": name, "data": ...}, or any object to deliver as the "message" event
+// @Param agentID path string true "Agent ID"
+// @Accept json
+// @Success 202
+// @Router /api/v1/agents/{agentID}/messages [POST]
+func sendAgentMessage(w http.ResponseWriter, r *http.Request) {
+	var msg map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg == nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := registry.GlobalRegistry.SendMessage(chi.URLParam(r, "agentID"), msg); err != nil {
+		if errors.Is(err, registry.ErrAgentNotFound) {
+			agentError(w, err)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// @Summary Agent mailbox
+// @Description Messages the agent has not handled yet
+// @Param agentID path string true "Agent ID"
+// @Produce json
+// @Success 200 {array} registry.AgentMessage
+// @Router /api/v1/agents/{agentID}/mailbox [GET]
+func getAgentMailbox(w http.ResponseWriter, r *http.Request) {
+	a, ok := lookupAgent(w, r)
+	if !ok {
+		return
+	}
+	writeAgentJSON(w, http.StatusOK, a.Mailbox())
+}
+
+// @Summary Agent history
+// @Description Messages the agent has handled, with their actions and failures
+// @Param agentID path string true "Agent ID"
+// @Produce json
+// @Success 200 {array} registry.AgentMessage
+// @Router /api/v1/agents/{agentID}/history [GET]
+func getAgentHistory(w http.ResponseWriter, r *http.Request) {
+	a, ok := lookupAgent(w, r)
+	if !ok {
+		return
+	}
+	writeAgentJSON(w, http.StatusOK, a.Handled())
+}
+
+// @Summary Retire agent
+// @Param agentID path string true "Agent ID"
+// @Success 204
+// @Router /api/v1/agents/{agentID} [DELETE]
+func retireAgent(w http.ResponseWriter, r *http.Request) {
+	if err := registry.GlobalRegistry.RetireAgent(chi.URLParam(r, "agentID")); err != nil {
+		agentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -12,5 +12,6 @@ func Router() chi.Router {
 	r.Get("/raw-yamls", ListRawYamlsHandler)
 	r.Post("/import/{filename}", ImportYamlHandler)
 	r.Mount("/statecharts", StatechartsRouter())
+	r.Mount("/agents", AgentsRouter())
 	return r
 }
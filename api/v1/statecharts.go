@@ -1,15 +1,15 @@
 package v1
 
 import (
-	"context"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"strings"
 	"sync"
-	"sync/atomic"
 
+	"github.com/comalice/maelstrom/internal/store"
 	"github.com/comalice/maelstrom/registry"
 	registrystatechart "github.com/comalice/maelstrom/registry/statechart"
 	"github.com/comalice/statechartx"
@@ -18,19 +18,69 @@ import (
 
 var (
 	instances         sync.Map // machineID -> *sync.Map of instID:*statechartx.Runtime
-	nextInstanceID    int64
 	instanceMutexes   sync.Map // mid:iid -> *sync.Mutex
-	augCache          sync.Map // machineID -> *registrystatechart.AugmentedMachine
+	augCache          sync.Map // name@version -> registry.MachineVersion
+	instanceRecorders sync.Map // mid:iid -> *registrystatechart.Recorder
+	instanceHistories sync.Map // mid:iid -> *registrystatechart.HistoryMemory
 )
 
+// EventLog is one processed event. Actions holds the outputs of its LLM, tool
+// and system actions so replay can apply them instead of re-executing.
+// From, To and Diff describe the transition for stream subscribers.
+// Failures lists the guards, actions and tool calls that failed on the way.
 type EventLog struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data"`
+	Type     string                            `json:"type"`
+	Data     json.RawMessage                   `json:"data"`
+	Actions  []registrystatechart.ActionRecord `json:"actions,omitempty"`
+	From     string                            `json:"from,omitempty"`
+	To       string                            `json:"to,omitempty"`
+	Diff     map[string]any                    `json:"diff,omitempty"`
+	Failures []registrystatechart.Failure      `json:"failures,omitempty"`
 }
 
+// Instance statuses.
+const (
+	StatusActive    = "active"
+	StatusCompleted = "completed"
+)
+
 type InstanceState struct {
 	Initial json.RawMessage `json:"initialContext"`
-	History []EventLog      `json:"history"`
+	History []EventLog      `json:"history,omitempty"`
+	Timers  []TimerRecord   `json:"timers,omitempty"`
+	// StartActions holds action outputs recorded while entering the initial state.
+	StartActions []registrystatechart.ActionRecord `json:"startActions,omitempty"`
+	// Status is StatusActive until the machine reaches a final state at its root.
+	Status string `json:"status,omitempty"`
+	// Remembered is the configuration the machine's history states resume,
+	// keyed by history state path.
+	Remembered map[string]string `json:"remembered,omitempty"`
+	// Invoked lists the children started by the `invoke:` of active states.
+	Invoked []InvokeRecord `json:"invoked,omitempty"`
+	// Parent is set on instances started by another instance's `invoke:`.
+	Parent *ParentRef `json:"parent,omitempty"`
+	// IdempotencyKey is the Idempotency-Key header the instance was created with.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// MachineVersion is the machine version the instance was created from and
+	// keeps running on; empty for instances stored before versions were pinned,
+	// which run on the latest version.
+	MachineVersion string `json:"machineVersion,omitempty"`
+	// StartState is the state path the instance is started in instead of the
+	// machine's initial state; set when it was migrated from another version.
+	StartState string `json:"startState,omitempty"`
+	// Migrations records the version migrations of the instance, oldest first.
+	Migrations []MigrationRecord `json:"migrations,omitempty"`
+	// Version is the store version this state was loaded at.
+	Version int64 `json:"-"`
+}
+
+// replayLog returns the events replayed on top of Initial: those after the
+// last migration, which folded the earlier ones into Initial.
+func (s *InstanceState) replayLog() []EventLog {
+	if n := len(s.Migrations); n > 0 {
+		return s.History[s.Migrations[n-1].Events+1:]
+	}
+	return s.History
 }
 
 func StatechartsRouter() http.Handler {
@@ -39,37 +89,55 @@ func StatechartsRouter() http.Handler {
 	r.Post("/{machineID}/instances", createInstance)
 	r.Get("/{machineID}/instances/{instID}", getInstance)
 	r.Post("/{machineID}/instances/{instID}/events", sendEvent)
+	r.Post("/{machineID}/instances/{instID}/replay", replayInstance)
+	r.Post("/{machineID}/instances/{instID}/migrate", migrateInstance)
+	r.Get("/{machineID}/instances/{instID}/stream", streamInstance)
 	r.Delete("/{machineID}/instances/{instID}", deleteInstance)
 	return r
 }
 
+// getMachines lists the machines as name@version.
 func getMachines() []string {
-	items := registry.GlobalRegistry.List()
 	out := []string{}
-	for _, item := range items {
-		if item.Type == "statechart" && item.Active && item.StatechartAugmented != nil && strings.HasSuffix(item.Filename, ".yaml") {
-			out = append(out, strings.TrimSuffix(item.Filename, ".yaml"))
-		}
+	for _, m := range registry.GlobalRegistry.MachineVersions() {
+		out = append(out, m.Ref())
 	}
 	return out
 }
 
-func getAugmentedMachine(id string) (*registrystatechart.AugmentedMachine, error) {
-	if v, ok := augCache.Load(id); ok {
-		return v.(*registrystatechart.AugmentedMachine), nil
-	}
-	filename := id + ".yaml"
-	items := registry.GlobalRegistry.List()
-	for _, item := range items {
-		if item.Filename == filename && item.Type == "statechart" && item.Active && item.StatechartAugmented != nil {
-			aug := item.StatechartAugmented
-			augCache.Store(id, aug)
-			return aug, nil
+// resolveMachine resolves "name", "name@latest" or "name@version". Exact
+// versions are cached, so instances pinned to a version keep their machine
+// when newer files land; names and @latest are looked up each time.
+func resolveMachine(ref string) (registry.MachineVersion, error) {
+	if _, version := registry.ParseMachineRef(ref); version != "" && version != registry.LatestVersion {
+		if v, ok := augCache.Load(ref); ok {
+			return v.(registry.MachineVersion), nil
 		}
 	}
-	return nil, fmt.Errorf("machine %q not found", id)
+	m, err := registry.GlobalRegistry.Machine(ref)
+	if err != nil {
+		return m, err
+	}
+	v, _ := augCache.LoadOrStore(m.Ref(), m)
+	return v.(registry.MachineVersion), nil
 }
 
+func getAugmentedMachine(ref string) (*registrystatechart.AugmentedMachine, error) {
+	m, err := resolveMachine(ref)
+	return m.Machine, err
+}
+
+// instanceMachine returns the machine version an instance of mid is pinned to.
+func instanceMachine(mid string, state *InstanceState) (*registrystatechart.AugmentedMachine, error) {
+	return getAugmentedMachine(registry.MachineRef(mid, state.MachineVersion))
+}
+
+// machineName returns the machine name of a machineID URL parameter, which
+// may carry a version; instances are stored by name.
+func machineName(r *http.Request) string {
+	name, _ := registry.ParseMachineRef(chi.URLParam(r, "machineID"))
+	return name
+}
 
 func listMachines(w http.ResponseWriter, r *http.Request) {
 	mids := getMachines()
@@ -80,90 +148,165 @@ func listMachines(w http.ResponseWriter, r *http.Request) {
 }
 
 type CreateInstanceReq struct {
-	InitialContext any `json:"initialContext"`
+	// ID is an optional client-chosen instance ID; a random UUID is used otherwise.
+	ID             string `json:"id,omitempty"`
+	InitialContext any    `json:"initialContext"`
 }
 
 type CreateInstanceResp struct {
-	ID     string `json:"id"`
+	ID      string `json:"id"`
 	Current string `json:"current"`
+	Machine string `json:"machine"`
+	Version string `json:"version,omitempty"` // the machine version the instance is pinned to
 }
 
+// createInstance starts an instance of machineID ("name", "name@latest" or
+// "name@version") pinned to the version it resolves to.
 func createInstance(w http.ResponseWriter, r *http.Request) {
-	mid := chi.URLParam(r, "machineID")
 	var req CreateInstanceReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
-	aug, err := getAugmentedMachine(mid)
+	m, err := resolveMachine(chi.URLParam(r, "machineID"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	iid := fmt.Sprintf("i%d", atomic.AddInt64(&nextInstanceID, 1))
+	mid, aug := m.Name, m.Machine
+	idemKey := r.Header.Get("Idempotency-Key")
+	iid, err := newInstanceID(mid, req.ID, idemKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	mu := getInstanceMutex(mid, iid)
 	mu.Lock()
 	defer mu.Unlock()
-	path := instancePath(mid, iid)
 	initialBytes, err := json.Marshal(req.InitialContext)
 	if err != nil {
 		http.Error(w, "invalid initialContext JSON", http.StatusBadRequest)
 		return
 	}
-	state := &InstanceState{Initial: json.RawMessage(initialBytes), History: []EventLog{}}
-	if err := saveInstanceState(path, state); err != nil {
-		http.Error(w, fmt.Sprintf("save instance: %v", err), http.StatusInternalServerError)
+	if existing, ok, err := loadInstanceState(mid, iid); err != nil {
+		http.Error(w, fmt.Sprintf("load instance: %v", err), http.StatusInternalServerError)
+		return
+	} else if ok {
+		// A retried create with the same idempotency key and body gets the original instance back.
+		if idemKey == "" || existing.IdempotencyKey != idemKey || !bytes.Equal(existing.Initial, initialBytes) {
+			http.Error(w, fmt.Sprintf("instance %q already exists", iid), http.StatusConflict)
+			return
+		}
+		aug, err := instanceMachine(mid, existing)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		rt, err := loadRuntime(mid, iid, aug, existing)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		resp := CreateInstanceResp{ID: iid, Current: aug.StatePathByID[rt.GetCurrentState()], Machine: mid, Version: existing.MachineVersion}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("json encode", "err", err)
+		}
 		return
 	}
-	bgctx := context.Background()
-	initialCtx := statechartx.NewContext()
-	if m, ok := req.InitialContext.(map[string]any); ok {
-		initialCtx.LoadAll(m)
+	state := &InstanceState{Initial: json.RawMessage(initialBytes), History: []EventLog{}, IdempotencyKey: idemKey, MachineVersion: m.Version}
+	rt, err := startInstance(mid, iid, aug, req.InitialContext, state)
+	if errors.Is(err, store.ErrExists) {
+		http.Error(w, fmt.Sprintf("instance %q already exists", iid), http.StatusConflict)
+		return
 	}
-	rt := statechartx.NewRuntime(aug.Machine, initialCtx)
-	if err := rt.Start(bgctx); err != nil {
-		slog.Error("runtime.Start failed", "machine", mid, "iid", iid, "err", err)
-		http.Error(w, "failed to start runtime", http.StatusInternalServerError)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	rt.EmbedContext()
-	currentID := rt.GetCurrentState()
 	resp := CreateInstanceResp{
-		ID: iid,
-		Current: aug.StatePathByID[currentID],
+		ID:      iid,
+		Current: aug.StatePathByID[rt.GetCurrentState()],
+		Machine: mid,
+		Version: m.Version,
 	}
-	v, _ := instances.LoadOrStore(mid, new(sync.Map))
-	midMap := v.(*sync.Map)
-	midMap.Store(iid, rt)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		slog.Error("json encode", "err", err)
 	}
 }
 
+// startInstance starts a new instance of aug with the given initial context,
+// stores state for it and registers its runtime. Callers must hold the
+// instance mutex.
+func startInstance(mid, iid string, aug *registrystatechart.AugmentedMachine, initialContext any, state *InstanceState) (*statechartx.Runtime, error) {
+	return runInstance(mid, iid, aug, initialContext, state, createInstanceState)
+}
+
+// runInstance starts aug in state.StartState or its initial state, with
+// state.Remembered as its history memory, and persists state with save before
+// registering the runtime.
+func runInstance(mid, iid string, aug *registrystatechart.AugmentedMachine, initialContext any, state *InstanceState, save func(mid, iid string, state *InstanceState) error) (*statechartx.Runtime, error) {
+	ts := getTimerSet(mid, iid)
+	cs := getChildSet(mid, iid)
+	getRecorder(mid, iid).Live()
+	getHistoryMemory(mid, iid).Restore(state.Remembered)
+	bgctx := instanceContext(mid, iid)
+	initialCtx := statechartx.NewContext()
+	if m, ok := initialContext.(map[string]any); ok {
+		initialCtx.LoadAll(m)
+	}
+	rt := newRuntime(aug, initialCtx, state.StartState)
+	if err := startRuntime(bgctx, aug, rt, state); err != nil {
+		slog.Error("runtime.Start failed", "machine", mid, "iid", iid, "err", err)
+		ts.stopAll()
+		cs.cancelAll()
+		return nil, fmt.Errorf("failed to start runtime")
+	}
+	state.Timers = ts.records()
+	state.Invoked = cs.records()
+	state.Status = instanceStatus(aug, rt)
+	state.Remembered = getHistoryMemory(mid, iid).Snapshot()
+	state.StartActions = getRecorder(mid, iid).Take()
+	if err := save(mid, iid, state); err != nil {
+		ts.stopAll()
+		cs.cancelAll()
+		_ = aug.Stop(rt)
+		if errors.Is(err, store.ErrExists) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("save instance: %w", err)
+	}
+	v, _ := instances.LoadOrStore(mid, new(sync.Map))
+	midMap := v.(*sync.Map)
+	midMap.Store(iid, rt)
+	notifyParent(mid, iid, state, rt)
+	return rt, nil
+}
+
 type SendEventReq struct {
 	Type string `json:"type"`
 	Data any    `json:"data,omitempty"`
 }
 
 type SendEventResp struct {
-	Current string   `json:"current"`
-	History string   `json:"history"`
+	Current  string                       `json:"current"`
+	History  string                       `json:"history"`
+	Failures []registrystatechart.Failure `json:"failures,omitempty"`
 }
 
 func sendEvent(w http.ResponseWriter, r *http.Request) {
-	mid := chi.URLParam(r, "machineID")
+	mid := machineName(r)
 	iid := chi.URLParam(r, "instID")
 	var evtReq SendEventReq
 	if err := json.NewDecoder(r.Body).Decode(&evtReq); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
-	path := instancePath(mid, iid)
 	mu := getInstanceMutex(mid, iid)
 	mu.Lock()
 	defer mu.Unlock()
-	state, ok, err := loadInstanceState(path)
+	state, ok, err := loadInstanceState(mid, iid)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("load instance: %v", err), http.StatusInternalServerError)
 		return
@@ -172,74 +315,33 @@ func sendEvent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "instance not found", http.StatusNotFound)
 		return
 	}
-	aug, err := getAugmentedMachine(mid)
+	aug, err := instanceMachine(mid, state)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	// Try reuse in-memory runtime
-	var rt *statechartx.Runtime
-	if v, ok := instances.Load(mid); ok {
-		midMap := v.(*sync.Map)
-		rtIface, loaded := midMap.Load(iid)
-		if loaded {
-			rt = rtIface.(*statechartx.Runtime)
-		}
-	}
-	if rt == nil {
-		var initialData any
-		if err := json.Unmarshal(state.Initial, &initialData); err != nil {
-			slog.Error("unmarshal initial", "iid", iid, "err", err)
-			initialData = map[string]any{}
-		}
-		bgctx := context.Background()
-		initialCtx := statechartx.NewContext()
-		if m, ok := initialData.(map[string]any); ok {
-			initialCtx.LoadAll(m)
-		}
-		rt = statechartx.NewRuntime(aug.Machine, initialCtx)
-		if err := rt.Start(bgctx); err != nil {
-			slog.Error("rt.Start failed", "mid", mid, "iid", iid, "err", err)
-			http.Error(w, "failed to start runtime", http.StatusInternalServerError)
-			return
-		}
-		if err := replayRuntime(rt, aug, state.History); err != nil {
-			slog.Error("replay failed", "mid", mid, "iid", iid, "err", err)
-			http.Error(w, fmt.Sprintf("replay failed: %v", err), http.StatusInternalServerError)
-			return
-		}
-		rt.EmbedContext()
-		midMapIface, _ := instances.LoadOrStore(mid, new(sync.Map))
-		midMap := midMapIface.(*sync.Map)
-		midMap.Store(iid, rt)
+	rt, err := loadRuntime(mid, iid, aug, state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	eid, ok := aug.EventIDByName[evtReq.Type]
-	if !ok {
+	if _, ok := aug.EventIDByName[evtReq.Type]; !ok {
 		http.Error(w, fmt.Sprintf("event type %q not found", evtReq.Type), http.StatusBadRequest)
 		return
 	}
-	evt := statechartx.Event{ID: eid, Data: evtReq.Data}
-	rt.EmbedContext()
-	rt.ProcessEvent(evt)
-	evtDataBytes, err := json.Marshal(evtReq.Data)
-	if err != nil {
-		slog.Warn("marshal event data", "mid", mid, "iid", iid, "err", err)
-		evtDataBytes = []byte("{}")
-	}
-	newLog := EventLog{
-		Type: evtReq.Type,
-		Data: json.RawMessage(evtDataBytes),
+	if aug.Completed(rt) {
+		http.Error(w, "instance completed", http.StatusConflict)
+		return
 	}
-	state.History = append(state.History, newLog)
-	if err := saveInstanceState(path, state); err != nil {
-		slog.Error("save failed", "mid", mid, "iid", iid, "err", err)
+	if err := applyEvent(mid, iid, aug, rt, state, evtReq.Type, evtReq.Data); err != nil {
 		http.Error(w, fmt.Sprintf("save instance: %v", err), http.StatusInternalServerError)
 		return
 	}
 	currentID := rt.GetCurrentState()
 	resp := SendEventResp{
-		Current: aug.StatePathByID[currentID],
-		History: fmt.Sprintf("%d events", len(state.History)),
+		Current:  aug.StatePathByID[currentID],
+		History:  fmt.Sprintf("%d events", len(state.History)),
+		Failures: state.History[len(state.History)-1].Failures,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -248,102 +350,159 @@ func sendEvent(w http.ResponseWriter, r *http.Request) {
 }
 
 func getInstance(w http.ResponseWriter, r *http.Request) {
-	mid := chi.URLParam(r, "machineID")
+	mid := machineName(r)
 	iid := chi.URLParam(r, "instID")
-	path := instancePath(mid, iid)
 	mu := getInstanceMutex(mid, iid)
 	mu.Lock()
 	defer mu.Unlock()
-	state, ok, err := loadInstanceState(path)
+	state, ok, err := loadInstanceState(mid, iid)
 	if err != nil || !ok {
 		http.Error(w, "instance not found", http.StatusNotFound)
 		return
 	}
-	aug, err := getAugmentedMachine(mid)
+	aug, err := instanceMachine(mid, state)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	// Reuse in-memory runtime (like sendEvent)
-	var rt *statechartx.Runtime
-	if v, ok := instances.Load(mid); ok {
-		midMap := v.(*sync.Map)
-		rtIface, loaded := midMap.Load(iid)
-		if loaded {
-			rt = rtIface.(*statechartx.Runtime)
-		}
-	}
-	if rt == nil {
-		// Fallback: rebuild + replay
-		var initialData any
-		if err := json.Unmarshal(state.Initial, &initialData); err != nil {
-			slog.Error("unmarshal initial", "iid", iid, "err", err)
-			initialData = map[string]any{}
-		}
-		bgctx := context.Background()
-		initialCtx := statechartx.NewContext()
-		if m, ok := initialData.(map[string]any); ok {
-			initialCtx.LoadAll(m)
-		}
-		rt = statechartx.NewRuntime(aug.Machine, initialCtx)
-		if err := rt.Start(bgctx); err != nil {
-			slog.Error("rt.Start failed", "mid", mid, "iid", iid, "err", err)
-			http.Error(w, "failed to start runtime", http.StatusInternalServerError)
-			return
-		}
-		if err := replayRuntime(rt, aug, state.History); err != nil {
-			slog.Error("replay failed", "mid", mid, "iid", iid, "err", err)
-			http.Error(w, fmt.Sprintf("replay failed: %v", err), http.StatusInternalServerError)
-			return
-		}
-		rt.EmbedContext()
-		midMapIface, _ := instances.LoadOrStore(mid, new(sync.Map))
-		midMap := midMapIface.(*sync.Map)
-		midMap.Store(iid, rt)
+	rt, err := loadRuntime(mid, iid, aug, state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	rt.EmbedContext()
 	currentID := rt.GetCurrentState()
 	type Resp struct {
 		Current      string                 `json:"current"`
+		Version      string                 `json:"version,omitempty"`
 		Context      map[string]interface{} `json:"context"`
 		HistoryCount int                    `json:"history_count"`
+		Timers       []TimerRecord          `json:"timers,omitempty"`
+		Status       string                 `json:"status"`
+		Remembered   map[string]string      `json:"remembered,omitempty"`
+		Invoked      []InvokeRecord         `json:"invoked,omitempty"`
+		Parent       *ParentRef             `json:"parent,omitempty"`
 	}
 	resp := Resp{
 		Current:      aug.StatePathByID[currentID],
+		Version:      state.MachineVersion,
+		Status:       instanceStatus(aug, rt),
 		Context:      rt.Ctx().GetAll(),
 		HistoryCount: len(state.History),
+		Timers:       state.Timers,
+		Remembered:   state.Remembered,
+		Invoked:      state.Invoked,
+		Parent:       state.Parent,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
 func deleteInstance(w http.ResponseWriter, r *http.Request) {
-	mid := chi.URLParam(r, "machineID")
+	mid := machineName(r)
 	iid := chi.URLParam(r, "instID")
-	path := instancePath(mid, iid)
 	mu := getInstanceMutex(mid, iid)
 	mu.Lock()
 	defer mu.Unlock()
-	if err := deleteInstanceState(path); err != nil {
-		slog.Error("delete state failed", "path", path, "err", err)
-		http.Error(w, fmt.Sprintf("delete failed: %v", err), http.StatusInternalServerError)
+	if err := removeInstance(mid, iid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeInstance deletes a stored instance, stops its runtime, timers and
+// children and forgets its in-memory state. Callers must hold the instance mutex.
+func removeInstance(mid, iid string) error {
+	var version string
+	if state, ok, err := loadInstanceState(mid, iid); err == nil && ok {
+		version = state.MachineVersion
+	}
+	if err := deleteInstanceState(mid, iid); err != nil {
+		slog.Error("delete state failed", "mid", mid, "iid", iid, "err", err)
+		return fmt.Errorf("delete failed: %v", err)
+	}
+	stopTimerSet(mid, iid)
+	if v, ok := instanceChildren.LoadAndDelete(mid + ":" + iid); ok {
+		v.(*childSet).cancelAll()
+	}
+	closeStreamHub(mid, iid)
+	instanceRecorders.Delete(mid + ":" + iid)
+	instanceHistories.Delete(mid + ":" + iid)
 	// Cleanup in-memory runtime
 	if v, ok := instances.Load(mid); ok {
 		if midMapIface, typeOk := v.(*sync.Map); typeOk {
 			rtIface, rtOk := midMapIface.Load(iid)
 			if rtOk {
 				if rt, castOk := rtIface.(*statechartx.Runtime); castOk {
-					if err := rt.Stop(); err != nil {
+					stop := rt.Stop
+					if aug, err := getAugmentedMachine(registry.MachineRef(mid, version)); err == nil {
+						stop = func() error { return aug.Stop(rt) }
+					}
+					if err := stop(); err != nil {
 						slog.Error("failed to stop runtime", "mid", mid, "iid", iid, "err", err)
-						http.Error(w, fmt.Sprintf("failed to stop runtime: %v", err), http.StatusInternalServerError)
-						return
+						return fmt.Errorf("failed to stop runtime: %v", err)
 					}
 					midMapIface.Delete(iid)
 				}
 			}
 		}
 	}
-	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// replayInstance rebuilds an instance's runtime from its event log.
+// mode=recorded (default) applies the recorded action outputs; mode=reexecute
+// runs every action again and stores the fresh outputs in the log.
+func replayInstance(w http.ResponseWriter, r *http.Request) {
+	mid := machineName(r)
+	iid := chi.URLParam(r, "instID")
+	mode := replayMode(r.URL.Query().Get("mode"))
+	if mode == "" {
+		mode = replayRecorded
+	}
+	if mode != replayRecorded && mode != replayReexecute {
+		http.Error(w, fmt.Sprintf("unknown replay mode %q", mode), http.StatusBadRequest)
+		return
+	}
+	mu := getInstanceMutex(mid, iid)
+	mu.Lock()
+	defer mu.Unlock()
+	state, ok, err := loadInstanceState(mid, iid)
+	if err != nil || !ok {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	aug, err := instanceMachine(mid, state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if v, ok := instances.Load(mid); ok {
+		midMap := v.(*sync.Map)
+		if rtIface, loaded := midMap.LoadAndDelete(iid); loaded {
+			if err := aug.Stop(rtIface.(*statechartx.Runtime)); err != nil {
+				slog.Warn("failed to stop runtime before replay", "mid", mid, "iid", iid, "err", err)
+			}
+		}
+	}
+	rt, err := buildRuntime(mid, iid, aug, state, mode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mode == replayReexecute {
+		if err := saveInstanceState(mid, iid, state); err != nil {
+			http.Error(w, fmt.Sprintf("save instance: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	resp := SendEventResp{
+		Current: aug.StatePathByID[rt.GetCurrentState()],
+		History: fmt.Sprintf("%d events", len(state.History)),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("json encode", "err", err)
+	}
 }
@@ -1,63 +1,152 @@
 package v1
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"log/slog"
+	"regexp"
 	"sync"
 
-	"github.com/comalice/statechartx"
+	"github.com/comalice/maelstrom/internal/store"
 	registrystatechart "github.com/comalice/maelstrom/registry/statechart"
+	"github.com/comalice/statechartx"
+	"github.com/google/uuid"
 )
 
-func instancePath(machineID, instID string) string {
-	return filepath.Join("instances", machineID, instID+".json")
+var instanceStore store.InstanceStore = store.NewFileStore("instances")
+
+// SetInstanceStore selects the persistence backend for statechart instances.
+// Call it once at startup, before serving requests.
+func SetInstanceStore(s store.InstanceStore) {
+	instanceStore = s
+}
+
+// encodeSnapshot marshals state without its event log.
+func encodeSnapshot(state *InstanceState) (json.RawMessage, error) {
+	snapshot := *state
+	snapshot.History = nil
+	data, err := json.Marshal(&snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("marshal state: %w", err)
+	}
+	return data, nil
 }
 
-func loadInstanceState(path string) (*InstanceState, bool, error) {
-	data, err := os.ReadFile(path)
-	if errors.Is(err, os.ErrNotExist) {
+// encodeInstanceState splits state into the snapshot and event log kept by the store.
+func encodeInstanceState(state *InstanceState) (json.RawMessage, []json.RawMessage, error) {
+	data, err := encodeSnapshot(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make([]json.RawMessage, 0, len(state.History))
+	for _, log := range state.History {
+		b, err := json.Marshal(log)
+		if err != nil {
+			return nil, nil, fmt.Errorf("marshal event %s: %w", log.Type, err)
+		}
+		events = append(events, b)
+	}
+	return data, events, nil
+}
+
+func loadInstanceState(mid, iid string) (*InstanceState, bool, error) {
+	inst, err := instanceStore.Load(mid, iid)
+	if errors.Is(err, store.ErrNotFound) {
 		return nil, false, nil
 	}
 	if err != nil {
-		return nil, false, fmt.Errorf("read %s: %w", path, err)
+		return nil, false, fmt.Errorf("load %s/%s: %w", mid, iid, err)
 	}
 	var state InstanceState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, false, fmt.Errorf("unmarshal %s: %w", path, err)
+	if err := json.Unmarshal(inst.State, &state); err != nil {
+		return nil, false, fmt.Errorf("unmarshal %s/%s: %w", mid, iid, err)
+	}
+	state.History = make([]EventLog, 0, len(inst.Events))
+	for i, raw := range inst.Events {
+		var log EventLog
+		if err := json.Unmarshal(raw, &log); err != nil {
+			return nil, false, fmt.Errorf("unmarshal %s/%s event %d: %w", mid, iid, i, err)
+		}
+		state.History = append(state.History, log)
 	}
+	state.Version = inst.Version
 	return &state, true, nil
 }
 
-func saveInstanceState(path string, state *InstanceState) error {
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("mkdir %s: %w", dir, err)
-	}
-	data, err := json.MarshalIndent(state, "", "  ")
+// createInstanceState stores a new instance; store.ErrExists if the ID is taken.
+func createInstanceState(mid, iid string, state *InstanceState) error {
+	data, events, err := encodeInstanceState(state)
 	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+		return err
+	}
+	inst := &store.Instance{MachineID: mid, ID: iid, State: data, Events: events}
+	if err := instanceStore.Create(inst); err != nil {
+		return err
 	}
-	tmp := filepath.Join(dir, "."+filepath.Base(path)+".tmp")
-	if err := os.WriteFile(tmp, data, 0644); err != nil {
-		return fmt.Errorf("write tmp %s: %w", tmp, err)
+	state.Version = inst.Version
+	return nil
+}
+
+// saveInstanceState replaces the whole persisted instance if state.Version is still current.
+func saveInstanceState(mid, iid string, state *InstanceState) error {
+	data, events, err := encodeInstanceState(state)
+	if err != nil {
+		return err
 	}
-	if err := os.Rename(tmp, path); err != nil {
-		os.Remove(tmp) // cleanup
-		return fmt.Errorf("rename %s to %s: %w", tmp, path, err)
+	v, err := instanceStore.CompareAndSwap(&store.Instance{MachineID: mid, ID: iid, Version: state.Version, State: data, Events: events})
+	if err != nil {
+		return fmt.Errorf("save %s/%s: %w", mid, iid, err)
 	}
+	state.Version = v
 	return nil
 }
 
-func deleteInstanceState(path string) error {
-	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("remove %s: %w", path, err)
+// appendInstanceEvent persists the last entry of state.History together with the updated snapshot.
+func appendInstanceEvent(mid, iid string, state *InstanceState) error {
+	data, err := encodeSnapshot(state)
+	if err != nil {
+		return err
+	}
+	evt, err := json.Marshal(state.History[len(state.History)-1])
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+	v, err := instanceStore.AppendEvent(mid, iid, state.Version, evt, data)
+	if err != nil {
+		return fmt.Errorf("append %s/%s: %w", mid, iid, err)
 	}
+	state.Version = v
 	return nil
 }
 
+func deleteInstanceState(mid, iid string) error {
+	return instanceStore.Delete(mid, iid)
+}
+
+// instanceIDPattern keeps client-chosen IDs safe as file names and URL segments.
+var instanceIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,127}$`)
+
+// idempotencyNamespace derives instance IDs from idempotency keys.
+var idempotencyNamespace = uuid.MustParse("6f1c7a52-3c1e-4f5e-9a51-8d2f0b7e4c11")
+
+// newInstanceID returns the ID for a new instance: the client's ID if given,
+// a name-based UUID for an idempotency key (so retries map to the same
+// instance, across restarts too), or a random UUID.
+func newInstanceID(mid, clientID, idemKey string) (string, error) {
+	switch {
+	case clientID != "":
+		if !instanceIDPattern.MatchString(clientID) {
+			return "", fmt.Errorf("invalid instance id %q", clientID)
+		}
+		return clientID, nil
+	case idemKey != "":
+		return uuid.NewSHA1(idempotencyNamespace, []byte(mid+":"+idemKey)).String(), nil
+	default:
+		return uuid.NewString(), nil
+	}
+}
 
 func getInstanceMutex(machineID, instID string) *sync.Mutex {
 	key := machineID + ":" + instID
@@ -65,8 +154,41 @@ func getInstanceMutex(machineID, instID string) *sync.Mutex {
 	return v.(*sync.Mutex)
 }
 
-func replayRuntime(rt *statechartx.Runtime, aug *registrystatechart.AugmentedMachine, history []EventLog) error {
-	for _, log := range history {
+// replayMode selects how replayRuntime treats recorded action outputs.
+type replayMode string
+
+const (
+	// replayRecorded applies each event's recorded action outputs; no LLM or tool calls are made.
+	replayRecorded replayMode = "recorded"
+	// replayReexecute runs every action again and overwrites the recorded outputs.
+	replayReexecute replayMode = "reexecute"
+)
+
+func getRecorder(mid, iid string) *registrystatechart.Recorder {
+	key := mid + ":" + iid
+	v, _ := instanceRecorders.LoadOrStore(key, registrystatechart.NewRecorder())
+	return v.(*registrystatechart.Recorder)
+}
+
+func getHistoryMemory(mid, iid string) *registrystatechart.HistoryMemory {
+	key := mid + ":" + iid
+	v, _ := instanceHistories.LoadOrStore(key, registrystatechart.NewHistoryMemory())
+	return v.(*registrystatechart.HistoryMemory)
+}
+
+// instanceContext is the context a runtime is started with; its actions reach
+// the instance's timers, children, action recorder and history memory through it.
+func instanceContext(mid, iid string) context.Context {
+	ctx := registrystatechart.WithTimerScheduler(context.Background(), getTimerSet(mid, iid))
+	ctx = registrystatechart.WithInvoker(ctx, getChildSet(mid, iid))
+	ctx = registrystatechart.WithHistoryMemory(ctx, getHistoryMemory(mid, iid))
+	ctx = registrystatechart.WithInstance(ctx, registrystatechart.InstanceRef{Machine: mid, ID: iid})
+	return registrystatechart.WithRecorder(ctx, getRecorder(mid, iid))
+}
+
+func replayRuntime(rt *statechartx.Runtime, aug *registrystatechart.AugmentedMachine, history []EventLog, rec *registrystatechart.Recorder, mode replayMode) error {
+	defer rec.Live()
+	for i, log := range history {
 		eid, ok := aug.EventIDByName[log.Type]
 		if !ok {
 			return fmt.Errorf("replay unknown event %q", log.Type)
@@ -75,8 +197,158 @@ func replayRuntime(rt *statechartx.Runtime, aug *registrystatechart.AugmentedMac
 		if err := json.Unmarshal(log.Data, &data); err != nil {
 			return fmt.Errorf("replay unmarshal data %s: %w", log.Type, err)
 		}
+		if mode == replayReexecute {
+			rec.Live()
+		} else {
+			rec.Replay(log.Actions)
+		}
 		evt := statechartx.Event{ID: eid, Data: data}
-		rt.ProcessEvent(evt)
+		aug.Step(rt, evt)
+		if mode == replayReexecute {
+			history[i].Actions = rec.Take()
+		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// loadRuntime returns the in-memory runtime for an instance, rebuilding it from
+// the persisted initial context and event log when it is not loaded yet.
+// Callers must hold the instance mutex.
+func loadRuntime(mid, iid string, aug *registrystatechart.AugmentedMachine, state *InstanceState) (*statechartx.Runtime, error) {
+	if v, ok := instances.Load(mid); ok {
+		midMap := v.(*sync.Map)
+		if rtIface, loaded := midMap.Load(iid); loaded {
+			rt := rtIface.(*statechartx.Runtime)
+			rt.EmbedContext()
+			return rt, nil
+		}
+	}
+	return buildRuntime(mid, iid, aug, state, replayRecorded)
+}
+
+// buildRuntime starts a fresh runtime for an instance, replays its event log
+// in the given mode and registers it as the instance's in-memory runtime.
+func buildRuntime(mid, iid string, aug *registrystatechart.AugmentedMachine, state *InstanceState, mode replayMode) (*statechartx.Runtime, error) {
+	var initialData any
+	if err := json.Unmarshal(state.Initial, &initialData); err != nil {
+		slog.Error("unmarshal initial", "iid", iid, "err", err)
+		initialData = map[string]any{}
+	}
+	initialCtx := statechartx.NewContext()
+	if m, ok := initialData.(map[string]any); ok {
+		initialCtx.LoadAll(m)
+	}
+	// Timers re-armed and children invoked by replayed entry actions are
+	// stale; the persisted records are the source of truth once replay is done.
+	ts := getTimerSet(mid, iid)
+	ts.pause()
+	cs := getChildSet(mid, iid)
+	cs.pause()
+	rec := getRecorder(mid, iid)
+	mem := getHistoryMemory(mid, iid)
+	mem.Restore(nil)
+	if mode == replayRecorded {
+		rec.Replay(state.StartActions)
+	} else {
+		rec.Live()
+	}
+	rt := newRuntime(aug, initialCtx, state.StartState)
+	if err := startRuntime(instanceContext(mid, iid), aug, rt, state); err != nil {
+		rec.Live()
+		ts.resume(state.Timers)
+		cs.resume(state.Invoked)
+		slog.Error("rt.Start failed", "mid", mid, "iid", iid, "err", err)
+		return nil, fmt.Errorf("failed to start runtime")
+	}
+	rt.EmbedContext()
+	if mode == replayReexecute {
+		state.StartActions = rec.Take()
+	}
+	if err := replayRuntime(rt, aug, state.replayLog(), rec, mode); err != nil {
+		ts.resume(state.Timers)
+		cs.resume(state.Invoked)
+		slog.Error("replay failed", "mid", mid, "iid", iid, "err", err)
+		return nil, fmt.Errorf("replay failed: %w", err)
+	}
+	ts.resume(state.Timers)
+	cs.resume(state.Invoked)
+	// Like timers, the persisted history memory is the source of truth unless
+	// the replay re-executed actions and may have taken another path.
+	if mode == replayRecorded {
+		mem.Restore(state.Remembered)
+	} else {
+		state.Remembered = mem.Snapshot()
+	}
+	midMapIface, _ := instances.LoadOrStore(mid, new(sync.Map))
+	midMap := midMapIface.(*sync.Map)
+	midMap.Store(iid, rt)
+	return rt, nil
+}
+
+// newRuntime returns a runtime of aug that starts in the state at path, or in
+// the machine's initial state when path is empty or unknown.
+func newRuntime(aug *registrystatechart.AugmentedMachine, initialCtx *statechartx.Context, path string) *statechartx.Runtime {
+	rt := statechartx.NewRuntime(aug.Machine, initialCtx)
+	if id, ok := aug.StateIDByPath[path]; ok && path != "" {
+		rt.SetCurrentState(aug.Machine.FindDeepestInitial(id))
+	}
+	return rt
+}
+
+// startRuntime starts rt, or resumes it for a migrated instance: the entry
+// actions of its start state ran on the version it was migrated from.
+func startRuntime(ctx context.Context, aug *registrystatechart.AugmentedMachine, rt *statechartx.Runtime, state *InstanceState) error {
+	if state.StartState != "" {
+		return aug.Resume(ctx, rt)
+	}
+	return aug.Start(ctx, rt)
+}
+
+// instanceStatus reports whether rt has reached a final state at the machine root.
+func instanceStatus(aug *registrystatechart.AugmentedMachine, rt *statechartx.Runtime) string {
+	if aug.Completed(rt) {
+		return StatusCompleted
+	}
+	return StatusActive
+}
+
+// applyEvent processes a named event on rt, appends it to the instance's
+// event log and persists the result. Callers must hold the instance mutex.
+func applyEvent(mid, iid string, aug *registrystatechart.AugmentedMachine, rt *statechartx.Runtime, state *InstanceState, evtType string, data any) error {
+	eid, ok := aug.EventIDByName[evtType]
+	if !ok {
+		return fmt.Errorf("event type %q not found", evtType)
+	}
+	rec := getRecorder(mid, iid)
+	rec.Live()
+	rt.EmbedContext()
+	from := aug.StatePathByID[rt.GetCurrentState()]
+	before := rt.Ctx().GetAll()
+	failures := aug.Step(rt, statechartx.Event{ID: eid, Data: data})
+	actions := rec.Take()
+	evtDataBytes, err := json.Marshal(data)
+	if err != nil {
+		slog.Warn("marshal event data", "mid", mid, "iid", iid, "err", err)
+		evtDataBytes = []byte("{}")
+	}
+	state.History = append(state.History, EventLog{
+		Type:     evtType,
+		Data:     json.RawMessage(evtDataBytes),
+		Actions:  actions,
+		From:     from,
+		To:       aug.StatePathByID[rt.GetCurrentState()],
+		Diff:     contextDiff(before, rt.Ctx().GetAll()),
+		Failures: failures,
+	})
+	state.Timers = getTimerSet(mid, iid).records()
+	state.Invoked = getChildSet(mid, iid).records()
+	state.Status = instanceStatus(aug, rt)
+	state.Remembered = getHistoryMemory(mid, iid).Snapshot()
+	if err := appendInstanceEvent(mid, iid, state); err != nil {
+		slog.Error("save failed", "mid", mid, "iid", iid, "err", err)
+		return err
+	}
+	publishEvent(mid, iid, state)
+	notifyParent(mid, iid, state, rt)
+	return nil
+}
@@ -0,0 +1,219 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	registrystatechart "github.com/comalice/maelstrom/registry/statechart"
+	"github.com/comalice/statechartx"
+	"github.com/google/uuid"
+)
+
+var instanceChildren sync.Map // mid:iid -> *childSet
+
+// InvokeRecord is a child instance started by the `invoke:` of an active
+// state, persisted with its parent so it can be cancelled after a restart.
+type InvokeRecord struct {
+	Invoke   string `json:"invoke"`
+	Machine  string `json:"machine"`
+	Instance string `json:"instance"`
+}
+
+// ParentRef links an invoked instance to the instance and invoke that started it.
+type ParentRef struct {
+	Machine  string `json:"machine"`
+	Instance string `json:"instance"`
+	Invoke   string `json:"invoke"`
+}
+
+// childSet holds the running children of one instance and implements
+// registrystatechart.Invoker for its runtime.
+type childSet struct {
+	mid, iid string
+	mu       sync.Mutex
+	paused   bool
+	children map[string]InvokeRecord
+}
+
+func getChildSet(mid, iid string) *childSet {
+	key := mid + ":" + iid
+	v, _ := instanceChildren.LoadOrStore(key, &childSet{
+		mid:      mid,
+		iid:      iid,
+		children: make(map[string]InvokeRecord),
+	})
+	return v.(*childSet)
+}
+
+// Invoke starts a child instance under a new ID. The caller holds the
+// parent's instance mutex, so the child reports its completion asynchronously.
+func (cs *childSet) Invoke(id, machine string, data map[string]any) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.paused {
+		return nil
+	}
+	if old, ok := cs.children[id]; ok {
+		delete(cs.children, id)
+		stopChild(old)
+	}
+	m, err := resolveMachine(machine)
+	if err != nil {
+		return err
+	}
+	// The child starts from its data as stored, like an instance created over HTTP.
+	initialBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshal data: %w", err)
+	}
+	var initial any
+	if err := json.Unmarshal(initialBytes, &initial); err != nil {
+		return fmt.Errorf("unmarshal data: %w", err)
+	}
+	rec := InvokeRecord{Invoke: id, Machine: m.Name, Instance: uuid.NewString()}
+	mu := getInstanceMutex(rec.Machine, rec.Instance)
+	mu.Lock()
+	defer mu.Unlock()
+	state := &InstanceState{
+		Initial: json.RawMessage(initialBytes),
+		History: []EventLog{},
+		Parent:  &ParentRef{Machine: cs.mid, Instance: cs.iid, Invoke: id},
+		// Pinned like an instance created over HTTP.
+		MachineVersion: m.Version,
+	}
+	if _, err := startInstance(rec.Machine, rec.Instance, m.Machine, initial, state); err != nil {
+		return err
+	}
+	cs.children[id] = rec
+	slog.Info("child started", "mid", cs.mid, "iid", cs.iid, "invoke", id, "child_mid", rec.Machine, "child_iid", rec.Instance)
+	return nil
+}
+
+func (cs *childSet) CancelInvoke(id string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.paused {
+		return
+	}
+	if rec, ok := cs.children[id]; ok {
+		delete(cs.children, id)
+		stopChild(rec)
+	}
+}
+
+// pause ignores invoke/cancel calls, e.g. while history is replayed.
+func (cs *childSet) pause() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.paused = true
+}
+
+// resume re-enables invoking and tracks exactly the given children.
+func (cs *childSet) resume(records []InvokeRecord) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.paused = false
+	cs.children = make(map[string]InvokeRecord, len(records))
+	for _, rec := range records {
+		cs.children[rec.Invoke] = rec
+	}
+}
+
+// finish forgets the child started under id if it is still instance.
+// A false result means the child was cancelled or replaced meanwhile.
+func (cs *childSet) finish(id, instance string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if rec, ok := cs.children[id]; !ok || rec.Instance != instance {
+		return false
+	}
+	delete(cs.children, id)
+	return true
+}
+
+func (cs *childSet) records() []InvokeRecord {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	out := make([]InvokeRecord, 0, len(cs.children))
+	for _, rec := range cs.children {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Invoke < out[j].Invoke })
+	return out
+}
+
+// cancelAll removes every child, e.g. when the parent itself is removed.
+func (cs *childSet) cancelAll() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for id, rec := range cs.children {
+		delete(cs.children, id)
+		stopChild(rec)
+	}
+}
+
+func stopChild(rec InvokeRecord) {
+	mu := getInstanceMutex(rec.Machine, rec.Instance)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := removeInstance(rec.Machine, rec.Instance); err != nil {
+		slog.Warn("cancel child failed", "invoke", rec.Invoke, "child_mid", rec.Machine, "child_iid", rec.Instance, "err", err)
+		return
+	}
+	slog.Info("child cancelled", "invoke", rec.Invoke, "child_mid", rec.Machine, "child_iid", rec.Instance)
+}
+
+// notifyParent delivers done.invoke.<id> to the parent of a child that has
+// just completed. It runs asynchronously, as the caller holds the child's
+// instance mutex and the parent's may be held while it waits for the child.
+func notifyParent(mid, iid string, state *InstanceState, rt *statechartx.Runtime) {
+	if state.Parent == nil || state.Status != StatusCompleted {
+		return
+	}
+	parent := *state.Parent
+	result := rt.Ctx().GetAll()
+	go deliverInvokeDone(parent, iid, result)
+}
+
+func deliverInvokeDone(p ParentRef, childIID string, result map[string]any) {
+	mu := getInstanceMutex(p.Machine, p.Instance)
+	mu.Lock()
+	defer mu.Unlock()
+	event := registrystatechart.DoneInvokeEventPrefix + p.Invoke
+	state, ok, err := loadInstanceState(p.Machine, p.Instance)
+	if err != nil || !ok {
+		slog.Warn("child completed for missing parent", "mid", p.Machine, "iid", p.Instance, "err", err)
+		return
+	}
+	aug, err := instanceMachine(p.Machine, state)
+	if err != nil {
+		slog.Error("parent machine lookup failed", "mid", p.Machine, "iid", p.Instance, "err", err)
+		return
+	}
+	rt, err := loadRuntime(p.Machine, p.Instance, aug, state)
+	if err != nil {
+		slog.Error("parent runtime load failed", "mid", p.Machine, "iid", p.Instance, "err", err)
+		return
+	}
+	// Checked once the runtime is loaded, which restores the persisted children.
+	if !getChildSet(p.Machine, p.Instance).finish(p.Invoke, childIID) {
+		slog.Info("child completed after it was cancelled", "mid", p.Machine, "iid", p.Instance, "invoke", p.Invoke, "child_iid", childIID)
+		return
+	}
+	if _, ok := aug.EventIDByName[event]; !ok || aug.Completed(rt) {
+		slog.Info("invoke done event has no transition", "mid", p.Machine, "iid", p.Instance, "event", event)
+		state.Invoked = getChildSet(p.Machine, p.Instance).records()
+		if err := saveInstanceState(p.Machine, p.Instance, state); err != nil {
+			slog.Error("save failed", "mid", p.Machine, "iid", p.Instance, "err", err)
+		}
+		return
+	}
+	if err := applyEvent(p.Machine, p.Instance, aug, rt, state, event, result); err != nil {
+		slog.Error("invoke done event failed", "mid", p.Machine, "iid", p.Instance, "event", event, "err", err)
+		return
+	}
+	slog.Info("child completed", "mid", p.Machine, "iid", p.Instance, "invoke", p.Invoke, "child_iid", childIID)
+}
@@ -0,0 +1,195 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/comalice/maelstrom/registry"
+	registrystatechart "github.com/comalice/maelstrom/registry/statechart"
+	"github.com/comalice/statechartx"
+	"github.com/go-chi/chi/v5"
+)
+
+// MigrationEvent is the type of the event log entry a migration appends.
+// Its data is the MigrationRecord; replay starts after the last one.
+const MigrationEvent = "migration"
+
+// MigrationRecord is one migration of an instance to another machine version.
+// Events is the index of its entry in the event log: the events before it are
+// folded into the new initial context.
+type MigrationRecord struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	FromState string    `json:"fromState"`
+	ToState   string    `json:"toState"`
+	Events    int       `json:"events"`
+	At        time.Time `json:"at"`
+}
+
+type MigrateResp struct {
+	registrystatechart.MigrationPlan
+	From   string `json:"from"`
+	To     string `json:"to"`
+	DryRun bool   `json:"dryRun"`
+	// Current is the state the migrated instance is in; empty on dry runs.
+	Current string `json:"current,omitempty"`
+}
+
+// migrateInstance moves an instance onto another version of its machine
+// (?to=2.0, the latest without it) using the `migrations:` entry of the target
+// spec. With ?dry_run=true it only reports the plan, including the old states
+// that have no counterpart; a migration whose plan is not ready is refused
+// with 409 and the plan. The migrated instance resumes in the mapped state
+// with the migrated context and history memory, without running the state's
+// entry: actions again; its timeouts and invokes start over. Pending delayed
+// sends are kept. Its event log is kept and gets a MigrationEvent entry, so
+// stream indexes carry on.
+func migrateInstance(w http.ResponseWriter, r *http.Request) {
+	mid := machineName(r)
+	iid := chi.URLParam(r, "instID")
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid dry_run %q", v), http.StatusBadRequest)
+			return
+		}
+		dryRun = b
+	}
+	mu := getInstanceMutex(mid, iid)
+	mu.Lock()
+	defer mu.Unlock()
+	state, ok, err := loadInstanceState(mid, iid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("load instance: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	old, err := instanceMachine(mid, state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	target, err := resolveMachine(registry.MachineRef(mid, r.URL.Query().Get("to")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if target.Version == state.MachineVersion {
+		http.Error(w, fmt.Sprintf("instance already runs %s", target.Ref()), http.StatusConflict)
+		return
+	}
+	rt, err := loadRuntime(mid, iid, old, state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rt.EmbedContext()
+	aug := target.Machine
+	plan := aug.PlanMigration(old, aug.Spec.MigrationFrom(state.MachineVersion), old.StatePathByID[rt.GetCurrentState()], rt.Ctx().GetAll(), state.Remembered)
+	resp := MigrateResp{MigrationPlan: plan, From: state.MachineVersion, To: target.Version, DryRun: dryRun}
+	if !dryRun && !plan.Ready() {
+		writeMigrateResp(w, http.StatusConflict, resp)
+		return
+	}
+	if !dryRun {
+		migrated, err := commitMigration(mid, iid, old, rt, aug, state, target.Version, plan)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Current = aug.StatePathByID[migrated.GetCurrentState()]
+	}
+	writeMigrateResp(w, http.StatusOK, resp)
+}
+
+// commitMigration stops the instance's runtime and state timeouts and resumes
+// it on aug as planned, appending a MigrationEvent to its event log. Resuming
+// arms the timeouts and starts the invokes of the new state; the old children
+// are stopped once the migrated instance is saved. Callers must hold the
+// instance mutex.
+func commitMigration(mid, iid string, old *registrystatechart.AugmentedMachine, rt *statechartx.Runtime, aug *registrystatechart.AugmentedMachine, state *InstanceState, version string, plan registrystatechart.MigrationPlan) (*statechartx.Runtime, error) {
+	initial, err := json.Marshal(plan.Context)
+	if err != nil {
+		return nil, fmt.Errorf("marshal migrated context: %w", err)
+	}
+	record := MigrationRecord{
+		From:      state.MachineVersion,
+		To:        version,
+		FromState: plan.FromState,
+		ToState:   plan.ToState,
+		Events:    len(state.History),
+		At:        time.Now().UTC(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("marshal migration: %w", err)
+	}
+	next := &InstanceState{
+		Initial: initial,
+		History: append(state.History[:len(state.History):len(state.History)], EventLog{
+			Type: MigrationEvent,
+			Data: data,
+			From: plan.FromState,
+			To:   plan.ToState,
+			Diff: contextDiff(rt.Ctx().GetAll(), plan.Context),
+		}),
+		Parent:         state.Parent,
+		IdempotencyKey: state.IdempotencyKey,
+		MachineVersion: version,
+		StartState:     plan.ToState,
+		Remembered:     plan.Remembered,
+		Migrations:     append(state.Migrations[:len(state.Migrations):len(state.Migrations)], record),
+		Version:        state.Version,
+	}
+
+	if v, ok := instances.Load(mid); ok {
+		v.(*sync.Map).Delete(iid)
+	}
+	if err := old.Stop(rt); err != nil {
+		slog.Warn("failed to stop runtime before migration", "mid", mid, "iid", iid, "err", err)
+	}
+	// Delayed sends do not belong to a state and stay pending.
+	var sends []TimerRecord
+	ts := getTimerSet(mid, iid)
+	for _, rec := range ts.records() {
+		if rec.Send != "" {
+			sends = append(sends, rec)
+		}
+	}
+	ts.resume(sends)
+	// Detached, not stopped: a failed migration gets them back.
+	cs := getChildSet(mid, iid)
+	children := cs.records()
+	cs.resume(nil)
+	migrated, err := runInstance(mid, iid, aug, plan.Context, next, appendInstanceEvent)
+	if err != nil {
+		// The stored instance is unchanged; bring its old runtime and children back.
+		if _, rerr := buildRuntime(mid, iid, old, state, replayRecorded); rerr != nil {
+			slog.Error("restore runtime after failed migration", "mid", mid, "iid", iid, "err", rerr)
+		}
+		return nil, fmt.Errorf("migrate instance: %w", err)
+	}
+	for _, child := range children {
+		stopChild(child)
+	}
+	publishEvent(mid, iid, next)
+	slog.Info("instance migrated", "mid", mid, "iid", iid, "from", state.MachineVersion, "to", version, "state", plan.ToState)
+	return migrated, nil
+}
+
+func writeMigrateResp(w http.ResponseWriter, status int, resp MigrateResp) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("json encode", "err", err)
+	}
+}
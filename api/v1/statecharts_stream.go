@@ -0,0 +1,228 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var instanceStreams sync.Map // mid:iid -> *streamHub
+
+// streamKeepAlive is how often an idle stream sends an SSE comment so proxies keep it open.
+const streamKeepAlive = 15 * time.Second
+
+// StreamEvent is one SSE message: a processed event and its position in the event log.
+// The position is also the SSE id, so clients resume with Last-Event-ID.
+type StreamEvent struct {
+	Index int `json:"index"`
+	EventLog
+}
+
+// streamHub fans out the processed events of one instance to its subscribers.
+// A hub is removed from instanceStreams once its last subscriber leaves; closed
+// marks it so a concurrent subscribe goes to a fresh hub instead.
+type streamHub struct {
+	key    string
+	mu     sync.Mutex
+	subs   map[chan StreamEvent]struct{}
+	closed bool
+}
+
+// subscribeStream subscribes to the instance's hub, creating it if needed.
+func subscribeStream(mid, iid string) (*streamHub, chan StreamEvent) {
+	key := mid + ":" + iid
+	for {
+		v, _ := instanceStreams.LoadOrStore(key, &streamHub{key: key, subs: make(map[chan StreamEvent]struct{})})
+		h := v.(*streamHub)
+		if ch, ok := h.subscribe(); ok {
+			return h, ch
+		}
+	}
+}
+
+// closeStreamHub disconnects every subscriber of a deleted instance.
+func closeStreamHub(mid, iid string) {
+	key := mid + ":" + iid
+	if v, ok := instanceStreams.LoadAndDelete(key); ok {
+		h := v.(*streamHub)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.closed = true
+		for ch := range h.subs {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe fails once the hub is closed.
+func (h *streamHub) subscribe() (chan StreamEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	ch := make(chan StreamEvent, 64)
+	h.subs[ch] = struct{}{}
+	return ch, true
+}
+
+func (h *streamHub) unsubscribe(ch chan StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+		h.closeIfEmpty()
+	}
+}
+
+// publish never blocks: a subscriber that falls behind is disconnected and
+// catches up by reconnecting with Last-Event-ID.
+func (h *streamHub) publish(evt StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- evt:
+		default:
+			slog.Warn("stream subscriber too slow, disconnecting", "index", evt.Index)
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+	h.closeIfEmpty()
+}
+
+// closeIfEmpty removes a hub without subscribers; h.mu must be held.
+func (h *streamHub) closeIfEmpty() {
+	if len(h.subs) == 0 && !h.closed {
+		h.closed = true
+		instanceStreams.CompareAndDelete(h.key, h)
+	}
+}
+
+// publishEvent streams the last entry of the instance's event log.
+func publishEvent(mid, iid string, state *InstanceState) {
+	v, ok := instanceStreams.Load(mid + ":" + iid)
+	if !ok {
+		return
+	}
+	idx := len(state.History) - 1
+	v.(*streamHub).publish(StreamEvent{Index: idx, EventLog: state.History[idx]})
+}
+
+// contextDiff returns the keys whose values changed between before and after;
+// removed keys map to nil.
+func contextDiff(before, after map[string]any) map[string]any {
+	diff := map[string]any{}
+	for k, v := range after {
+		if old, ok := before[k]; !ok || !reflect.DeepEqual(old, v) {
+			diff[k] = v
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			diff[k] = nil
+		}
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	return diff
+}
+
+// streamInstance serves the instance's processed events as Server-Sent Events.
+// With Last-Event-ID (header or last_event_id query) the log entries after that
+// index are sent first; otherwise only new events are streamed.
+func streamInstance(w http.ResponseWriter, r *http.Request) {
+	mid := machineName(r)
+	iid := chi.URLParam(r, "instID")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	next := -1
+	if lastID != "" {
+		n, err := strconv.Atoi(lastID)
+		if err != nil || n < -1 {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %q", lastID), http.StatusBadRequest)
+			return
+		}
+		next = n + 1
+	}
+
+	// Subscribe under the instance mutex so no event falls between backlog and live stream.
+	mu := getInstanceMutex(mid, iid)
+	mu.Lock()
+	state, ok, err := loadInstanceState(mid, iid)
+	if err != nil || !ok {
+		mu.Unlock()
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	hub, ch := subscribeStream(mid, iid)
+	var backlog []StreamEvent
+	if next >= 0 {
+		for i := next; i < len(state.History); i++ {
+			backlog = append(backlog, StreamEvent{Index: i, EventLog: state.History[i]})
+		}
+	}
+	mu.Unlock()
+	defer hub.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, evt := range backlog {
+		if err := writeStreamEvent(w, evt); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt, open := <-ch:
+			if !open {
+				return
+			}
+			if err := writeStreamEvent(w, evt); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, evt StreamEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		slog.Error("stream marshal", "index", evt.Index, "err", err)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: transition\ndata: %s\n\n", evt.Index, data)
+	return err
+}
@@ -0,0 +1,627 @@
+package v1
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/comalice/maelstrom/config"
+	"github.com/comalice/maelstrom/internal/store"
+	"github.com/comalice/maelstrom/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAPI serves the v1 routes over a registry and instance store of its own,
+// swapped into the package globals for the duration of a test.
+type testAPI struct {
+	*httptest.Server
+	t   *testing.T
+	reg *registry.Registry
+	dir string
+}
+
+func newTestAPI(t *testing.T, files map[string]string) *testAPI {
+	t.Helper()
+	dir := t.TempDir()
+	reg := registry.New()
+	reg.SetDir(dir)
+	reg.SetConfig(&config.AppConfig{AgentsDir: filepath.Join(dir, "agents"), RuntimeDir: filepath.Join(dir, "runtime")})
+	api := &testAPI{t: t, reg: reg, dir: dir}
+	for name, src := range files {
+		api.addFile(name, src)
+	}
+	prevReg, prevStore := registry.GlobalRegistry, instanceStore
+	registry.GlobalRegistry = reg
+	SetInstanceStore(store.NewFileStore(filepath.Join(dir, "instances")))
+	augCache.Clear()
+	instances.Clear()
+	api.Server = httptest.NewServer(Router())
+	t.Cleanup(func() {
+		api.Close()
+		registry.GlobalRegistry = prevReg
+		SetInstanceStore(prevStore)
+		augCache.Clear()
+		instances.Clear()
+	})
+	return api
+}
+
+// addFile writes a registry file and imports it.
+func (a *testAPI) addFile(name, src string) {
+	a.t.Helper()
+	require.NoError(a.t, os.WriteFile(filepath.Join(a.dir, name), []byte(src), 0o644))
+	require.NoError(a.t, a.reg.Import(name))
+}
+
+// do sends a request with an optional JSON body and returns the status and body.
+func (a *testAPI) do(method, path, body string, header ...string) (int, string) {
+	a.t.Helper()
+	req, err := http.NewRequest(method, a.URL+path, strings.NewReader(body))
+	require.NoError(a.t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(a.t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(a.t, err)
+	return resp.StatusCode, string(b)
+}
+
+// decode unmarshals a JSON response body into a map.
+func decode(t *testing.T, body string) map[string]any {
+	t.Helper()
+	var out map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &out), body)
+	return out
+}
+
+const flowV1 = `name: flow
+machine:
+  id: flow
+  initial: a
+  states:
+    a:
+      on:
+        next: {target: b}
+    b: {}
+`
+
+const flowV2 = `name: flow
+machine:
+  id: flow
+  initial: a
+  states:
+    a:
+      on:
+        go: {target: c}
+    c: {}
+`
+
+func TestStatecharts_VersionRouting(t *testing.T) {
+	api := newTestAPI(t, map[string]string{"flow-v1.0.yaml": flowV1})
+
+	status, body := api.do("GET", "/statecharts/", "")
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `["flow@1.0"]`, body)
+
+	status, body = api.do("POST", "/statecharts/flow/instances", `{"id":"i1"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	assert.JSONEq(t, `{"id":"i1","current":"flow.a","machine":"flow","version":"1.0"}`, body)
+
+	api.addFile("flow-v2.0.yaml", flowV2)
+	_, body = api.do("GET", "/statecharts/", "")
+	assert.JSONEq(t, `["flow@1.0","flow@2.0"]`, body)
+
+	// A bare name and @latest create on the newest version, an exact version pins.
+	for ref, want := range map[string]string{"flow": "2.0", "flow@latest": "2.0", "flow@1.0": "1.0"} {
+		status, body = api.do("POST", "/statecharts/"+ref+"/instances", `{}`)
+		require.Equal(t, http.StatusOK, status, body)
+		assert.Equal(t, want, decode(t, body)["version"], ref)
+	}
+	status, body = api.do("POST", "/statecharts/flow@9.0/instances", `{}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, body, `machine "flow@9.0" not found`)
+
+	// i1 keeps running on 1.0, whatever version the URL names.
+	status, body = api.do("POST", "/statecharts/flow/instances/i1/events", `{"type":"next"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "flow.b", decode(t, body)["current"])
+	status, body = api.do("GET", "/statecharts/flow@2.0/instances/i1", "")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "1.0", decode(t, body)["version"])
+
+	status, body = api.do("POST", "/statecharts/flow/instances", `{"id":"i2"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	status, _ = api.do("POST", "/statecharts/flow/instances/i2/events", `{"type":"next"}`)
+	assert.Equal(t, http.StatusBadRequest, status, "next is not an event of 2.0")
+}
+
+func TestCreateInstance_IDsAndIdempotency(t *testing.T) {
+	api := newTestAPI(t, map[string]string{"flow-v1.0.yaml": flowV1})
+
+	// A client-supplied ID is used as it is; a second create with it conflicts.
+	status, body := api.do("POST", "/statecharts/flow/instances", `{"id":"order-42"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "order-42", decode(t, body)["id"])
+	status, body = api.do("POST", "/statecharts/flow/instances", `{"id":"order-42"}`)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, body, `instance "order-42" already exists`)
+
+	for _, id := range []string{"../etc", ".hidden", "a b", "-x", strings.Repeat("a", 129)} {
+		status, body = api.do("POST", "/statecharts/flow/instances", `{"id":"`+id+`"}`)
+		assert.Equal(t, http.StatusBadRequest, status, id)
+		assert.Contains(t, body, "invalid instance id", id)
+	}
+	status, _ = api.do("POST", "/statecharts/flow/instances", `{`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Without an ID every create gets a new one.
+	_, body = api.do("POST", "/statecharts/flow/instances", `{}`)
+	first := decode(t, body)["id"]
+	_, body = api.do("POST", "/statecharts/flow/instances", `{}`)
+	assert.NotEqual(t, first, decode(t, body)["id"])
+
+	// A retry with the same idempotency key and body returns the same instance,
+	// also after it has moved on.
+	create := `{"initialContext":{"n":1}}`
+	status, body = api.do("POST", "/statecharts/flow/instances", create, "Idempotency-Key", "k1")
+	require.Equal(t, http.StatusOK, status, body)
+	id := decode(t, body)["id"].(string)
+	status, _ = api.do("POST", "/statecharts/flow/instances/"+id+"/events", `{"type":"next"}`)
+	require.Equal(t, http.StatusOK, status)
+	status, body = api.do("POST", "/statecharts/flow/instances", create, "Idempotency-Key", "k1")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.JSONEq(t, `{"id":"`+id+`","current":"flow.b","machine":"flow","version":"1.0"}`, body)
+
+	// The same key with another body, or reusing a key-less ID, is a conflict.
+	status, _ = api.do("POST", "/statecharts/flow/instances", `{"initialContext":{"n":2}}`, "Idempotency-Key", "k1")
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = api.do("POST", "/statecharts/flow/instances", `{"id":"order-42"}`, "Idempotency-Key", "k2")
+	assert.Equal(t, http.StatusConflict, status)
+
+	// A key can come with a client ID; retries match on both.
+	for range 2 {
+		status, body = api.do("POST", "/statecharts/flow/instances", `{"id":"order-43"}`, "Idempotency-Key", "k3")
+		require.Equal(t, http.StatusOK, status, body)
+		assert.Equal(t, "order-43", decode(t, body)["id"])
+	}
+	status, _ = api.do("POST", "/statecharts/flow/instances", `{"id":"order-43"}`, "Idempotency-Key", "k4")
+	assert.Equal(t, http.StatusConflict, status)
+}
+
+const tickerSpec = `name: ticker
+machine:
+  id: ticker
+  initial: running
+  states:
+    running:
+      on:
+        tick:
+          target: running
+          action: {assign: {n: "(ctx.n ?? 0) + 1"}}
+`
+
+// sseStream is an open event stream read frame by frame.
+type sseStream struct {
+	t      *testing.T
+	resp   *http.Response
+	r      *bufio.Reader
+	cancel context.CancelFunc
+}
+
+// stream opens path as an event stream; the request is cancelled on cleanup.
+func (a *testAPI) stream(path string, header ...string) *sseStream {
+	a.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	a.t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", a.URL+path, nil)
+	require.NoError(a.t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(a.t, err)
+	a.t.Cleanup(func() { resp.Body.Close() })
+	return &sseStream{t: a.t, resp: resp, r: bufio.NewReader(resp.Body), cancel: cancel}
+}
+
+// next reads one SSE frame into its fields, skipping comments.
+func (s *sseStream) next() map[string]string {
+	s.t.Helper()
+	frame := map[string]string{}
+	for {
+		line, err := s.r.ReadString('\n')
+		require.NoError(s.t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && len(frame) > 0:
+			return frame
+		case line == "", strings.HasPrefix(line, ":"):
+		default:
+			field, value, _ := strings.Cut(line, ": ")
+			frame[field] = value
+		}
+	}
+}
+
+func subscribers(mid, iid string) int {
+	v, ok := instanceStreams.Load(mid + ":" + iid)
+	if !ok {
+		return 0
+	}
+	h := v.(*streamHub)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func TestStreamInstance(t *testing.T) {
+	api := newTestAPI(t, map[string]string{"ticker.yaml": tickerSpec})
+	status, body := api.do("POST", "/statecharts/ticker/instances", `{"id":"t1"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	tick := func() {
+		status, body := api.do("POST", "/statecharts/ticker/instances/t1/events", `{"type":"tick","data":{"by":"test"}}`)
+		require.Equal(t, http.StatusOK, status, body)
+	}
+
+	// A fresh stream only sees new events, framed with their log index as id.
+	live := api.stream("/statecharts/ticker/instances/t1/stream")
+	require.Equal(t, http.StatusOK, live.resp.StatusCode)
+	assert.Equal(t, "text/event-stream", live.resp.Header.Get("Content-Type"))
+	tick()
+	frame := live.next()
+	assert.Equal(t, "0", frame["id"])
+	assert.Equal(t, "transition", frame["event"])
+	var evt StreamEvent
+	require.NoError(t, json.Unmarshal([]byte(frame["data"]), &evt))
+	assert.Equal(t, 0, evt.Index)
+	assert.Equal(t, "tick", evt.Type)
+	assert.JSONEq(t, `{"by":"test"}`, string(evt.Data))
+	assert.Equal(t, map[string]any{"n": float64(1)}, evt.Diff)
+
+	tick()
+	tick()
+	assert.Equal(t, "1", live.next()["id"])
+	assert.Equal(t, "2", live.next()["id"])
+
+	// Resuming sends the events after Last-Event-ID, then the live ones.
+	resumed := api.stream("/statecharts/ticker/instances/t1/stream", "Last-Event-ID", "0")
+	assert.Equal(t, "1", resumed.next()["id"])
+	assert.Equal(t, "2", resumed.next()["id"])
+	tick()
+	assert.Equal(t, "3", resumed.next()["id"])
+	assert.Equal(t, "3", live.next()["id"])
+	fromQuery := api.stream("/statecharts/ticker/instances/t1/stream?last_event_id=2")
+	assert.Equal(t, "3", fromQuery.next()["id"])
+
+	// A client that disconnects is unsubscribed.
+	require.Eventually(t, func() bool { return subscribers("ticker", "t1") == 3 }, time.Second, 5*time.Millisecond)
+	live.cancel()
+	fromQuery.cancel()
+	require.Eventually(t, func() bool { return subscribers("ticker", "t1") == 1 }, time.Second, 5*time.Millisecond)
+
+	// The hub goes with the last subscriber and comes back with the next one.
+	resumed.cancel()
+	require.Eventually(t, func() bool {
+		_, ok := instanceStreams.Load("ticker:t1")
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	tick()
+	resumed = api.stream("/statecharts/ticker/instances/t1/stream", "Last-Event-ID", "3")
+	assert.Equal(t, "4", resumed.next()["id"])
+	tick()
+	assert.Equal(t, "5", resumed.next()["id"])
+	assert.Equal(t, 1, subscribers("ticker", "t1"))
+
+	// Deleting the instance ends the remaining stream.
+	status, _ = api.do("DELETE", "/statecharts/ticker/instances/t1", "")
+	require.Equal(t, http.StatusOK, status)
+	_, err := io.ReadAll(resumed.r)
+	assert.NoError(t, err)
+
+	status, _ = api.do("GET", "/statecharts/ticker/instances/t1/stream", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	api.do("POST", "/statecharts/ticker/instances", `{"id":"t2"}`)
+	status, body = api.do("GET", "/statecharts/ticker/instances/t2/stream", "", "Last-Event-ID", "x")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, `invalid Last-Event-ID "x"`)
+}
+
+const counterAgent = `name: counter
+cost_per_hour: 1
+machine:
+  id: counter
+  initial: counting
+  states:
+    counting:
+      on:
+        add:
+          target: counting
+          action: {assign: {total: "(ctx.total ?? 0) + evt.n"}}
+`
+
+func TestAgents(t *testing.T) {
+	api := newTestAPI(t, nil)
+	agentsDir := filepath.Join(api.dir, "agents")
+	require.NoError(t, os.MkdirAll(agentsDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(agentsDir, "counter.yaml"), []byte(counterAgent), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(agentsDir, "pricey.yaml"), []byte(strings.Replace(counterAgent, "cost_per_hour: 1", "cost_per_hour: 5", 1)), 0o644))
+	t.Cleanup(func() {
+		for _, a := range api.reg.Agents() {
+			_ = api.reg.RetireAgent(a.ID)
+		}
+	})
+
+	status, body := api.do("POST", "/agents/", `{"template":"counter","initialContext":{"total":10}}`)
+	require.Equal(t, http.StatusCreated, status, body)
+	hired := decode(t, body)
+	id := hired["id"].(string)
+	assert.Equal(t, "counter.counting", hired["current"])
+	assert.Equal(t, map[string]any{"total": float64(10)}, hired["context"])
+
+	// Messages are delivered in order and end up in the history.
+	for _, n := range []int{2, 3} {
+		status, body = api.do("POST", "/agents/"+id+"/messages", `{"event":"add","data":{"n":`+strconv.Itoa(n)+`}}`)
+		require.Equal(t, http.StatusAccepted, status, body)
+	}
+	require.Eventually(t, func() bool {
+		_, body := api.do("GET", "/agents/"+id, "")
+		return decode(t, body)["handled"] == float64(2)
+	}, time.Second, 5*time.Millisecond)
+	_, body = api.do("GET", "/agents/"+id, "")
+	assert.Equal(t, map[string]any{"total": float64(15)}, decode(t, body)["context"])
+	_, body = api.do("GET", "/agents/"+id+"/mailbox", "")
+	assert.JSONEq(t, `[]`, body)
+	_, body = api.do("GET", "/agents/"+id+"/history", "")
+	var history []registry.AgentMessage
+	require.NoError(t, json.Unmarshal([]byte(body), &history))
+	require.Len(t, history, 2)
+	assert.Equal(t, "add", history[0].Event)
+	assert.Equal(t, map[string]any{"n": float64(3)}, history[1].Data)
+	status, _ = api.do("POST", "/agents/"+id+"/messages", `null`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Unknown agents and templates are 404s.
+	for _, req := range [][2]string{{"GET", "/agents/nobody"}, {"GET", "/agents/nobody/mailbox"},
+		{"GET", "/agents/nobody/history"}, {"POST", "/agents/nobody/messages"}, {"DELETE", "/agents/nobody"}} {
+		status, _ = api.do(req[0], req[1], `{"event":"add"}`)
+		assert.Equal(t, http.StatusNotFound, status, req)
+	}
+	status, _ = api.do("POST", "/agents/", `{"template":"missing"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = api.do("POST", "/agents/", `{"template":"../counter"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// A full pool is 429, a hire over the hourly budget 402.
+	api.reg.MaxAgents = 2
+	status, body = api.do("POST", "/agents/", `{"template":"counter"}`)
+	require.Equal(t, http.StatusCreated, status, body)
+	status, body = api.do("POST", "/agents/", `{"template":"counter"}`)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Contains(t, body, registry.ErrMaxAgents.Error())
+	api.reg.CostPerHour = 3
+	status, body = api.do("DELETE", "/agents/"+id, "")
+	require.Equal(t, http.StatusNoContent, status, body)
+	status, body = api.do("POST", "/agents/", `{"template":"pricey"}`)
+	assert.Equal(t, http.StatusPaymentRequired, status)
+	assert.Contains(t, body, registry.ErrBudgetExceeded.Error())
+
+	status, _ = api.do("GET", "/agents/"+id, "")
+	assert.Equal(t, http.StatusNotFound, status)
+	_, body = api.do("GET", "/agents/", "")
+	assert.Len(t, decodeList(t, body), 1)
+}
+
+// decodeList unmarshals a JSON array response body.
+func decodeList(t *testing.T, body string) []any {
+	t.Helper()
+	var out []any
+	require.NoError(t, json.Unmarshal([]byte(body), &out), body)
+	return out
+}
+
+const reviewV1 = `name: review
+machine:
+  id: review
+  initial: draft
+  states:
+    draft:
+      on:
+        submit: {target: check}
+    check:
+      entry:
+        - send: {event: nudge, delay: 1h, id: nudge}
+      invoke: {machine: helper}
+      initial: first
+      states:
+        first:
+          on:
+            next: {target: second}
+        second: {}
+        hist: {history: shallow}
+      on:
+        pause: {target: paused}
+        drop: {target: legacy}
+    paused:
+      on:
+        back: {target: check.hist}
+    legacy: {}
+`
+
+const reviewV2 = `name: review
+machine:
+  id: review
+  initial: draft
+  states:
+    draft:
+      on:
+        submit: {target: approve}
+    approve:
+      timeout: 1h
+      entry:
+        - assign: {entered: "(ctx.entered ?? 0) + 1"}
+      invoke: {machine: helper}
+      initial: first
+      states:
+        first: {}
+        second: {}
+        hist: {history: shallow}
+      on:
+        approve: {target: closed}
+        nudge: {target: approve}
+    closed: {}
+migrations:
+  - from: "1.0"
+    states:
+      review.check: review.approve
+    context:
+      tries: (ctx.tries ?? 0) + 1
+`
+
+const helperSpec = `name: helper
+machine:
+  id: helper
+  initial: idle
+  states:
+    idle: {}
+`
+
+func TestMigrateInstance(t *testing.T) {
+	api := newTestAPI(t, map[string]string{"review-v1.0.yaml": reviewV1, "helper.yaml": helperSpec})
+	send := func(id string, events ...string) {
+		t.Helper()
+		for _, evt := range events {
+			status, body := api.do("POST", "/statecharts/review/instances/"+id+"/events", `{"type":"`+evt+`"}`)
+			require.Equal(t, http.StatusOK, status, body)
+		}
+	}
+	get := func(id string) map[string]any {
+		t.Helper()
+		status, body := api.do("GET", "/statecharts/review/instances/"+id, "")
+		require.Equal(t, http.StatusOK, status, body)
+		return decode(t, body)
+	}
+	// The only child an instance has invoked.
+	child := func(inst map[string]any) string {
+		t.Helper()
+		invoked, _ := inst["invoked"].([]any)
+		require.Len(t, invoked, 1)
+		return invoked[0].(map[string]any)["instance"].(string)
+	}
+	for _, id := range []string{"r1", "r2"} {
+		status, body := api.do("POST", "/statecharts/review/instances", `{"id":"`+id+`"}`)
+		require.Equal(t, http.StatusOK, status, body)
+	}
+	// r1 leaves check.second and comes back through its history state.
+	send("r1", "submit", "next", "pause", "back")
+	send("r2", "submit", "drop")
+	before := get("r1")
+	require.Equal(t, "review.check.second", before["current"])
+	assert.Equal(t, map[string]any{"review.check.hist": "review.check.second"}, before["remembered"])
+	oldChild := child(before)
+
+	status, body := api.do("POST", "/statecharts/review/instances/r1/migrate", "")
+	assert.Equal(t, http.StatusConflict, status, "without a newer version")
+	assert.Contains(t, body, "instance already runs review@1.0")
+	api.addFile("review-v2.0.yaml", reviewV2)
+
+	// A dry run reports the plan, including the states 2.0 has no place for.
+	status, body = api.do("POST", "/statecharts/review/instances/r1/migrate?dry_run=true", "")
+	require.Equal(t, http.StatusOK, status, body)
+	plan := decode(t, body)
+	assert.Equal(t, true, plan["dryRun"])
+	assert.Equal(t, "review.approve.second", plan["toState"])
+	assert.Equal(t, []any{"review.legacy", "review.paused"}, plan["unmapped"])
+	assert.Equal(t, map[string]any{"review.approve.hist": "review.approve.second"}, plan["remembered"])
+	assert.NotContains(t, plan, "current")
+	assert.Equal(t, "1.0", get("r1")["version"])
+	status, _ = api.do("POST", "/statecharts/review/instances/r1/migrate?dry_run=maybe", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// An instance in an unmapped state is refused with the plan.
+	status, body = api.do("POST", "/statecharts/review/instances/r2/migrate", "")
+	require.Equal(t, http.StatusConflict, status, body)
+	assert.Equal(t, []any{`state "review.legacy" is not mapped`}, decode(t, body)["errors"])
+	assert.Equal(t, "1.0", get("r2")["version"])
+
+	// Migrating keeps the event log and resumes in the mapped state without
+	// running its entry: actions.
+	live := api.stream("/statecharts/review/instances/r1/stream")
+	status, body = api.do("POST", "/statecharts/review/instances/r1/migrate?to=2.0", "")
+	require.Equal(t, http.StatusOK, status, body)
+	resp := decode(t, body)
+	assert.Equal(t, "review.approve.second", resp["current"])
+	assert.Equal(t, "1.0", resp["from"])
+	assert.Equal(t, "2.0", resp["to"])
+	evt := decodeFrame(t, live.next())
+	assert.Equal(t, 4, evt.Index)
+	assert.Equal(t, MigrationEvent, evt.Type)
+	assert.Equal(t, "review.check.second", evt.From)
+	assert.Equal(t, "review.approve.second", evt.To)
+	assert.Equal(t, map[string]any{"tries": float64(1)}, evt.Diff)
+
+	got := get("r1")
+	assert.Equal(t, "2.0", got["version"])
+	assert.Equal(t, map[string]any{"tries": float64(1)}, got["context"])
+	assert.Equal(t, float64(5), got["history_count"])
+	assert.Equal(t, map[string]any{"review.approve.hist": "review.approve.second"}, got["remembered"])
+	// The new state's timeout is armed next to the pending send, and its
+	// invoke has replaced the old child.
+	var timers []string
+	for _, rec := range got["timers"].([]any) {
+		rec := rec.(map[string]any)
+		timers = append(timers, fmt.Sprint(rec["state"], rec["send"], ":", rec["event"]))
+	}
+	assert.ElementsMatch(t, []string{"review.approve<nil>:timeout", "<nil>nudge:nudge"}, timers)
+	newChild := child(got)
+	assert.NotEqual(t, oldChild, newChild)
+	status, _ = api.do("GET", "/statecharts/helper/instances/"+oldChild, "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = api.do("GET", "/statecharts/helper/instances/"+newChild, "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body = api.do("POST", "/statecharts/review/instances/r1/migrate?to=2.0", "")
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, body, "instance already runs review@2.0")
+
+	// A rebuild resumes the same way and replays only the events after the
+	// migration; timers and children come from the store.
+	instances.Clear()
+	got = get("r1")
+	assert.Equal(t, "review.approve.second", got["current"])
+	assert.Equal(t, map[string]any{"tries": float64(1)}, got["context"])
+	assert.Equal(t, newChild, child(got))
+	send("r1", "approve")
+	assert.Equal(t, 5, decodeFrame(t, live.next()).Index)
+	instances.Clear()
+	assert.Equal(t, "review.closed", get("r1")["current"])
+
+	resumed := api.stream("/statecharts/review/instances/r1/stream", "Last-Event-ID", "3")
+	assert.Equal(t, MigrationEvent, decodeFrame(t, resumed.next()).Type)
+	assert.Equal(t, "approve", decodeFrame(t, resumed.next()).Type)
+
+	status, _ = api.do("POST", "/statecharts/review/instances/r1/migrate?to=9.0", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = api.do("POST", "/statecharts/review/instances/nobody/migrate", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func decodeFrame(t *testing.T, frame map[string]string) StreamEvent {
+	t.Helper()
+	var evt StreamEvent
+	require.NoError(t, json.Unmarshal([]byte(frame["data"]), &evt), frame)
+	return evt
+}
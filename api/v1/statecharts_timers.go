@@ -0,0 +1,315 @@
+package v1
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comalice/maelstrom/registry"
+)
+
+var instanceTimers sync.Map // mid:iid -> *timerSet
+
+// TimerRecord is a pending state timeout or delayed send, persisted with its
+// instance so it can be re-armed after a restart. Sends have an ID (Send), an
+// optional target and event data.
+type TimerRecord struct {
+	State    string    `json:"state,omitempty"`
+	Send     string    `json:"send,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Event    string    `json:"event"`
+	Data     any       `json:"data,omitempty"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// key identifies the timer within its instance: the state for a timeout, the ID for a send.
+func (r TimerRecord) key() string {
+	if r.Send != "" {
+		return "send:" + r.Send
+	}
+	return r.State
+}
+
+// timerSet holds the armed timeouts and sends of one instance and implements
+// registrystatechart.TimerScheduler for its runtime.
+type timerSet struct {
+	mid, iid string
+	mu       sync.Mutex
+	paused   bool
+	pending  map[string]TimerRecord
+	timers   map[string]*time.Timer
+}
+
+func getTimerSet(mid, iid string) *timerSet {
+	key := mid + ":" + iid
+	v, _ := instanceTimers.LoadOrStore(key, &timerSet{
+		mid:     mid,
+		iid:     iid,
+		pending: make(map[string]TimerRecord),
+		timers:  make(map[string]*time.Timer),
+	})
+	return v.(*timerSet)
+}
+
+func stopTimerSet(mid, iid string) {
+	key := mid + ":" + iid
+	if v, ok := instanceTimers.LoadAndDelete(key); ok {
+		v.(*timerSet).stopAll()
+	}
+}
+
+func (ts *timerSet) ScheduleTimeout(state, event string, d time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.paused {
+		return
+	}
+	ts.armLocked(TimerRecord{State: state, Event: event, Deadline: time.Now().Add(d)})
+}
+
+func (ts *timerSet) CancelTimeout(state string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.paused {
+		return
+	}
+	ts.disarmLocked(state)
+}
+
+func (ts *timerSet) ScheduleSend(id, target, event string, data any, d time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.paused {
+		return
+	}
+	ts.armLocked(TimerRecord{Send: id, Target: target, Event: event, Data: data, Deadline: time.Now().Add(d)})
+}
+
+func (ts *timerSet) CancelSend(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.paused {
+		return
+	}
+	ts.disarmLocked(TimerRecord{Send: id}.key())
+}
+
+func (ts *timerSet) armLocked(rec TimerRecord) {
+	key := rec.key()
+	ts.disarmLocked(key)
+	ts.pending[key] = rec
+	ts.timers[key] = time.AfterFunc(time.Until(rec.Deadline), func() {
+		fireTimer(ts.mid, ts.iid, rec)
+	})
+	slog.Info("timer armed", "mid", ts.mid, "iid", ts.iid, "timer", key, "event", rec.Event, "deadline", rec.Deadline)
+}
+
+func (ts *timerSet) disarmLocked(key string) {
+	if t, ok := ts.timers[key]; ok {
+		t.Stop()
+		delete(ts.timers, key)
+	}
+	delete(ts.pending, key)
+}
+
+// pause ignores schedule/cancel calls, e.g. while history is replayed.
+func (ts *timerSet) pause() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.paused = true
+}
+
+// resume re-enables scheduling and re-arms exactly the given records.
+func (ts *timerSet) resume(records []TimerRecord) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.paused = false
+	for key := range ts.pending {
+		ts.disarmLocked(key)
+	}
+	for _, rec := range records {
+		ts.armLocked(rec)
+	}
+}
+
+// take removes rec if it is still the armed timer for its key.
+// A false result means the timer was cancelled or replaced meanwhile.
+func (ts *timerSet) take(rec TimerRecord) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	key := rec.key()
+	cur, ok := ts.pending[key]
+	if !ok || !cur.Deadline.Equal(rec.Deadline) || cur.Event != rec.Event {
+		return false
+	}
+	delete(ts.pending, key)
+	delete(ts.timers, key)
+	return true
+}
+
+func (ts *timerSet) records() []TimerRecord {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := make([]TimerRecord, 0, len(ts.pending))
+	for _, rec := range ts.pending {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Deadline.Before(out[j].Deadline) })
+	return out
+}
+
+func (ts *timerSet) stopAll() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for key := range ts.pending {
+		ts.disarmLocked(key)
+	}
+}
+
+// fireTimer delivers a timeout or a send to its instance and records it in the
+// event log. Sends to other targets are delivered once the sending instance
+// has dropped them from its pending timers.
+func fireTimer(mid, iid string, rec TimerRecord) {
+	if !fireOwnTimer(mid, iid, rec) || rec.Target == "" {
+		return
+	}
+	if err := deliverSend(mid, rec.Target, rec.Event, rec.Data); err != nil {
+		slog.Warn("send failed", "mid", mid, "iid", iid, "send", rec.Send, "target", rec.Target, "event", rec.Event, "err", err)
+		return
+	}
+	slog.Info("send delivered", "mid", mid, "iid", iid, "send", rec.Send, "target", rec.Target, "event", rec.Event)
+}
+
+// fireOwnTimer takes rec from the instance's pending timers and, unless it
+// is a send to another target, applies its event. It reports whether rec was
+// still pending.
+func fireOwnTimer(mid, iid string, rec TimerRecord) bool {
+	mu := getInstanceMutex(mid, iid)
+	mu.Lock()
+	defer mu.Unlock()
+	if !getTimerSet(mid, iid).take(rec) {
+		return false
+	}
+	state, ok, err := loadInstanceState(mid, iid)
+	if err != nil || !ok {
+		slog.Warn("timer fired for missing instance", "mid", mid, "iid", iid, "err", err)
+		return false
+	}
+	remaining := state.Timers[:0]
+	for _, t := range state.Timers {
+		if t.key() != rec.key() {
+			remaining = append(remaining, t)
+		}
+	}
+	state.Timers = remaining
+	if rec.Target != "" {
+		if err := saveInstanceState(mid, iid, state); err != nil {
+			slog.Error("save failed", "mid", mid, "iid", iid, "err", err)
+			return false
+		}
+		return true
+	}
+	aug, err := instanceMachine(mid, state)
+	if err != nil {
+		slog.Error("timer machine lookup failed", "mid", mid, "iid", iid, "err", err)
+		return true
+	}
+	rt, err := loadRuntime(mid, iid, aug, state)
+	if err != nil {
+		slog.Error("timer runtime load failed", "mid", mid, "iid", iid, "err", err)
+		return true
+	}
+	if _, ok := aug.EventIDByName[rec.Event]; !ok || aug.Completed(rt) {
+		slog.Info("timer event has no transition", "mid", mid, "iid", iid, "timer", rec.key(), "event", rec.Event)
+		state.Timers = getTimerSet(mid, iid).records()
+		if err := saveInstanceState(mid, iid, state); err != nil {
+			slog.Error("save failed", "mid", mid, "iid", iid, "err", err)
+		}
+		return true
+	}
+	data := rec.Data
+	if rec.Send == "" {
+		data = map[string]any{"state": rec.State}
+	}
+	if err := applyEvent(mid, iid, aug, rt, state, rec.Event, data); err != nil {
+		slog.Error("timer event failed", "mid", mid, "iid", iid, "event", rec.Event, "err", err)
+		return true
+	}
+	slog.Info("timer fired", "mid", mid, "iid", iid, "timer", rec.key(), "event", rec.Event)
+	return true
+}
+
+// deliverSend delivers an event sent by an instance of machine mid to its
+// target: an instance of the same machine ("<iid>"), an instance of another
+// machine ("<mid>/<iid>") or an agent ("agent:<id>").
+func deliverSend(mid, target, event string, data any) error {
+	if id, ok := strings.CutPrefix(target, "agent:"); ok {
+		return registry.GlobalRegistry.SendMessage(id, map[string]any{"event": event, "data": data})
+	}
+	tmid, tiid := mid, target
+	if m, i, ok := strings.Cut(target, "/"); ok {
+		tmid, tiid = m, i
+	}
+	return dispatchEvent(tmid, tiid, event, data)
+}
+
+// DispatchEvent applies an event to a stored instance like a POST to its
+// events endpoint, e.g. for registry.Registry.NotifyInstance.
+func DispatchEvent(mid, iid, event string, data any) error {
+	return dispatchEvent(mid, iid, event, data)
+}
+
+// dispatchEvent applies an event to a stored instance like a POST to its events endpoint.
+func dispatchEvent(mid, iid, event string, data any) error {
+	mid, _ = registry.ParseMachineRef(mid)
+	mu := getInstanceMutex(mid, iid)
+	mu.Lock()
+	defer mu.Unlock()
+	state, ok, err := loadInstanceState(mid, iid)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("instance %s/%s not found", mid, iid)
+	}
+	aug, err := instanceMachine(mid, state)
+	if err != nil {
+		return err
+	}
+	rt, err := loadRuntime(mid, iid, aug, state)
+	if err != nil {
+		return err
+	}
+	if _, ok := aug.EventIDByName[event]; !ok {
+		return fmt.Errorf("event type %q not found", event)
+	}
+	if aug.Completed(rt) {
+		return fmt.Errorf("instance %s/%s completed", mid, iid)
+	}
+	return applyEvent(mid, iid, aug, rt, state, event, data)
+}
+
+// RestoreTimers re-arms the persisted timeouts and sends of every stored instance.
+// Call it once at startup, after the registry has loaded its machines.
+func RestoreTimers() error {
+	keys, err := instanceStore.List("")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		state, ok, err := loadInstanceState(k.MachineID, k.ID)
+		if err != nil {
+			slog.Warn("restore timers: load failed", "mid", k.MachineID, "iid", k.ID, "err", err)
+			continue
+		}
+		if !ok || len(state.Timers) == 0 {
+			continue
+		}
+		getTimerSet(k.MachineID, k.ID).resume(state.Timers)
+		slog.Info("timers restored", "mid", k.MachineID, "iid", k.ID, "count", len(state.Timers))
+	}
+	return nil
+}
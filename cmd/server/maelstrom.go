@@ -7,16 +7,17 @@ package main
 // @BasePath /
 
 import (
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
-	"encoding/json"
-	"fmt"
 	"strings"
 	"text/tabwriter"
 
-	"github.com/comalice/maelstrom/registry"
+	"github.com/comalice/maelstrom/internal/store"
 	"github.com/comalice/maelstrom/internal/tools"
+	"github.com/comalice/maelstrom/registry"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
@@ -61,19 +62,6 @@ func main() {
 	}
 	slog.Info("app variables loaded", "variables_count", len(cfg.Variables))
 
-
-
-
-
-
-
-
-
-
-
-
-
-
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
 	slog.Info("Starting server", "addr", cfg.ListenAddr)
 
@@ -95,15 +83,28 @@ func main() {
 	GlobalTools.Init()
 	reg.Tools = GlobalTools
 
-	items := reg.List()
 	var machines []string
-	for _, item := range items {
-		if item.Type == "statechart" && item.Active && strings.HasSuffix(item.Filename, ".yaml") {
-			machines = append(machines, strings.TrimSuffix(item.Filename, ".yaml"))
-		}
+	for _, m := range reg.MachineVersions() {
+		machines = append(machines, m.Ref())
 	}
 	slog.Info("statecharts loaded on startup", "count", len(machines), "machines", machines)
 
+	instStore, err := store.Open(cfg.InstanceStore, cfg.InstanceStorePath)
+	if err != nil {
+		slog.Error("failed to open instance store", "backend", cfg.InstanceStore, "error", err)
+		os.Exit(1)
+	}
+	defer instStore.Close()
+	v1.SetInstanceStore(instStore)
+	reg.NotifyInstance = v1.DispatchEvent
+	slog.Info("instance store opened", "backend", cfg.InstanceStore, "path", cfg.InstanceStorePath)
+	if err := v1.RestoreTimers(); err != nil {
+		slog.Warn("failed to restore instance timers", "error", err)
+	}
+	if err := reg.RestoreAgents(); err != nil {
+		slog.Warn("failed to restore agents", "error", err)
+	}
+
 	r := chi.NewRouter()
 
 	// Optional: Basic middleware for logging and panic recovery
@@ -37,7 +37,38 @@ type AppConfig struct {
 	DefaultMaxTokens   *int              `envconfig:"DEFAULT_MAX_TOKENS" desc:"Default max tokens" default:"4096"`
 	DefaultAPIKey      string            `envconfig:"DEFAULT_API_KEY" desc:"Default API key (or env:VAR)"`
 	Variables          map[string]string `envconfig:"APP_VARS" desc:"App variables from APP_* env vars"`
-	MaxLLMCalls       *int              `envconfig:"MAX_LLM_CALLS" desc:"Max global LLM calls" default:"100"`
+	MaxLLMCalls        *int              `envconfig:"MAX_LLM_CALLS" desc:"Max global LLM calls" default:"100"`
+
+	// InstanceStore selects where statechart instances are persisted: file, bbolt or sqlite.
+	// Environment: INSTANCE_STORE
+	// Default: file
+	InstanceStore string `envconfig:"INSTANCE_STORE" desc:"Instance store backend (file, bbolt, sqlite)" default:"file"`
+
+	// InstanceStorePath is the directory (file) or database file (bbolt, sqlite) of the instance store.
+	// Environment: INSTANCE_STORE_PATH
+	// Default: instances, instances.db or instances.sqlite depending on the backend
+	InstanceStorePath string `envconfig:"INSTANCE_STORE_PATH" desc:"Instance store directory or database file"`
+
+	// AgentsDir is the directory of the agent templates hire_agent starts agents from.
+	// Environment: AGENTS_DIR
+	// Default: ./agents
+	AgentsDir string `envconfig:"AGENTS_DIR" desc:"Directory of agent templates" default:"./agents"`
+
+	// RuntimeDir is where hired agents and their mailboxes are persisted.
+	// Environment: RUNTIME_DIR
+	// Default: ./runtime
+	RuntimeDir string `envconfig:"RUNTIME_DIR" desc:"Directory for hired agents and their mailboxes" default:"./runtime"`
+
+	// MaxAgents is the number of agents that may be hired at the same time.
+	// Environment: MAX_AGENTS
+	// Default: 5
+	MaxAgents int `envconfig:"MAX_AGENTS" desc:"Max concurrently hired agents" default:"5"`
+
+	// CostPerHour is the hourly budget of the hired agents, compared against
+	// the summed cost_per_hour of their templates. 0 means no budget.
+	// Environment: COST_PER_HOUR
+	CostPerHour float64 `envconfig:"COST_PER_HOUR" desc:"Hourly cost budget for hired agents (0: unlimited)"`
+
 	Environment string
 	CompanyName string
 }
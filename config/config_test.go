@@ -9,7 +9,7 @@ import (
 
 func TestAppConfigFields(t *testing.T) {
 	fields := AppConfigFields()
-	assert.Len(t, fields, 12, "AppConfig should have 12 fields")
+	assert.Len(t, fields, 18, "AppConfig should have 18 fields")
 
 	assert.Equal(t, "LISTEN_ADDR", fields[0].Env)
 	assert.Equal(t, "REGISTRY_DIR", fields[1].Env)
@@ -28,6 +28,14 @@ func TestAppConfigFields(t *testing.T) {
 	assert.Equal(t, "APP_VARS", fields[8].Env)
 	assert.Equal(t, "map", fields[8].Type)
 	assert.Equal(t, "App variables from APP_* env vars", fields[8].Desc)
+	assert.Equal(t, "INSTANCE_STORE", fields[10].Env)
+	assert.Equal(t, "file", fields[10].Default)
+	assert.Equal(t, "INSTANCE_STORE_PATH", fields[11].Env)
+	assert.Equal(t, "AGENTS_DIR", fields[12].Env)
+	assert.Equal(t, "RUNTIME_DIR", fields[13].Env)
+	assert.Equal(t, "MAX_AGENTS", fields[14].Env)
+	assert.Equal(t, "5", fields[14].Default)
+	assert.Equal(t, "COST_PER_HOUR", fields[15].Env)
 }
 
 func TestAppVariables_Nested(t *testing.T) {
@@ -58,20 +66,29 @@ func TestLoadAppVariables(t *testing.T) {
 }
 
 func TestEnvironmentDerivation(t *testing.T) {
-	os.Clearenv(); os.Setenv("APP_ENV", "prod")
-	cfg := &AppConfig{}; err := LoadAppVariables(cfg); assert.NoError(t, err)
+	os.Clearenv()
+	os.Setenv("APP_ENV", "prod")
+	cfg := &AppConfig{}
+	err := LoadAppVariables(cfg)
+	assert.NoError(t, err)
 	assert.Equal(t, "prod", cfg.Environment)
 	assert.Equal(t, "prod", cfg.Variables["ENV"])
 }
 
 func TestCompanyNameDerivation(t *testing.T) {
-	os.Clearenv(); os.Setenv("APP_COMPANY_NAME", "Acme")
-	cfg := &AppConfig{}; err := LoadAppVariables(cfg); assert.NoError(t, err)
+	os.Clearenv()
+	os.Setenv("APP_COMPANY_NAME", "Acme")
+	cfg := &AppConfig{}
+	err := LoadAppVariables(cfg)
+	assert.NoError(t, err)
 	assert.Equal(t, "Acme", cfg.CompanyName)
 	assert.Equal(t, "Acme", cfg.Variables["COMPANY_NAME"])
 }
 
 func TestMissingEnvironmentVariable(t *testing.T) {
-	os.Clearenv(); cfg := &AppConfig{}; err := LoadAppVariables(cfg); assert.NoError(t, err)
+	os.Clearenv()
+	cfg := &AppConfig{}
+	err := LoadAppVariables(cfg)
+	assert.NoError(t, err)
 	assert.Equal(t, "development", cfg.Environment)
 }
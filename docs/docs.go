@@ -32,6 +32,180 @@ const docTemplate = `{
                 }
             }
         },
+        "/api/v1/agents": {
+            "get": {
+                "description": "List hired agents with their state",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List agents",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/v1.AgentResp"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Start an agent from a template in AgentsDir",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Hire agent",
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/v1.AgentResp"
+                        }
+                    },
+                    "402": {
+                        "description": "budget exceeded",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "429": {
+                        "description": "max agents reached",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/agents/{agentID}": {
+            "get": {
+                "description": "Agent state and context",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get agent",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Agent ID",
+                        "name": "agentID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/v1.AgentResp"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "summary": "Retire agent",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Agent ID",
+                        "name": "agentID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        },
+        "/api/v1/agents/{agentID}/history": {
+            "get": {
+                "description": "Messages the agent has handled, with their actions and failures",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Agent history",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Agent ID",
+                        "name": "agentID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/registry.AgentMessage"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/agents/{agentID}/mailbox": {
+            "get": {
+                "description": "Messages the agent has not handled yet",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Agent mailbox",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Agent ID",
+                        "name": "agentID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/registry.AgentMessage"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/agents/{agentID}/messages": {
+            "post": {
+                "description": "Append a message to the agent's mailbox: {\"event\": name, \"data\": ...}, or any object to deliver as the \"message\" event",
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Message agent",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Agent ID",
+                        "name": "agentID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted"
+                    }
+                }
+            }
+        },
         "/api/v1/greet": {
             "post": {
                 "description": "Greet user by name",
@@ -146,6 +320,34 @@ const docTemplate = `{
         }
     },
     "definitions": {
+        "registry.AgentMessage": {
+            "type": "object",
+            "properties": {
+                "actions": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/statechart.ActionRecord"
+                    }
+                },
+                "data": {},
+                "error": {
+                    "description": "Error is set when the message could not be delivered, e.g. because no\ntransition handles its event.",
+                    "type": "string"
+                },
+                "event": {
+                    "type": "string"
+                },
+                "failures": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/statechart.Failure"
+                    }
+                },
+                "received": {
+                    "type": "string"
+                }
+            }
+        },
         "registry.RawYAML": {
             "type": "object",
             "properties": {
@@ -170,6 +372,12 @@ const docTemplate = `{
                     "type": "object",
                     "additionalProperties": {}
                 },
+                "diagnostics": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/statechart.Diagnostic"
+                    }
+                },
                 "filename": {
                     "type": "string"
                 },
@@ -187,6 +395,91 @@ const docTemplate = `{
                 }
             }
         },
+        "statechart.ActionRecord": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "error_event": {
+                    "type": "string"
+                },
+                "patch": {
+                    "type": "object",
+                    "additionalProperties": {}
+                },
+                "tools": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/statechart.ToolRecord"
+                    }
+                }
+            }
+        },
+        "statechart.Diagnostic": {
+            "type": "object",
+            "properties": {
+                "column": {
+                    "type": "integer"
+                },
+                "file": {
+                    "description": "registry file Line and Column are in, if the node was composed from another file",
+                    "type": "string"
+                },
+                "line": {
+                    "type": "integer"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "severity": {
+                    "type": "string"
+                }
+            }
+        },
+        "statechart.Failure": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "event": {
+                    "description": "the error event raised for it",
+                    "type": "string"
+                },
+                "guard": {
+                    "type": "string"
+                },
+                "tool": {
+                    "type": "string"
+                }
+            }
+        },
+        "statechart.ToolRecord": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "params": {
+                    "type": "object",
+                    "additionalProperties": {}
+                },
+                "result": {}
+            }
+        },
         "tools.ParamProperty": {
             "type": "object",
             "properties": {
@@ -232,6 +525,34 @@ const docTemplate = `{
                 }
             }
         },
+        "v1.AgentResp": {
+            "type": "object",
+            "properties": {
+                "context": {
+                    "type": "object",
+                    "additionalProperties": {}
+                },
+                "current": {
+                    "type": "string"
+                },
+                "handled": {
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "pending": {
+                    "type": "integer"
+                },
+                "supervisor": {
+                    "description": "hiring instance \"mid/iid\" or \"agent:\u003cid\u003e\"; empty for root",
+                    "type": "string"
+                },
+                "template": {
+                    "type": "string"
+                }
+            }
+        },
         "v1.Request": {
             "type": "object",
             "properties": {
@@ -0,0 +1,296 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Message roles for Chat.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool" // tool_result for the call in ToolCallID
+)
+
+// Message is one entry of a chat transcript.
+type Message struct {
+	Role       string
+	Content    string
+	ToolCalls  []ToolCall // assistant messages that requested tools
+	ToolCallID string     // tool messages: the call this result answers
+	IsError    bool       // tool messages: the tool failed
+}
+
+// Tool describes a tool the model may call. InputSchema is a JSON Schema object.
+type Tool struct {
+	Name        string
+	Description string
+	InputSchema any
+}
+
+// ToolCall is a parsed tool invocation requested by the model.
+type ToolCall struct {
+	ID    string         `json:"id"`
+	Name  string         `json:"name"`
+	Input map[string]any `json:"input"`
+}
+
+// ChatRequest is a provider-neutral chat completion request.
+type ChatRequest struct {
+	Messages []Message
+	Tools    []Tool
+}
+
+// ChatResponse is the assistant turn: text and/or tool calls (possibly several in parallel).
+type ChatResponse struct {
+	Content    string
+	ToolCalls  []ToolCall
+	StopReason string
+}
+
+// Chat sends a structured conversation with native tool definitions.
+// Anthropic uses tool_use/tool_result blocks; OpenAI and OpenRouter use tool_calls.
+func (h *HTTPClient) Chat(ctx context.Context, cfg LLMConfig, req ChatRequest) (*ChatResponse, error) {
+	url, headers, err := providerRequest(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Provider == "anthropic" {
+		var ar anthropicResponse
+		if err := postJSON(ctx, url, headers, anthropicPayload(cfg, req), &ar); err != nil {
+			return nil, err
+		}
+		return ar.toChatResponse(), nil
+	}
+	var or openAIResponse
+	if err := postJSON(ctx, url, headers, openAIPayload(cfg, req), &or); err != nil {
+		return nil, err
+	}
+	return or.toChatResponse()
+}
+
+// providerRequest returns the completion URL and headers for cfg.Provider.
+func providerRequest(cfg LLMConfig) (string, map[string]string, error) {
+	switch cfg.Provider {
+	case "anthropic":
+		return cfg.Endpoint + "/v1/messages", map[string]string{
+			"Content-Type":      "application/json",
+			"x-api-key":         cfg.APIKey,
+			"anthropic-version": "2023-06-01",
+		}, nil
+	case "openai":
+		return cfg.Endpoint + "/v1/chat/completions", map[string]string{
+			"Content-Type":  "application/json",
+			"Authorization": "Bearer " + cfg.APIKey,
+		}, nil
+	case "openrouter":
+		return cfg.Endpoint + "/api/v1/chat/completions", map[string]string{
+			"Content-Type":  "application/json",
+			"Authorization": "Bearer " + cfg.APIKey,
+			"HTTP-Referer":  "https://maelstrom-stillpoint.com",
+			"X-Title":       "Maelstrom CLI Demo",
+		}, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported LLM provider: %s", cfg.Provider)
+	}
+}
+
+func postJSON(ctx context.Context, url string, headers map[string]string, payload, out any) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http do: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("http %d: %s", resp.StatusCode, string(body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode resp: %w", err)
+	}
+	return nil
+}
+
+func anthropicPayload(cfg LLMConfig, req ChatRequest) map[string]any {
+	var system []string
+	var msgs []map[string]any
+	for _, m := range req.Messages {
+		switch m.Role {
+		case RoleSystem:
+			system = append(system, m.Content)
+		case RoleAssistant:
+			var blocks []map[string]any
+			if m.Content != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": m.Content})
+			}
+			for _, tc := range m.ToolCalls {
+				input := tc.Input
+				if input == nil {
+					input = map[string]any{}
+				}
+				blocks = append(blocks, map[string]any{"type": "tool_use", "id": tc.ID, "name": tc.Name, "input": input})
+			}
+			msgs = append(msgs, map[string]any{"role": "assistant", "content": blocks})
+		case RoleTool:
+			block := map[string]any{"type": "tool_result", "tool_use_id": m.ToolCallID, "content": m.Content}
+			if m.IsError {
+				block["is_error"] = true
+			}
+			// Results of parallel calls belong in one user turn.
+			if n := len(msgs); n > 0 && msgs[n-1]["role"] == "user" {
+				if blocks, ok := msgs[n-1]["content"].([]map[string]any); ok {
+					msgs[n-1]["content"] = append(blocks, block)
+					continue
+				}
+			}
+			msgs = append(msgs, map[string]any{"role": "user", "content": []map[string]any{block}})
+		default:
+			msgs = append(msgs, map[string]any{"role": "user", "content": m.Content})
+		}
+	}
+	payload := map[string]any{
+		"model":       cfg.Model,
+		"max_tokens":  cfg.MaxTokens,
+		"temperature": cfg.Temp,
+		"messages":    msgs,
+	}
+	if len(system) > 0 {
+		payload["system"] = strings.Join(system, "\n\n")
+	}
+	if len(req.Tools) > 0 {
+		defs := make([]map[string]any, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			defs = append(defs, map[string]any{"name": t.Name, "description": t.Description, "input_schema": t.InputSchema})
+		}
+		payload["tools"] = defs
+	}
+	return payload
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type  string         `json:"type"`
+		Text  string         `json:"text"`
+		ID    string         `json:"id"`
+		Name  string         `json:"name"`
+		Input map[string]any `json:"input"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+}
+
+func (ar *anthropicResponse) toChatResponse() *ChatResponse {
+	out := &ChatResponse{StopReason: ar.StopReason}
+	var text []string
+	for _, b := range ar.Content {
+		switch b.Type {
+		case "tool_use":
+			out.ToolCalls = append(out.ToolCalls, ToolCall{ID: b.ID, Name: b.Name, Input: b.Input})
+		default:
+			if b.Text != "" {
+				text = append(text, b.Text)
+			}
+		}
+	}
+	out.Content = strings.Join(text, "\n")
+	return out
+}
+
+func openAIPayload(cfg LLMConfig, req ChatRequest) map[string]any {
+	msgs := make([]map[string]any, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		switch m.Role {
+		case RoleAssistant:
+			msg := map[string]any{"role": "assistant", "content": m.Content}
+			if len(m.ToolCalls) > 0 {
+				calls := make([]map[string]any, 0, len(m.ToolCalls))
+				for _, tc := range m.ToolCalls {
+					args, _ := json.Marshal(tc.Input)
+					calls = append(calls, map[string]any{
+						"id":       tc.ID,
+						"type":     "function",
+						"function": map[string]any{"name": tc.Name, "arguments": string(args)},
+					})
+				}
+				msg["tool_calls"] = calls
+				if m.Content == "" {
+					msg["content"] = nil
+				}
+			}
+			msgs = append(msgs, msg)
+		case RoleTool:
+			msgs = append(msgs, map[string]any{"role": "tool", "tool_call_id": m.ToolCallID, "content": m.Content})
+		case RoleSystem:
+			msgs = append(msgs, map[string]any{"role": "system", "content": m.Content})
+		default:
+			msgs = append(msgs, map[string]any{"role": "user", "content": m.Content})
+		}
+	}
+	payload := map[string]any{
+		"model":       cfg.Model,
+		"max_tokens":  cfg.MaxTokens,
+		"temperature": cfg.Temp,
+		"messages":    msgs,
+	}
+	if len(req.Tools) > 0 {
+		defs := make([]map[string]any, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			defs = append(defs, map[string]any{
+				"type":     "function",
+				"function": map[string]any{"name": t.Name, "description": t.Description, "parameters": t.InputSchema},
+			})
+		}
+		payload["tools"] = defs
+	}
+	return payload
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+func (or *openAIResponse) toChatResponse() (*ChatResponse, error) {
+	if len(or.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in response")
+	}
+	choice := or.Choices[0]
+	out := &ChatResponse{Content: choice.Message.Content, StopReason: choice.FinishReason}
+	for _, tc := range choice.Message.ToolCalls {
+		input := map[string]any{}
+		if strings.TrimSpace(tc.Function.Arguments) != "" {
+			if err := json.Unmarshal([]byte(tc.Function.Arguments), &input); err != nil {
+				return nil, fmt.Errorf("tool call %q arguments: %w", tc.Function.Name, err)
+			}
+		}
+		out.ToolCalls = append(out.ToolCalls, ToolCall{ID: tc.ID, Name: tc.Function.Name, Input: input})
+	}
+	return out, nil
+}
@@ -0,0 +1,287 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTool = Tool{
+	Name:        "read_file",
+	Description: "Read a file",
+	InputSchema: map[string]any{"type": "object", "properties": map[string]any{"path": map[string]any{"type": "string"}}},
+}
+
+// toolTurn is a transcript where the model called two tools in parallel and
+// the second one failed.
+var toolTurn = ChatRequest{
+	Messages: []Message{
+		{Role: RoleSystem, Content: "Be brief."},
+		{Role: RoleUser, Content: "Compare a.txt and b.txt"},
+		{Role: RoleAssistant, Content: "Reading both.", ToolCalls: []ToolCall{
+			{ID: "call_1", Name: "read_file", Input: map[string]any{"path": "a.txt"}},
+			{ID: "call_2", Name: "read_file", Input: map[string]any{"path": "b.txt"}},
+		}},
+		{Role: RoleTool, ToolCallID: "call_1", Content: "alpha"},
+		{Role: RoleTool, ToolCallID: "call_2", Content: "no such file", IsError: true},
+	},
+	Tools: []Tool{testTool},
+}
+
+var testConfig = LLMConfig{Model: "m", MaxTokens: 256, Temp: 0.5}
+
+func TestAnthropicPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		req  ChatRequest
+		want string
+	}{
+		{
+			name: "plain prompt",
+			req:  ChatRequest{Messages: []Message{{Role: RoleUser, Content: "hi"}}},
+			want: `{"model":"m","max_tokens":256,"temperature":0.5,
+				"messages":[{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name: "parallel tool calls, results grouped in one user turn",
+			req:  toolTurn,
+			want: `{"model":"m","max_tokens":256,"temperature":0.5,"system":"Be brief.",
+				"messages":[
+					{"role":"user","content":"Compare a.txt and b.txt"},
+					{"role":"assistant","content":[
+						{"type":"text","text":"Reading both."},
+						{"type":"tool_use","id":"call_1","name":"read_file","input":{"path":"a.txt"}},
+						{"type":"tool_use","id":"call_2","name":"read_file","input":{"path":"b.txt"}}]},
+					{"role":"user","content":[
+						{"type":"tool_result","tool_use_id":"call_1","content":"alpha"},
+						{"type":"tool_result","tool_use_id":"call_2","content":"no such file","is_error":true}]}],
+				"tools":[{"name":"read_file","description":"Read a file",
+					"input_schema":{"type":"object","properties":{"path":{"type":"string"}}}}]}`,
+		},
+		{
+			name: "tool call without input or text",
+			req: ChatRequest{Messages: []Message{
+				{Role: RoleUser, Content: "time?"},
+				{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "t1", Name: "now"}}},
+				{Role: RoleTool, ToolCallID: "t1", Content: "noon"},
+			}},
+			want: `{"model":"m","max_tokens":256,"temperature":0.5,
+				"messages":[
+					{"role":"user","content":"time?"},
+					{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"now","input":{}}]},
+					{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"noon"}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(anthropicPayload(testConfig, tt.req))
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestOpenAIPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		req  ChatRequest
+		want string
+	}{
+		{
+			name: "plain prompt",
+			req:  ChatRequest{Messages: []Message{{Role: RoleSystem, Content: "s"}, {Role: RoleUser, Content: "hi"}}},
+			want: `{"model":"m","max_tokens":256,"temperature":0.5,
+				"messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name: "parallel tool calls answered by tool messages",
+			req:  toolTurn,
+			want: `{"model":"m","max_tokens":256,"temperature":0.5,
+				"messages":[
+					{"role":"system","content":"Be brief."},
+					{"role":"user","content":"Compare a.txt and b.txt"},
+					{"role":"assistant","content":"Reading both.","tool_calls":[
+						{"id":"call_1","type":"function","function":{"name":"read_file","arguments":"{\"path\":\"a.txt\"}"}},
+						{"id":"call_2","type":"function","function":{"name":"read_file","arguments":"{\"path\":\"b.txt\"}"}}]},
+					{"role":"tool","tool_call_id":"call_1","content":"alpha"},
+					{"role":"tool","tool_call_id":"call_2","content":"no such file"}],
+				"tools":[{"type":"function","function":{"name":"read_file","description":"Read a file",
+					"parameters":{"type":"object","properties":{"path":{"type":"string"}}}}}]}`,
+		},
+		{
+			name: "tool calls without text have null content",
+			req: ChatRequest{Messages: []Message{
+				{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "t1", Name: "now"}}},
+			}},
+			want: `{"model":"m","max_tokens":256,"temperature":0.5,
+				"messages":[{"role":"assistant","content":null,"tool_calls":[
+					{"id":"t1","type":"function","function":{"name":"now","arguments":"null"}}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(openAIPayload(testConfig, tt.req))
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestAnthropicResponse_ToChatResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want ChatResponse
+	}{
+		{
+			name: "text",
+			body: `{"id":"msg_01","type":"message","role":"assistant","model":"claude",
+				"content":[{"type":"text","text":"{\"answer\": 42}"}],
+				"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":5}}`,
+			want: ChatResponse{Content: `{"answer": 42}`, StopReason: "end_turn"},
+		},
+		{
+			name: "parallel tool use",
+			body: `{"id":"msg_02","type":"message","role":"assistant","model":"claude",
+				"content":[
+					{"type":"text","text":"Reading both."},
+					{"type":"tool_use","id":"toolu_1","name":"read_file","input":{"path":"a.txt"}},
+					{"type":"tool_use","id":"toolu_2","name":"read_file","input":{"path":"b.txt","lines":10}}],
+				"stop_reason":"tool_use"}`,
+			want: ChatResponse{Content: "Reading both.", StopReason: "tool_use", ToolCalls: []ToolCall{
+				{ID: "toolu_1", Name: "read_file", Input: map[string]any{"path": "a.txt"}},
+				{ID: "toolu_2", Name: "read_file", Input: map[string]any{"path": "b.txt", "lines": float64(10)}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ar anthropicResponse
+			require.NoError(t, json.Unmarshal([]byte(tt.body), &ar))
+			assert.Equal(t, &tt.want, ar.toChatResponse())
+		})
+	}
+}
+
+func TestOpenAIResponse_ToChatResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    *ChatResponse
+		wantErr string
+	}{
+		{
+			name: "text",
+			body: `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,
+				"message":{"role":"assistant","content":"{\"answer\": 42}"},"finish_reason":"stop"}]}`,
+			want: &ChatResponse{Content: `{"answer": 42}`, StopReason: "stop"},
+		},
+		{
+			name: "parallel tool calls with JSON-encoded arguments",
+			body: `{"id":"chatcmpl-2","object":"chat.completion","choices":[{"index":0,
+				"message":{"role":"assistant","content":null,"tool_calls":[
+					{"id":"call_1","type":"function","function":{"name":"read_file","arguments":"{\"path\":\"a.txt\"}"}},
+					{"id":"call_2","type":"function","function":{"name":"now","arguments":""}}]},
+				"finish_reason":"tool_calls"}]}`,
+			want: &ChatResponse{StopReason: "tool_calls", ToolCalls: []ToolCall{
+				{ID: "call_1", Name: "read_file", Input: map[string]any{"path": "a.txt"}},
+				{ID: "call_2", Name: "now", Input: map[string]any{}},
+			}},
+		},
+		{
+			name: "malformed arguments",
+			body: `{"choices":[{"message":{"tool_calls":[
+				{"id":"call_1","type":"function","function":{"name":"read_file","arguments":"{\"path\":"}}]},
+				"finish_reason":"tool_calls"}]}`,
+			wantErr: `tool call "read_file" arguments`,
+		},
+		{
+			name:    "no choices",
+			body:    `{"choices":[]}`,
+			wantErr: "no choices in response",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var or openAIResponse
+			require.NoError(t, json.Unmarshal([]byte(tt.body), &or))
+			got, err := or.toChatResponse()
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHTTPClient_Chat(t *testing.T) {
+	tests := []struct {
+		provider string
+		path     string
+		header   string
+		response string
+	}{
+		{"anthropic", "/v1/messages", "x-api-key",
+			`{"content":[{"type":"tool_use","id":"toolu_1","name":"read_file","input":{"path":"a.txt"}}],"stop_reason":"tool_use"}`},
+		{"openai", "/v1/chat/completions", "Authorization",
+			`{"choices":[{"message":{"tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"read_file","arguments":"{\"path\":\"a.txt\"}"}}]},"finish_reason":"tool_use"}]}`},
+		{"openrouter", "/api/v1/chat/completions", "Authorization",
+			`{"choices":[{"message":{"tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"read_file","arguments":"{\"path\":\"a.txt\"}"}}]},"finish_reason":"tool_use"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			var sent map[string]any
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, tt.path, r.URL.Path)
+				assert.Contains(t, r.Header.Get(tt.header), "key")
+				b, _ := io.ReadAll(r.Body)
+				assert.NoError(t, json.Unmarshal(b, &sent))
+				io.WriteString(w, tt.response)
+			}))
+			defer srv.Close()
+
+			cfg := LLMConfig{Provider: tt.provider, Endpoint: srv.URL, APIKey: "key", Model: "m"}
+			resp, err := (&HTTPClient{}).Chat(context.Background(), cfg, toolTurn)
+			require.NoError(t, err)
+			assert.Equal(t, []ToolCall{{ID: "toolu_1", Name: "read_file", Input: map[string]any{"path": "a.txt"}}}, resp.ToolCalls)
+			assert.Equal(t, "tool_use", resp.StopReason)
+			assert.Len(t, sent["tools"], 1)
+		})
+	}
+}
+
+// promptCaller implements only Call.
+type promptCaller struct{ prompt string }
+
+func (p *promptCaller) Call(ctx context.Context, cfg LLMConfig, prompt string) (string, error) {
+	p.prompt = prompt
+	return "ok", nil
+}
+
+func TestChat_CallerWithoutChat(t *testing.T) {
+	orig := DefaultCaller
+	defer func() { DefaultCaller = orig }()
+	caller := &promptCaller{}
+	DefaultCaller = caller
+
+	resp, err := Chat(context.Background(), testConfig, ChatRequest{Messages: []Message{
+		{Role: RoleSystem, Content: "Be brief."},
+		{Role: RoleUser, Content: "hi"},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.Content)
+	assert.Equal(t, "Be brief.\n\nhi", caller.prompt)
+
+	_, err = Chat(context.Background(), testConfig, toolTurn)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not support tool use")
+}
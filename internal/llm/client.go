@@ -1,142 +1,43 @@
 package llm
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"strings"
 	"sync"
 )
 
 type LLMConfig struct {
-	Provider   string
-	Endpoint   string
-	Model      string
-	APIKey     string
-	Temp       float64
-	MaxTokens  int
+	Provider  string
+	Endpoint  string
+	Model     string
+	APIKey    string
+	Temp      float64
+	MaxTokens int
 }
 
 type Caller interface {
 	Call(context.Context, LLMConfig, string) (string, error)
 }
 
+// ChatCaller is a Caller that also speaks the native tool-use chat API.
+// Callers that only implement Call still serve chats without tools.
+type ChatCaller interface {
+	Caller
+	Chat(context.Context, LLMConfig, ChatRequest) (*ChatResponse, error)
+}
+
 type HTTPClient struct{}
 
 func (h *HTTPClient) Call(ctx context.Context, cfg LLMConfig, prompt string) (string, error) {
-	var url string
-	var headers map[string]string
-	var payload map[string]any
-
-	switch cfg.Provider {
-	case "anthropic":
-		url = cfg.Endpoint + "/v1/messages"
-		headers = map[string]string{
-			"Content-Type":      "application/json",
-			"x-api-key":         cfg.APIKey,
-			"anthropic-version": "2023-06-01",
-		}
-		payload = map[string]any{
-			"model":       cfg.Model,
-			"max_tokens":  cfg.MaxTokens,
-			"temperature": cfg.Temp,
-			"messages": []map[string]string{{
-				"role": "user",
-				"content": prompt,
-			}},
-		}
-	case "openai":
-		url = cfg.Endpoint + "/v1/chat/completions"
-		headers = map[string]string{
-			"Content-Type":   "application/json",
-			"Authorization":  "Bearer " + cfg.APIKey,
-		}
-		payload = map[string]any{
-			"model":       cfg.Model,
-			"max_tokens":  cfg.MaxTokens,
-			"temperature": cfg.Temp,
-			"messages": []map[string]string{{
-				"role": "user",
-				"content": prompt,
-			}},
-		}
-	case "openrouter":
-		url = cfg.Endpoint + "/api/v1/chat/completions"
-		headers = map[string]string{
-			"Content-Type":   "application/json",
-			"Authorization":  "Bearer " + cfg.APIKey,
-			"HTTP-Referer":   "https://maelstrom-stillpoint.com",
-			"X-Title":        "Maelstrom CLI Demo",
-		}
-		payload = map[string]any{
-			"model":       cfg.Model,
-			"max_tokens":  cfg.MaxTokens,
-			"temperature": cfg.Temp,
-			"messages": []map[string]string{{
-				"role": "user",
-				"content": prompt,
-			}},
-		}
-	default:
-		return "", fmt.Errorf("unsupported LLM provider: %s", cfg.Provider)
-	}
-
-	payloadBytes, err := json.Marshal(payload)
+	resp, err := h.Chat(ctx, cfg, ChatRequest{Messages: []Message{{Role: RoleUser, Content: prompt}}})
 	if err != nil {
-		return "", fmt.Errorf("marshal payload: %w", err)
+		return "", err
 	}
-
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payloadBytes))
-	if err != nil {
-		return "", fmt.Errorf("new request: %w", err)
-	}
-
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("http do: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("http %d: %s", resp.StatusCode, string(body))
-	}
-
-	if cfg.Provider == "anthropic" {
-		var ar struct {
-			Content []struct {
-				Text string `json:"text"`
-			} `json:"content"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
-			return "", fmt.Errorf("decode anthropic resp: %w", err)
-		}
-		if len(ar.Content) > 0 {
-			return ar.Content[0].Text, nil
-		}
-	} else {
-		var ar struct {
-			Choices []struct {
-				Message struct {
-					Content string `json:"content"`
-				} `json:"message"`
-			} `json:"choices"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
-			return "", fmt.Errorf("decode openai resp: %w", err)
-		}
-		if len(ar.Choices) > 0 {
-			return ar.Choices[0].Message.Content, nil
-		}
+	if resp.Content == "" {
+		return "", fmt.Errorf("no content in response")
 	}
-
-	return "", fmt.Errorf("no content in response")
+	return resp.Content, nil
 }
 
 var DefaultCaller Caller = &HTTPClient{}
@@ -145,6 +46,26 @@ func Call(ctx context.Context, cfg LLMConfig, prompt string) (string, error) {
 	return DefaultCaller.Call(ctx, cfg, prompt)
 }
 
+// Chat sends req with DefaultCaller. A DefaultCaller that is not a ChatCaller
+// gets the messages of a request without tools as one prompt.
+func Chat(ctx context.Context, cfg LLMConfig, req ChatRequest) (*ChatResponse, error) {
+	if c, ok := DefaultCaller.(ChatCaller); ok {
+		return c.Chat(ctx, cfg, req)
+	}
+	if len(req.Tools) > 0 {
+		return nil, fmt.Errorf("LLM caller %T does not support tool use", DefaultCaller)
+	}
+	parts := make([]string, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		parts = append(parts, m.Content)
+	}
+	content, err := DefaultCaller.Call(ctx, cfg, strings.Join(parts, "\n\n"))
+	if err != nil {
+		return nil, err
+	}
+	return &ChatResponse{Content: content}, nil
+}
+
 type CallRec struct {
 	Config LLMConfig
 	Prompt string
@@ -162,8 +83,22 @@ func (m *MockCaller) Call(ctx context.Context, cfg LLMConfig, prompt string) (st
 	return "{}", nil
 }
 
+// Chat records the last user message as the prompt and answers with an empty JSON object.
+func (m *MockCaller) Chat(ctx context.Context, cfg LLMConfig, req ChatRequest) (*ChatResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var prompt string
+	for _, msg := range req.Messages {
+		if msg.Role == RoleUser {
+			prompt = msg.Content
+		}
+	}
+	m.Calls = append(m.Calls, CallRec{Config: cfg, Prompt: prompt})
+	return &ChatResponse{Content: "{}", StopReason: "end_turn"}, nil
+}
+
 func (m *MockCaller) ResetCalls() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.Calls = nil
-}
\ No newline at end of file
+}
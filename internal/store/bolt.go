@@ -0,0 +1,221 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore keeps instances in an embedded bbolt database:
+// instances/{machine}/{id} buckets hold "version", "state" and an "events" bucket keyed by sequence.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltRoot    = []byte("instances")
+	boltVersion = []byte("version")
+	boltState   = []byte("state")
+	boltEvents  = []byte("events")
+)
+
+// OpenBolt opens (or creates) the database file at path.
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bbolt %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRoot)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init bbolt %s: %w", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) instanceBucket(tx *bolt.Tx, machineID, id string) *bolt.Bucket {
+	mb := tx.Bucket(boltRoot).Bucket([]byte(machineID))
+	if mb == nil {
+		return nil
+	}
+	return mb.Bucket([]byte(id))
+}
+
+func (s *BoltStore) Create(inst *Instance) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		mb, err := tx.Bucket(boltRoot).CreateBucketIfNotExists([]byte(inst.MachineID))
+		if err != nil {
+			return err
+		}
+		if mb.Bucket([]byte(inst.ID)) != nil {
+			return ErrExists
+		}
+		ib, err := mb.CreateBucket([]byte(inst.ID))
+		if err != nil {
+			return err
+		}
+		inst.Version = 1
+		return putInstance(ib, inst)
+	})
+}
+
+func (s *BoltStore) Load(machineID, id string) (*Instance, error) {
+	var inst *Instance
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ib := s.instanceBucket(tx, machineID, id)
+		if ib == nil {
+			return ErrNotFound
+		}
+		inst = &Instance{
+			MachineID: machineID,
+			ID:        id,
+			Version:   boltVersionOf(ib),
+			State:     append(json.RawMessage(nil), ib.Get(boltState)...),
+		}
+		if eb := ib.Bucket(boltEvents); eb != nil {
+			return eb.ForEach(func(_, v []byte) error {
+				inst.Events = append(inst.Events, append(json.RawMessage(nil), v...))
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (s *BoltStore) AppendEvent(machineID, id string, version int64, event, state json.RawMessage) (int64, error) {
+	next := version + 1
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ib := s.instanceBucket(tx, machineID, id)
+		if ib == nil {
+			return ErrNotFound
+		}
+		if boltVersionOf(ib) != version {
+			return ErrVersionConflict
+		}
+		eb, err := ib.CreateBucketIfNotExists(boltEvents)
+		if err != nil {
+			return err
+		}
+		seq, err := eb.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := eb.Put(boltSeqKey(seq), event); err != nil {
+			return err
+		}
+		if err := ib.Put(boltState, state); err != nil {
+			return err
+		}
+		return ib.Put(boltVersion, boltSeqKey(uint64(next)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+func (s *BoltStore) CompareAndSwap(inst *Instance) (int64, error) {
+	next := *inst
+	next.Version++
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ib := s.instanceBucket(tx, inst.MachineID, inst.ID)
+		if ib == nil {
+			return ErrNotFound
+		}
+		if boltVersionOf(ib) != inst.Version {
+			return ErrVersionConflict
+		}
+		if ib.Bucket(boltEvents) != nil {
+			if err := ib.DeleteBucket(boltEvents); err != nil {
+				return err
+			}
+		}
+		return putInstance(ib, &next)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return next.Version, nil
+}
+
+func (s *BoltStore) List(machineID string) ([]Key, error) {
+	var keys []Key
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(boltRoot)
+		// Nested buckets are the keys with a nil value.
+		return root.ForEach(func(mid, v []byte) error {
+			if v != nil || machineID != "" && string(mid) != machineID {
+				return nil
+			}
+			return root.Bucket(mid).ForEach(func(id, v []byte) error {
+				if v == nil {
+					keys = append(keys, Key{MachineID: string(mid), ID: string(id)})
+				}
+				return nil
+			})
+		})
+	})
+	return keys, err
+}
+
+func (s *BoltStore) Delete(machineID, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(boltRoot).Bucket([]byte(machineID))
+		if mb == nil || mb.Bucket([]byte(id)) == nil {
+			return nil
+		}
+		return mb.DeleteBucket([]byte(id))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// putInstance writes version, snapshot and a fresh event bucket into ib.
+func putInstance(ib *bolt.Bucket, inst *Instance) error {
+	if err := ib.Put(boltVersion, boltSeqKey(uint64(inst.Version))); err != nil {
+		return err
+	}
+	if err := ib.Put(boltState, inst.State); err != nil {
+		return err
+	}
+	eb, err := ib.CreateBucketIfNotExists(boltEvents)
+	if err != nil {
+		return err
+	}
+	for _, evt := range inst.Events {
+		seq, err := eb.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := eb.Put(boltSeqKey(seq), evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltVersionOf(ib *bolt.Bucket) int64 {
+	v := ib.Get(boltVersion)
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// boltSeqKey encodes n big-endian so keys iterate in numeric order.
+func boltSeqKey(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileStore keeps one JSON document per instance at {dir}/{machine}/{id}.json.
+// The snapshot fields sit at the top level next to "history" and "version".
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore returns a FileStore rooted at dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (s *FileStore) path(machineID, id string) string {
+	return filepath.Join(s.dir, machineID, id+".json")
+}
+
+func (s *FileStore) Create(inst *Instance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.read(inst.MachineID, inst.ID); err == nil {
+		return ErrExists
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	inst.Version = 1
+	return s.write(inst)
+}
+
+func (s *FileStore) Load(machineID, id string) (*Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(machineID, id)
+}
+
+func (s *FileStore) AppendEvent(machineID, id string, version int64, event, state json.RawMessage) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.read(machineID, id)
+	if err != nil {
+		return 0, err
+	}
+	if inst.Version != version {
+		return 0, ErrVersionConflict
+	}
+	inst.Version++
+	inst.State = state
+	inst.Events = append(inst.Events, event)
+	if err := s.write(inst); err != nil {
+		return 0, err
+	}
+	return inst.Version, nil
+}
+
+func (s *FileStore) CompareAndSwap(inst *Instance) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.read(inst.MachineID, inst.ID)
+	if err != nil {
+		return 0, err
+	}
+	if cur.Version != inst.Version {
+		return 0, ErrVersionConflict
+	}
+	next := *inst
+	next.Version++
+	if err := s.write(&next); err != nil {
+		return 0, err
+	}
+	return next.Version, nil
+}
+
+func (s *FileStore) List(machineID string) ([]Key, error) {
+	pattern := filepath.Join(s.dir, "*", "*.json")
+	if machineID != "" {
+		pattern = filepath.Join(s.dir, machineID, "*.json")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	keys := make([]Key, 0, len(files))
+	for _, f := range files {
+		keys = append(keys, Key{
+			MachineID: filepath.Base(filepath.Dir(f)),
+			ID:        strings.TrimSuffix(filepath.Base(f), ".json"),
+		})
+	}
+	return keys, nil
+}
+
+func (s *FileStore) Delete(machineID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(machineID, id)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *FileStore) Close() error { return nil }
+
+// read decodes an instance file. Files written before versioning load as version 0.
+func (s *FileStore) read(machineID, id string) (*Instance, error) {
+	path := s.path(machineID, id)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %w", path, err)
+	}
+	inst := &Instance{MachineID: machineID, ID: id}
+	if v, ok := doc["version"]; ok {
+		if err := json.Unmarshal(v, &inst.Version); err != nil {
+			return nil, fmt.Errorf("unmarshal %s version: %w", path, err)
+		}
+	}
+	if h, ok := doc["history"]; ok {
+		if err := json.Unmarshal(h, &inst.Events); err != nil {
+			return nil, fmt.Errorf("unmarshal %s history: %w", path, err)
+		}
+	}
+	delete(doc, "version")
+	delete(doc, "history")
+	if inst.State, err = json.Marshal(doc); err != nil {
+		return nil, fmt.Errorf("marshal %s state: %w", path, err)
+	}
+	return inst, nil
+}
+
+// write stores inst atomically via a temp file and rename.
+func (s *FileStore) write(inst *Instance) error {
+	doc := map[string]json.RawMessage{}
+	if len(inst.State) > 0 {
+		if err := json.Unmarshal(inst.State, &doc); err != nil {
+			return fmt.Errorf("unmarshal state: %w", err)
+		}
+	}
+	events := inst.Events
+	if events == nil {
+		events = []json.RawMessage{}
+	}
+	var err error
+	if doc["history"], err = json.Marshal(events); err != nil {
+		return fmt.Errorf("marshal history: %w", err)
+	}
+	if doc["version"], err = json.Marshal(inst.Version); err != nil {
+		return fmt.Errorf("marshal version: %w", err)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	path := s.path(inst.MachineID, inst.ID)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	tmp := filepath.Join(dir, "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write tmp %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp) // cleanup
+		return fmt.Errorf("rename %s to %s: %w", tmp, path, err)
+	}
+	return nil
+}
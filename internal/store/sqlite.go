@@ -0,0 +1,219 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// sqliteDriver is the database/sql driver name registered by the pure-Go
+// SQLite driver, see sqlite_driver.go.
+const sqliteDriver = "sqlite"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS instances (
+	machine_id TEXT NOT NULL,
+	id         TEXT NOT NULL,
+	version    INTEGER NOT NULL,
+	state      TEXT NOT NULL,
+	PRIMARY KEY (machine_id, id)
+);
+CREATE TABLE IF NOT EXISTS events (
+	machine_id  TEXT NOT NULL,
+	instance_id TEXT NOT NULL,
+	seq         INTEGER NOT NULL,
+	data        TEXT NOT NULL,
+	PRIMARY KEY (machine_id, instance_id, seq)
+);`
+
+// SQLiteStore keeps instances in an SQLite database: one row per instance
+// and one row per event, so instances can be queried with plain SQL.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens (or creates) the database file at path.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite %s: %w", path, err)
+	}
+	// One writer at a time; SQLite serialises writes anyway.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init sqlite %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Create(inst *Instance) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM instances WHERE machine_id = ? AND id = ?`, inst.MachineID, inst.ID).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrExists
+	}
+	if _, err := tx.Exec(`INSERT INTO instances (machine_id, id, version, state) VALUES (?, ?, 1, ?)`,
+		inst.MachineID, inst.ID, string(inst.State)); err != nil {
+		return err
+	}
+	if err := sqliteInsertEvents(tx, inst.MachineID, inst.ID, 0, inst.Events); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	inst.Version = 1
+	return nil
+}
+
+func (s *SQLiteStore) Load(machineID, id string) (*Instance, error) {
+	inst := &Instance{MachineID: machineID, ID: id}
+	var state string
+	err := s.db.QueryRow(`SELECT version, state FROM instances WHERE machine_id = ? AND id = ?`, machineID, id).Scan(&inst.Version, &state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	inst.State = json.RawMessage(state)
+	rows, err := s.db.Query(`SELECT data FROM events WHERE machine_id = ? AND instance_id = ? ORDER BY seq`, machineID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		inst.Events = append(inst.Events, json.RawMessage(data))
+	}
+	return inst, rows.Err()
+}
+
+func (s *SQLiteStore) AppendEvent(machineID, id string, version int64, event, state json.RawMessage) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err := sqliteBumpVersion(tx, machineID, id, version, state); err != nil {
+		return 0, err
+	}
+	var seq int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM events WHERE machine_id = ? AND instance_id = ?`, machineID, id).Scan(&seq); err != nil {
+		return 0, err
+	}
+	if err := sqliteInsertEvents(tx, machineID, id, seq, []json.RawMessage{event}); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return version + 1, nil
+}
+
+func (s *SQLiteStore) CompareAndSwap(inst *Instance) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err := sqliteBumpVersion(tx, inst.MachineID, inst.ID, inst.Version, inst.State); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM events WHERE machine_id = ? AND instance_id = ?`, inst.MachineID, inst.ID); err != nil {
+		return 0, err
+	}
+	if err := sqliteInsertEvents(tx, inst.MachineID, inst.ID, 0, inst.Events); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return inst.Version + 1, nil
+}
+
+func (s *SQLiteStore) List(machineID string) ([]Key, error) {
+	query := `SELECT machine_id, id FROM instances ORDER BY machine_id, id`
+	var args []any
+	if machineID != "" {
+		query = `SELECT machine_id, id FROM instances WHERE machine_id = ? ORDER BY id`
+		args = append(args, machineID)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []Key
+	for rows.Next() {
+		var k Key
+		if err := rows.Scan(&k.MachineID, &k.ID); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) Delete(machineID, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM events WHERE machine_id = ? AND instance_id = ?`, machineID, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM instances WHERE machine_id = ? AND id = ?`, machineID, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// sqliteBumpVersion replaces the snapshot if version is current.
+func sqliteBumpVersion(tx *sql.Tx, machineID, id string, version int64, state json.RawMessage) error {
+	res, err := tx.Exec(`UPDATE instances SET version = version + 1, state = ? WHERE machine_id = ? AND id = ? AND version = ?`,
+		string(state), machineID, id, version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 1 {
+		return nil
+	}
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM instances WHERE machine_id = ? AND id = ?`, machineID, id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionConflict
+}
+
+func sqliteInsertEvents(tx *sql.Tx, machineID, id string, after int64, events []json.RawMessage) error {
+	for i, evt := range events {
+		if _, err := tx.Exec(`INSERT INTO events (machine_id, instance_id, seq, data) VALUES (?, ?, ?, ?)`,
+			machineID, id, after+int64(i)+1, string(evt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+package store
+
+// Pure-Go SQLite driver (no cgo); registers itself as "sqlite".
+import _ "modernc.org/sqlite"
@@ -0,0 +1,82 @@
+// Package store persists statechart instances: a snapshot of each instance
+// plus its append-only event log, guarded by a version for compare-and-swap.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound        = errors.New("instance not found")
+	ErrExists          = errors.New("instance already exists")
+	ErrVersionConflict = errors.New("instance version conflict")
+)
+
+// Key identifies an instance.
+type Key struct {
+	MachineID string `json:"machineId"`
+	ID        string `json:"id"`
+}
+
+// Instance is the persisted form of one statechart instance.
+type Instance struct {
+	MachineID string
+	ID        string
+	// Version increases by one on every write; writers pass the version they
+	// loaded and get ErrVersionConflict if someone else wrote in between.
+	Version int64
+	// State is the instance snapshot (initial context, timers, ...) without the event log.
+	State json.RawMessage
+	// Events is the event log, oldest first.
+	Events []json.RawMessage
+}
+
+// InstanceStore is implemented by every persistence backend.
+type InstanceStore interface {
+	// Create stores a new instance at version 1; ErrExists if the key is taken.
+	Create(inst *Instance) error
+	// Load returns the instance or ErrNotFound.
+	Load(machineID, id string) (*Instance, error)
+	// AppendEvent appends event, replaces the snapshot with state and returns the new version.
+	AppendEvent(machineID, id string, version int64, event, state json.RawMessage) (int64, error)
+	// CompareAndSwap replaces snapshot and event log if inst.Version is current and returns the new version.
+	CompareAndSwap(inst *Instance) (int64, error)
+	// List returns the instances of machineID, or of all machines if it is empty.
+	List(machineID string) ([]Key, error)
+	// Delete removes the instance; deleting a missing instance is not an error.
+	Delete(machineID, id string) error
+	Close() error
+}
+
+// Backend names accepted by Open.
+const (
+	BackendFile   = "file"
+	BackendBolt   = "bbolt"
+	BackendSQLite = "sqlite"
+)
+
+// Open returns the store for backend. An empty path selects the backend's
+// default location relative to the working directory.
+func Open(backend, path string) (InstanceStore, error) {
+	switch backend {
+	case "", BackendFile:
+		if path == "" {
+			path = "instances"
+		}
+		return NewFileStore(path), nil
+	case BackendBolt, "bolt":
+		if path == "" {
+			path = "instances.db"
+		}
+		return OpenBolt(path)
+	case BackendSQLite:
+		if path == "" {
+			path = "instances.sqlite"
+		}
+		return OpenSQLite(path)
+	default:
+		return nil, fmt.Errorf("unknown instance store %q", backend)
+	}
+}
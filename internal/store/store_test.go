@@ -0,0 +1,96 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func backends(t *testing.T) map[string]InstanceStore {
+	dir := t.TempDir()
+	out := map[string]InstanceStore{BackendFile: NewFileStore(filepath.Join(dir, "instances"))}
+	bs, err := OpenBolt(filepath.Join(dir, "instances.db"))
+	require.NoError(t, err)
+	out[BackendBolt] = bs
+	ss, err := OpenSQLite(filepath.Join(dir, "instances.sqlite"))
+	require.NoError(t, err)
+	out[BackendSQLite] = ss
+	t.Cleanup(func() {
+		for _, s := range out {
+			s.Close()
+		}
+	})
+	return out
+}
+
+func TestInstanceStore_Lifecycle(t *testing.T) {
+	for name, s := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			inst := &Instance{MachineID: "m", ID: "i1", State: json.RawMessage(`{"initialContext":{"a":1}}`)}
+			require.NoError(t, s.Create(inst))
+			assert.Equal(t, int64(1), inst.Version)
+			assert.ErrorIs(t, s.Create(&Instance{MachineID: "m", ID: "i1", State: json.RawMessage(`{}`)}), ErrExists)
+
+			v, err := s.AppendEvent("m", "i1", 1, json.RawMessage(`{"type":"go"}`), json.RawMessage(`{"initialContext":{"a":2}}`))
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), v)
+			_, err = s.AppendEvent("m", "i1", 1, json.RawMessage(`{"type":"stale"}`), json.RawMessage(`{}`))
+			assert.ErrorIs(t, err, ErrVersionConflict)
+
+			got, err := s.Load("m", "i1")
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), got.Version)
+			assert.JSONEq(t, `{"initialContext":{"a":2}}`, string(got.State))
+			require.Len(t, got.Events, 1)
+			assert.JSONEq(t, `{"type":"go"}`, string(got.Events[0]))
+
+			got.Events = append(got.Events, json.RawMessage(`{"type":"again"}`))
+			v, err = s.CompareAndSwap(got)
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), v)
+			_, err = s.CompareAndSwap(got)
+			assert.ErrorIs(t, err, ErrVersionConflict)
+			got, err = s.Load("m", "i1")
+			require.NoError(t, err)
+			assert.Len(t, got.Events, 2)
+
+			require.NoError(t, s.Create(&Instance{MachineID: "other", ID: "i2", State: json.RawMessage(`{}`)}))
+			keys, err := s.List("m")
+			require.NoError(t, err)
+			assert.Equal(t, []Key{{MachineID: "m", ID: "i1"}}, keys)
+			keys, err = s.List("")
+			require.NoError(t, err)
+			assert.Len(t, keys, 2)
+
+			require.NoError(t, s.Delete("m", "i1"))
+			require.NoError(t, s.Delete("m", "i1"))
+			_, err = s.Load("m", "i1")
+			assert.True(t, errors.Is(err, ErrNotFound))
+			_, err = s.AppendEvent("m", "i1", 3, json.RawMessage(`{}`), json.RawMessage(`{}`))
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestFileStore_LoadsUnversionedFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "m"), 0755))
+	legacy := `{"initialContext": {"a": 1}, "history": [{"type": "go", "data": null}]}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "m", "i1.json"), []byte(legacy), 0644))
+
+	s := NewFileStore(dir)
+	inst, err := s.Load("m", "i1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), inst.Version)
+	assert.JSONEq(t, `{"initialContext": {"a": 1}}`, string(inst.State))
+	require.Len(t, inst.Events, 1)
+
+	v, err := s.AppendEvent("m", "i1", 0, json.RawMessage(`{"type":"next"}`), inst.State)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), v)
+}
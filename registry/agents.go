@@ -0,0 +1,699 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comalice/maelstrom/internal/store"
+	"github.com/comalice/maelstrom/registry/statechart"
+	"github.com/comalice/maelstrom/registry/yaml"
+	"github.com/comalice/statechartx"
+	"github.com/google/uuid"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// DefaultMessageEvent is the event a message without an "event" key is delivered as.
+const DefaultMessageEvent = "message"
+
+// Agent is a hired agent: a running instance of an agent template that
+// handles the messages in its mailbox one at a time, in arrival order.
+type Agent struct {
+	ID       string
+	Template string
+
+	aug   *statechart.AugmentedMachine
+	rt    *statechartx.Runtime
+	rec   *statechart.Recorder
+	store store.InstanceStore // nil if agents are not persisted
+
+	mu       sync.Mutex
+	snap     agentSnapshot
+	version  int64
+	messages []AgentMessage // every message received, oldest first
+	current  string
+	wake     chan struct{}
+	restart  chan struct{}
+	stop     chan struct{}
+	failed   func(a *Agent, reason string) // reports a failure to the supervisor
+}
+
+// AgentMessage is one message in an agent's mailbox. The first
+// agentSnapshot.Delivered messages have been processed as events.
+type AgentMessage struct {
+	Event    string                    `json:"event"`
+	Data     any                       `json:"data,omitempty"`
+	Received time.Time                 `json:"received"`
+	Actions  []statechart.ActionRecord `json:"actions,omitempty"`
+	Failures []statechart.Failure      `json:"failures,omitempty"`
+	// Error is set when the message could not be delivered, e.g. because no
+	// transition handles its event.
+	Error string `json:"error,omitempty"`
+}
+
+// agentDelivery is appended to an agent's log once the message at index
+// Delivered has been handled, with what handling it did; messages are logged
+// when they arrive, so the log grows by one entry per step.
+type agentDelivery struct {
+	Delivered int                       `json:"delivered"`
+	Actions   []statechart.ActionRecord `json:"actions,omitempty"`
+	Failures  []statechart.Failure      `json:"failures,omitempty"`
+	Error     string                    `json:"error,omitempty"`
+}
+
+// agentSnapshot is the persisted state of an agent besides its mailbox.
+type agentSnapshot struct {
+	Template string `json:"template"`
+	// Spec is the rendered template the agent was hired from, so a restart
+	// does not depend on the template file.
+	Spec         string                    `json:"spec"`
+	Initial      map[string]any            `json:"initialContext,omitempty"`
+	StartActions []statechart.ActionRecord `json:"startActions,omitempty"`
+	Delivered    int                       `json:"delivered"`
+	Supervisor   statechart.Supervisor     `json:"supervisor"`
+}
+
+// messageEvent splits a message into the event it is delivered as and the
+// event data: {"event": name, "data": ...}, or the whole message as the data
+// of DefaultMessageEvent.
+func messageEvent(msg map[string]any) (string, any) {
+	if event, ok := msg["event"].(string); ok && event != "" {
+		return event, msg["data"]
+	}
+	return DefaultMessageEvent, msg
+}
+
+// agentStore returns the store agents are persisted in, under RuntimeDir.
+func (r *Registry) agentStore() store.InstanceStore {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.RuntimeDir == "" {
+		return nil
+	}
+	if r.agentsStore == nil {
+		r.agentsStore = store.NewFileStore(filepath.Join(r.RuntimeDir, "agents"))
+	}
+	return r.agentsStore
+}
+
+// renderAgentTemplate reads an agent template from AgentsDir, renders it like
+// registry files and composes its extends and $refs from the registry, so the
+// source saved with the agent stands alone.
+func (r *Registry) renderAgentTemplate(template string) ([]byte, error) {
+	if template == "" || template != filepath.Base(template) || strings.HasPrefix(template, ".") {
+		return nil, fmt.Errorf("invalid agent template name %q", template)
+	}
+	agentPath := filepath.Join(r.AgentsDir, template+".yaml")
+	dataBytes, err := os.ReadFile(agentPath)
+	if err != nil {
+		return nil, fmt.Errorf("read agent template %q: %w", agentPath, err)
+	}
+
+	agentRaw := string(dataBytes)
+
+	data := renderData{App: r.Config, Env: r.Config.Variables}
+	parseBytes, renderErr := yaml.RenderBytesWith(agentRaw, data, r.Partial)
+	if renderErr == nil {
+		slog.Info("agent template rendered", "template", template)
+	} else {
+		parseBytes = []byte(agentRaw)
+		slog.Warn("agent template render failed, using raw", "template", template, "err", renderErr)
+	}
+	return r.composeAgentTemplate(agentPath, parseBytes)
+}
+
+// composeAgentTemplate resolves the extends and $refs of an agent template
+// against the registry files. Sources without either are returned as they are.
+func (r *Registry) composeAgentTemplate(path string, source []byte) ([]byte, error) {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(source, &root); err != nil || !composes(&root) {
+		return source, nil
+	}
+	r.mu.RLock()
+	c, _, _ := r.composer()
+	r.mu.RUnlock()
+	c.add(path, &root)
+	doc, err := c.compose(path)
+	if err != nil {
+		return nil, fmt.Errorf("compose agent template: %w", err)
+	}
+	out, err := yamlv3.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("compose agent template: %w", err)
+	}
+	return out, nil
+}
+
+func (r *Registry) buildAgentMachine(template string, source []byte) (*statechart.AugmentedMachine, error) {
+	spec, err := statechart.ParseSpec(source)
+	if err != nil {
+		return nil, fmt.Errorf("parse agent spec %q: %w", template, err)
+	}
+	spec.App = r.Config
+	spec.Partials = r.Partial
+	if err := statechart.ValidationError(statechart.ValidateAgent(spec)); err != nil {
+		return nil, fmt.Errorf("invalid agent spec %q: %w", template, err)
+	}
+	aug, err := spec.ToAugmentedMachine(r)
+	if err != nil {
+		return nil, fmt.Errorf("augment agent machine %q: %w", template, err)
+	}
+	return aug, nil
+}
+
+// HireAgent starts a new agent from a template in AgentsDir and returns its ID.
+func (r *Registry) HireAgent(template string) (string, error) {
+	return r.HireAgentWith(template, nil)
+}
+
+// HireSupervisedAgent is HireAgent for an agent supervised by sup instead of
+// the root supervisor.
+func (r *Registry) HireSupervisedAgent(template string, sup statechart.Supervisor) (string, error) {
+	return r.hireAgent(template, nil, sup)
+}
+
+// HireAgentWith starts a new agent from a template in AgentsDir with initial
+// as its context and returns its ID. It fails with ErrMaxAgents when MaxAgents
+// agents are hired, and with ErrBudgetExceeded when the template's
+// cost_per_hour would take the pool over CostPerHour. The agent is supervised
+// by the root supervisor.
+func (r *Registry) HireAgentWith(template string, initial map[string]any) (string, error) {
+	return r.hireAgent(template, initial, statechart.Supervisor{})
+}
+
+func (r *Registry) hireAgent(template string, initial map[string]any, sup statechart.Supervisor) (string, error) {
+	if r.AgentsDir == "" {
+		return "", fmt.Errorf("AgentsDir not set")
+	}
+	source, err := r.renderAgentTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	aug, err := r.buildAgentMachine(template, source)
+	if err != nil {
+		return "", err
+	}
+	// Reserve the slot; the agent's entry actions may hire agents themselves.
+	cost := aug.Spec.CostPerHour
+	if err := r.reserveAgent(cost); err != nil {
+		return "", err
+	}
+	a := newAgent(uuid.New().String(), aug, r.agentStore(), agentSnapshot{Template: template, Spec: string(source), Initial: initial, Supervisor: sup})
+	if err := r.startAgent(a); err != nil {
+		r.releaseAgent(cost)
+		return "", err
+	}
+	slog.Info("hired agent", "id", a.ID, "template", template)
+	return a.ID, nil
+}
+
+// reserveAgent counts an agent costing cost per hour against MaxAgents and CostPerHour.
+func (r *Registry) reserveAgent(cost float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if int(r.NumAgents.Load()) >= r.MaxAgents {
+		return ErrMaxAgents
+	}
+	if r.CostPerHour > 0 && r.hourlyCost+cost > r.CostPerHour {
+		return fmt.Errorf("%w: %.2f/h hired, %.2f/h more exceeds %.2f/h", ErrBudgetExceeded, r.hourlyCost, cost, r.CostPerHour)
+	}
+	r.NumAgents.Add(1)
+	r.hourlyCost += cost
+	return nil
+}
+
+func (r *Registry) releaseAgent(cost float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.NumAgents.Add(-1)
+	r.hourlyCost -= cost
+}
+
+func (r *Registry) startAgent(a *Agent) error {
+	if err := a.start(false); err != nil {
+		return fmt.Errorf("start agent %q: %w", a.Template, err)
+	}
+	if err := a.create(); err != nil {
+		_ = a.aug.Stop(a.rt)
+		return err
+	}
+	r.addAgent(a)
+	return nil
+}
+
+func (r *Registry) addAgent(a *Agent) {
+	a.failed = r.agentFailed
+	r.mu.Lock()
+	r.Machines[a.ID] = a.aug
+	r.agents[a.ID] = a
+	r.mu.Unlock()
+	go a.run()
+}
+
+// RestoreAgents restarts the agents persisted under RuntimeDir: each resumes
+// from its recorded messages and then handles the ones still in its mailbox.
+// Call it once at startup.
+func (r *Registry) RestoreAgents() error {
+	s := r.agentStore()
+	if s == nil {
+		return nil
+	}
+	keys, err := s.List("")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		a, err := r.loadAgent(s, k)
+		if err != nil {
+			slog.Warn("restore agent failed", "template", k.MachineID, "id", k.ID, "err", err)
+			continue
+		}
+		// Restored agents count against the pool even if it is over its limits now.
+		r.mu.Lock()
+		r.NumAgents.Add(1)
+		r.hourlyCost += a.aug.Spec.CostPerHour
+		r.mu.Unlock()
+		r.addAgent(a)
+		slog.Info("agent restored", "id", a.ID, "template", a.Template, "messages", len(a.messages))
+	}
+	return nil
+}
+
+func (r *Registry) loadAgent(s store.InstanceStore, k store.Key) (*Agent, error) {
+	inst, err := s.Load(k.MachineID, k.ID)
+	if err != nil {
+		return nil, err
+	}
+	var snap agentSnapshot
+	if err := json.Unmarshal(inst.State, &snap); err != nil {
+		return nil, fmt.Errorf("unmarshal agent: %w", err)
+	}
+	aug, err := r.buildAgentMachine(snap.Template, []byte(snap.Spec))
+	if err != nil {
+		return nil, err
+	}
+	a := newAgent(k.ID, aug, s, snap)
+	a.version = inst.Version
+	for i, raw := range inst.Events {
+		var entry struct {
+			AgentMessage
+			Delivered *int `json:"delivered"`
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("unmarshal message %d: %w", i, err)
+		}
+		if d := entry.Delivered; d != nil {
+			if *d < 0 || *d >= len(a.messages) {
+				return nil, fmt.Errorf("entry %d: delivery of unknown message %d", i, *d)
+			}
+			msg := &a.messages[*d]
+			msg.Actions, msg.Failures, msg.Error = entry.Actions, entry.Failures, entry.Error
+			continue
+		}
+		a.messages = append(a.messages, entry.AgentMessage)
+	}
+	if err := a.start(true); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (r *Registry) RetireAgent(id string) error {
+	r.mu.Lock()
+	a, ok := r.agents[id]
+	if ok {
+		delete(r.Machines, id)
+		delete(r.agents, id)
+		r.NumAgents.Add(-1)
+		r.hourlyCost -= a.aug.Spec.CostPerHour
+	}
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("agent %q: %w", id, ErrAgentNotFound)
+	}
+	a.retire()
+	slog.Info("retired agent", "id", id)
+	return nil
+}
+
+// SendMessage appends msg to the agent's mailbox; the agent handles it as an
+// event after the messages before it.
+func (r *Registry) SendMessage(toID string, msg map[string]any) error {
+	a, err := r.Agent(toID)
+	if err != nil {
+		return err
+	}
+	event, data := messageEvent(msg)
+	return a.receive(AgentMessage{Event: event, Data: data, Received: time.Now().UTC()})
+}
+
+// Agent returns the hired agent with the given ID.
+func (r *Registry) Agent(id string) (*Agent, error) {
+	r.mu.RLock()
+	a, ok := r.agents[id]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("agent %q: %w", id, ErrAgentNotFound)
+	}
+	return a, nil
+}
+
+// Agents returns the hired agents ordered by ID.
+func (r *Registry) Agents() []*Agent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*Agent, 0, len(r.agents))
+	for _, a := range r.agents {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (r *Registry) QueryAgents() map[string]statechart.AgentInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := make(map[string]statechart.AgentInfo)
+	for id, a := range r.agents {
+		m[id] = a.info()
+	}
+	return m
+}
+
+func newAgent(id string, aug *statechart.AugmentedMachine, s store.InstanceStore, snap agentSnapshot) *Agent {
+	return &Agent{
+		ID:       id,
+		Template: snap.Template,
+		aug:      aug,
+		rec:      statechart.NewRecorder(),
+		store:    s,
+		snap:     snap,
+		wake:     make(chan struct{}, 1),
+		restart:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+// start starts the agent's runtime. With replay set it replays the recorded
+// outputs of the start and of the delivered messages instead of running their
+// LLM and system actions again.
+func (a *Agent) start(replay bool) error {
+	initial := statechartx.NewContext()
+	if a.snap.Initial != nil {
+		initial.LoadAll(a.snap.Initial)
+	}
+	rt := statechartx.NewRuntime(a.aug.Machine, initial)
+	if replay {
+		a.rec.Replay(a.snap.StartActions)
+	} else {
+		a.rec.Live()
+	}
+	ctx := statechart.WithInstance(context.Background(), statechart.InstanceRef{Machine: a.Template, ID: a.ID, Agent: true})
+	if err := a.aug.Start(statechart.WithRecorder(ctx, a.rec), rt); err != nil {
+		a.rec.Live()
+		return err
+	}
+	if !replay {
+		a.snap.StartActions = a.rec.Take()
+	}
+	a.mu.Lock()
+	delivered := append([]AgentMessage{}, a.messages[:a.snap.Delivered]...)
+	a.mu.Unlock()
+	for _, msg := range delivered {
+		eid, ok := a.aug.EventIDByName[msg.Event]
+		if !ok || msg.Error != "" {
+			continue
+		}
+		a.rec.Replay(msg.Actions)
+		a.aug.Step(rt, statechartx.Event{ID: eid, Data: msg.Data})
+	}
+	a.rec.Live()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rt = rt
+	a.current = a.aug.StatePathByID[rt.GetCurrentState()]
+	return nil
+}
+
+// run delivers the agent's messages until it is retired. A requested restart
+// is handled before the next message.
+func (a *Agent) run() {
+	for {
+		select {
+		case <-a.stop:
+			a.stopRuntime()
+			return
+		case <-a.restart:
+			a.restartRuntime()
+		default:
+		}
+		if a.deliverNext() {
+			continue
+		}
+		select {
+		case <-a.stop:
+			a.stopRuntime()
+			return
+		case <-a.restart:
+			a.restartRuntime()
+		case <-a.wake:
+		}
+	}
+}
+
+func (a *Agent) stopRuntime() {
+	if err := a.aug.Stop(a.rt); err != nil {
+		slog.Warn("stop agent runtime", "id", a.ID, "err", err)
+	}
+}
+
+// restartRuntime replaces the runtime with one resumed from the last saved
+// snapshot, dropping whatever the failed message did.
+func (a *Agent) restartRuntime() {
+	a.stopRuntime()
+	if err := a.start(true); err != nil {
+		slog.Error("restart agent failed", "id", a.ID, "err", err)
+		if a.failed != nil {
+			a.failed(a, fmt.Sprintf("restart: %v", err))
+		}
+		return
+	}
+	slog.Info("agent restarted", "id", a.ID, "current", a.Current())
+}
+
+// requestRestart makes the agent restart before it handles its next message.
+func (a *Agent) requestRestart() {
+	select {
+	case a.restart <- struct{}{}:
+	default:
+	}
+}
+
+// unhandledFailure returns the first failure whose error event the agent has
+// no transition for; such a failure crashes the agent.
+func (a *Agent) unhandledFailure(failures []statechart.Failure) (statechart.Failure, bool) {
+	for _, f := range failures {
+		if _, ok := a.aug.EventIDByName[f.Event]; !ok {
+			return f, true
+		}
+	}
+	return statechart.Failure{}, false
+}
+
+// deliverNext processes the oldest undelivered message, if any. A message that
+// crashes the agent is recorded with its error and reported to the supervisor.
+func (a *Agent) deliverNext() bool {
+	select {
+	case <-a.stop:
+		return false
+	default:
+	}
+	a.mu.Lock()
+	if a.snap.Delivered >= len(a.messages) {
+		a.mu.Unlock()
+		return false
+	}
+	i := a.snap.Delivered
+	msg := a.messages[i]
+	a.mu.Unlock()
+
+	eid, ok := a.aug.EventIDByName[msg.Event]
+	switch {
+	case !ok:
+		msg.Error = fmt.Sprintf("event %q has no transition", msg.Event)
+	case a.aug.Completed(a.rt):
+		msg.Error = "agent completed"
+	default:
+		a.rec.Live()
+		msg.Failures = a.aug.Step(a.rt, statechartx.Event{ID: eid, Data: msg.Data})
+		msg.Actions = a.rec.Take()
+	}
+	crash, crashed := a.unhandledFailure(msg.Failures)
+	if crashed {
+		// Not replayed on restart, so the agent resumes from before the message.
+		msg.Error = fmt.Sprintf("crashed: %s: %s", crash.Event, crash.Error)
+	}
+	if msg.Error != "" {
+		slog.Warn("agent message not delivered", "id", a.ID, "event", msg.Event, "err", msg.Error)
+	}
+
+	a.mu.Lock()
+	a.messages[i] = msg
+	a.snap.Delivered++
+	a.current = a.aug.StatePathByID[a.rt.GetCurrentState()]
+	if err := a.saveDeliveryLocked(i); err != nil {
+		slog.Error("save agent failed", "id", a.ID, "err", err)
+	}
+	a.mu.Unlock()
+	if crashed && a.failed != nil {
+		a.failed(a, msg.Error)
+	}
+	return true
+}
+
+func (a *Agent) receive(msg AgentMessage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store != nil {
+		snap, err := json.Marshal(a.snap)
+		if err != nil {
+			return fmt.Errorf("marshal agent: %w", err)
+		}
+		raw, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("marshal message: %w", err)
+		}
+		v, err := a.store.AppendEvent(a.Template, a.ID, a.version, raw, snap)
+		if err != nil {
+			return fmt.Errorf("append message to agent %s: %w", a.ID, err)
+		}
+		a.version = v
+	}
+	a.messages = append(a.messages, msg)
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (a *Agent) create() error {
+	if a.store == nil {
+		return nil
+	}
+	snap, err := json.Marshal(a.snap)
+	if err != nil {
+		return fmt.Errorf("marshal agent: %w", err)
+	}
+	inst := &store.Instance{MachineID: a.Template, ID: a.ID, State: snap}
+	if err := a.store.Create(inst); err != nil {
+		return fmt.Errorf("create agent %s: %w", a.ID, err)
+	}
+	a.version = inst.Version
+	return nil
+}
+
+// saveDeliveryLocked appends the outcome of handling message i to the
+// agent's log along with the snapshot; a.mu must be held.
+func (a *Agent) saveDeliveryLocked(i int) error {
+	if a.store == nil {
+		return nil
+	}
+	snap, err := json.Marshal(a.snap)
+	if err != nil {
+		return fmt.Errorf("marshal agent: %w", err)
+	}
+	msg := a.messages[i]
+	raw, err := json.Marshal(agentDelivery{Delivered: i, Actions: msg.Actions, Failures: msg.Failures, Error: msg.Error})
+	if err != nil {
+		return fmt.Errorf("marshal delivery: %w", err)
+	}
+	v, err := a.store.AppendEvent(a.Template, a.ID, a.version, raw, snap)
+	if err != nil {
+		return fmt.Errorf("save agent %s: %w", a.ID, err)
+	}
+	a.version = v
+	return nil
+}
+
+// retire stops the agent and deletes it from the store. The runtime is
+// stopped by run, so an agent may retire itself from one of its actions.
+func (a *Agent) retire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	close(a.stop)
+	if a.store != nil {
+		if err := a.store.Delete(a.Template, a.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			slog.Warn("delete agent failed", "id", a.ID, "err", err)
+		}
+		a.store = nil
+	}
+}
+
+// Info returns the agent's current state and the events it has handled.
+func (a *Agent) Info() statechart.AgentInfo {
+	return a.info()
+}
+
+// Context returns a copy of the agent's context.
+func (a *Agent) Context() map[string]any {
+	a.mu.Lock()
+	rt := a.rt
+	a.mu.Unlock()
+	return rt.Ctx().GetAll()
+}
+
+// Current returns the path of the agent's current state.
+func (a *Agent) Current() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current
+}
+
+// Supervisor returns who supervises the agent.
+func (a *Agent) Supervisor() statechart.Supervisor {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.snap.Supervisor
+}
+
+// Mailbox returns the messages the agent has not handled yet, oldest first.
+func (a *Agent) Mailbox() []AgentMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AgentMessage{}, a.messages[a.snap.Delivered:]...)
+}
+
+// Handled returns the messages the agent has handled, oldest first, with the
+// actions and failures they caused.
+func (a *Agent) Handled() []AgentMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AgentMessage{}, a.messages[:a.snap.Delivered]...)
+}
+
+func (a *Agent) info() statechart.AgentInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	history := make([]statechartx.Event, 0, a.snap.Delivered)
+	for _, msg := range a.messages[:a.snap.Delivered] {
+		if eid, ok := a.aug.EventIDByName[msg.Event]; ok && msg.Error == "" {
+			history = append(history, statechartx.Event{ID: eid, Data: msg.Data})
+		}
+	}
+	return statechart.AgentInfo{
+		ID:       a.ID,
+		Template: a.Template,
+		Current:  a.current,
+		Pending:  len(a.messages) - a.snap.Delivered,
+		History:  history,
+	}
+}
@@ -0,0 +1,411 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/comalice/maelstrom/registry/statechart"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// A registry spec can start from another one with `extends: <spec>`, deep-merging
+// its own llm, guards, actions and machine states over the base's, and pull
+// single actions, guards or states from one with `$ref: <spec>#/<path>`; keys
+// next to $ref are merged over the referenced node. <spec> is a file name, or
+// a machine name with an optional @version as for Registry.Machine.
+// Composition works on the rendered YAML nodes, so diagnostics keep their lines
+// and statechart.Origins names the file each node comes from.
+const (
+	extendsKey = "extends"
+	refKey     = "$ref"
+)
+
+// inheritedKeys are the top-level keys a spec inherits from the one it
+// extends, besides machine.states. Its name, version, migrations and the rest
+// are its own.
+var inheritedKeys = []string{"llm", "guards", "actions"}
+
+// composeError is a composition failure at node of file.
+type composeError struct {
+	File string
+	Path []string
+	Node *yamlv3.Node
+	Err  error
+}
+
+func (e *composeError) Error() string { return fmt.Sprintf("%s: %v", e.File, e.Err) }
+func (e *composeError) Unwrap() error { return e.Err }
+
+// composer composes the specs of one set of rendered registry files.
+type composer struct {
+	parsed  map[string]*yamlv3.Node // parsed sources by file name
+	targets []string                // files extends and $ref can name, sorted
+	docs    map[string]*yamlv3.Node // composed documents by file name
+	failed  map[string]error        // files that failed to compose; their nodes are half resolved
+	origins statechart.Origins
+	stack   []string // files being composed, for cycle detection
+}
+
+// newComposer parses sources; targets are the files specs may extend or
+// reference. Files that do not parse are left to the caller to report.
+func newComposer(sources map[string][]byte, targets []string) *composer {
+	c := &composer{
+		parsed:  make(map[string]*yamlv3.Node),
+		docs:    make(map[string]*yamlv3.Node),
+		failed:  make(map[string]error),
+		origins: make(statechart.Origins),
+		targets: slices.Sorted(slices.Values(targets)),
+	}
+	for file, src := range sources {
+		var root yamlv3.Node
+		if err := yamlv3.Unmarshal(src, &root); err != nil || root.Kind == 0 {
+			continue
+		}
+		c.add(file, &root)
+	}
+	return c
+}
+
+// add records the parsed source of file and the origin of its nodes.
+func (c *composer) add(file string, root *yamlv3.Node) {
+	c.parsed[file] = root
+	var mark func(n *yamlv3.Node)
+	mark = func(n *yamlv3.Node) {
+		c.origins[n] = file
+		for _, child := range n.Content {
+			mark(child)
+		}
+	}
+	mark(root)
+}
+
+// compose returns the document of file with its extends and $refs resolved.
+func (c *composer) compose(file string) (*yamlv3.Node, error) {
+	if doc, ok := c.docs[file]; ok {
+		return doc, nil
+	}
+	if err, ok := c.failed[file]; ok {
+		return nil, err
+	}
+	if i := slices.Index(c.stack, file); i >= 0 {
+		return nil, fmt.Errorf("composition cycle: %s", strings.Join(append(slices.Clone(c.stack[i:]), file), " -> "))
+	}
+	root, ok := c.parsed[file]
+	if !ok {
+		return nil, fmt.Errorf("%s does not parse", file)
+	}
+	c.stack = append(c.stack, file)
+	doc, err := c.composeDoc(file, root)
+	c.stack = c.stack[:len(c.stack)-1]
+	if err != nil {
+		c.failed[file] = err
+		return nil, err
+	}
+	c.docs[file] = doc
+	return doc, nil
+}
+
+func (c *composer) composeDoc(file string, root *yamlv3.Node) (*yamlv3.Node, error) {
+	m := mapping(root)
+	if m == nil {
+		return root, nil
+	}
+	resolved, err := c.resolveRefs(file, m, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ext := take(resolved, extendsKey); ext != nil {
+		base, err := c.extend(file, ext)
+		if err != nil {
+			return nil, err
+		}
+		resolved = merge(inheritable(base), resolved)
+	}
+	return &yamlv3.Node{Kind: yamlv3.DocumentNode, Line: root.Line, Column: root.Column, Content: []*yamlv3.Node{resolved}}, nil
+}
+
+// extend returns the composed mapping of the spec file extends.
+func (c *composer) extend(file string, ext *yamlv3.Node) (*yamlv3.Node, error) {
+	fail := func(err error) error {
+		return &composeError{File: file, Path: []string{extendsKey}, Node: ext, Err: err}
+	}
+	if ext.Kind != yamlv3.ScalarNode || ext.Value == "" {
+		return nil, fail(errors.New("extends must name a spec"))
+	}
+	baseFile, err := c.lookup(ext.Value)
+	if err != nil {
+		return nil, fail(err)
+	}
+	base, err := c.compose(baseFile)
+	if err != nil {
+		return nil, fail(fmt.Errorf("extends %s: %w", ext.Value, err))
+	}
+	m := mapping(base)
+	if m == nil {
+		return nil, fail(fmt.Errorf("extends %s: %s is not a mapping", ext.Value, baseFile))
+	}
+	return m, nil
+}
+
+// resolveRefs returns a copy of n with the $ref mappings under it replaced by
+// their targets, leaving the parsed source alone. keys is the path of n, for
+// errors.
+func (c *composer) resolveRefs(file string, n *yamlv3.Node, keys []string) (*yamlv3.Node, error) {
+	if n.Kind != yamlv3.MappingNode && n.Kind != yamlv3.SequenceNode {
+		return n, nil
+	}
+	if ref := value(n, refKey); n.Kind == yamlv3.MappingNode && ref != nil {
+		target, err := c.ref(file, ref)
+		if err != nil {
+			return nil, &composeError{File: file, Path: append(slices.Clone(keys), refKey), Node: ref, Err: err}
+		}
+		rest := c.copyNode(n)
+		take(rest, refKey)
+		if len(rest.Content) == 0 {
+			return target, nil
+		}
+		rest, err = c.resolveRefs(file, rest, keys)
+		if err != nil {
+			return nil, err
+		}
+		return merge(target, rest), nil
+	}
+	out := c.copyNode(n)
+	for i, child := range n.Content {
+		key := strconv.Itoa(i)
+		if n.Kind == yamlv3.MappingNode {
+			if i%2 == 0 {
+				continue
+			}
+			key = n.Content[i-1].Value
+		}
+		resolved, err := c.resolveRefs(file, child, append(keys, key))
+		if err != nil {
+			return nil, err
+		}
+		out.Content[i] = resolved
+	}
+	return out, nil
+}
+
+// copyNode returns a shallow copy of n with its own Content, from the same file.
+func (c *composer) copyNode(n *yamlv3.Node) *yamlv3.Node {
+	out := *n
+	out.Content = slices.Clone(n.Content)
+	if file, ok := c.origins[n]; ok {
+		c.origins[&out] = file
+	}
+	return &out
+}
+
+// ref returns the node a `$ref: <spec>#/<path>` names.
+func (c *composer) ref(file string, ref *yamlv3.Node) (*yamlv3.Node, error) {
+	if ref.Kind != yamlv3.ScalarNode {
+		return nil, errors.New("$ref must be a string")
+	}
+	spec, pointer, ok := strings.Cut(ref.Value, "#")
+	if !ok || spec == "" || !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("$ref %q: want <spec>#/<path>", ref.Value)
+	}
+	target, err := c.lookup(spec)
+	if err != nil {
+		return nil, fmt.Errorf("$ref %q: %w", ref.Value, err)
+	}
+	doc, err := c.compose(target)
+	if err != nil {
+		return nil, fmt.Errorf("$ref %q: %w", ref.Value, err)
+	}
+	n := mapping(doc)
+	for _, seg := range strings.Split(pointer[1:], "/") {
+		seg = strings.ReplaceAll(strings.ReplaceAll(seg, "~1", "/"), "~0", "~")
+		var next *yamlv3.Node
+		switch {
+		case n == nil:
+		case n.Kind == yamlv3.MappingNode:
+			next = value(n, seg)
+		case n.Kind == yamlv3.SequenceNode:
+			if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(n.Content) {
+				next = n.Content[i]
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("$ref %q: %s has no %s", ref.Value, target, strings.ReplaceAll(pointer[1:], "/", "."))
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// lookup returns the target file a spec reference names: the file itself, or
+// the file whose name and version match like Registry.Machine. Without a
+// version, or with @latest, the highest one is used.
+func (c *composer) lookup(spec string) (string, error) {
+	if slices.Contains(c.targets, spec) {
+		return spec, nil
+	}
+	name, version := ParseMachineRef(spec)
+	var found []string
+	for _, file := range c.targets {
+		fname, fversion := c.specID(file)
+		if fname == name && (version == "" || version == LatestVersion || fversion == version) {
+			found = append(found, file)
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no registry spec %q", spec)
+	}
+	slices.SortStableFunc(found, func(a, b string) int {
+		_, va := c.specID(a)
+		_, vb := c.specID(b)
+		return compareVersions(vb, va)
+	})
+	return found[0], nil
+}
+
+// specID returns the name and version a file is referenced by; see specID.
+func (c *composer) specID(file string) (string, string) {
+	var specVersion string
+	if m := mapping(c.parsed[file]); m != nil {
+		if v := value(m, "version"); v != nil && v.Kind == yamlv3.ScalarNode {
+			specVersion = v.Value
+		}
+	}
+	return specID(file, specVersion)
+}
+
+// compareVersions compares dotted versions numerically where both parts are
+// numbers, so 1.10 sorts after 1.9.
+func compareVersions(a, b string) int {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var sa, sb string
+		if i < len(pa) {
+			sa = pa[i]
+		}
+		if i < len(pb) {
+			sb = pb[i]
+		}
+		na, erra := strconv.Atoi(sa)
+		nb, errb := strconv.Atoi(sb)
+		switch {
+		case erra == nil && errb == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+			return 1
+		case (erra != nil || errb != nil) && sa != sb:
+			return strings.Compare(sa, sb)
+		}
+	}
+	return 0
+}
+
+// merge deep-merges the mapping over onto base without changing either:
+// mappings merge key by key, anything else in over replaces base.
+func merge(base, over *yamlv3.Node) *yamlv3.Node {
+	if base.Kind != yamlv3.MappingNode || over.Kind != yamlv3.MappingNode {
+		return over
+	}
+	out := *base
+	out.Content = slices.Clone(base.Content)
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		k, v := over.Content[i], over.Content[i+1]
+		if j := keyIndex(&out, k.Value); j >= 0 {
+			out.Content[j], out.Content[j+1] = k, merge(out.Content[j+1], v)
+		} else {
+			out.Content = append(out.Content, k, v)
+		}
+	}
+	return &out
+}
+
+// inheritable returns the part of a base spec mapping that specs extending it
+// inherit: its inheritedKeys and machine.states.
+func inheritable(base *yamlv3.Node) *yamlv3.Node {
+	out := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: base.Tag, Line: base.Line, Column: base.Column}
+	for _, key := range inheritedKeys {
+		if i := keyIndex(base, key); i >= 0 {
+			out.Content = append(out.Content, base.Content[i], base.Content[i+1])
+		}
+	}
+	if i := keyIndex(base, "machine"); i >= 0 && base.Content[i+1].Kind == yamlv3.MappingNode {
+		m := base.Content[i+1]
+		if j := keyIndex(m, "states"); j >= 0 {
+			states := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: m.Tag, Line: m.Line, Column: m.Column, Content: slices.Clone(m.Content[j : j+2])}
+			out.Content = append(out.Content, base.Content[i], states)
+		}
+	}
+	return out
+}
+
+// composes reports whether a document uses extends or $ref.
+func composes(n *yamlv3.Node) bool {
+	if m := mapping(n); m != nil && value(m, extendsKey) != nil {
+		return true
+	}
+	var walk func(n *yamlv3.Node) bool
+	walk = func(n *yamlv3.Node) bool {
+		if n.Kind == yamlv3.MappingNode && value(n, refKey) != nil {
+			return true
+		}
+		return slices.ContainsFunc(n.Content, walk)
+	}
+	return walk(n)
+}
+
+// mapping returns the top-level mapping of a document, or nil.
+func mapping(n *yamlv3.Node) *yamlv3.Node {
+	if n != nil && n.Kind == yamlv3.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	if n == nil || n.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	return n
+}
+
+func keyIndex(m *yamlv3.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func value(m *yamlv3.Node, key string) *yamlv3.Node {
+	if i := keyIndex(m, key); i >= 0 {
+		return m.Content[i+1]
+	}
+	return nil
+}
+
+// take removes key from the mapping m and returns its value.
+func take(m *yamlv3.Node, key string) *yamlv3.Node {
+	i := keyIndex(m, key)
+	if i < 0 {
+		return nil
+	}
+	v := m.Content[i+1]
+	m.Content = slices.Delete(m.Content, i, i+2)
+	return v
+}
+
+// composeDiagnostic describes a composition error of file, positioned at the
+// innermost extends or $ref that failed, which may be in another file.
+func composeDiagnostic(file string, err error) statechart.Diagnostic {
+	d := statechart.Diagnostic{Severity: statechart.SeverityError, Path: extendsKey, Message: err.Error()}
+	var ce *composeError
+	for e := err; errors.As(e, &ce); e = ce.Err {
+		d.Path = strings.Join(ce.Path, ".")
+		d.Line, d.Column = ce.Node.Line, ce.Node.Column
+		d.File = ce.File
+	}
+	if d.File == file {
+		d.File = ""
+	}
+	return d
+}
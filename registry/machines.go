@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/comalice/maelstrom/registry/statechart"
+	"github.com/comalice/maelstrom/registry/yaml"
+)
+
+// LatestVersion addresses the highest version of a machine, as does a name
+// without a version.
+const LatestVersion = "latest"
+
+// MachineVersion is one version of a statechart in the registry. Several
+// versions of a machine live side by side in files like
+// research-agent-v1.0.yaml and research-agent-v2.0.yaml.
+type MachineVersion struct {
+	Name     string                       `json:"name"`
+	Version  string                       `json:"version"`
+	Filename string                       `json:"filename"`
+	Machine  *statechart.AugmentedMachine `json:"-"`
+}
+
+// Ref returns "name@version".
+func (m MachineVersion) Ref() string { return MachineRef(m.Name, m.Version) }
+
+// ParseMachineRef splits "name@version"; version is empty for a bare name.
+func ParseMachineRef(ref string) (name, version string) {
+	name, version, _ = strings.Cut(ref, "@")
+	return name, version
+}
+
+// MachineRef joins a machine name and version; an empty version gives the
+// bare name, which addresses the latest version.
+func MachineRef(name, version string) string {
+	if version == "" {
+		return name
+	}
+	return name + "@" + version
+}
+
+// specID returns the name and version a registry file is addressed by: its
+// file name without version, and the version in its file name or else its
+// spec version.
+func specID(filename, specVersion string) (string, string) {
+	name, version := yaml.NameVersion(filename)
+	if version == "" {
+		version = specVersion
+	}
+	return name, version
+}
+
+// machineIndex is the active statecharts of one registry generation.
+type machineIndex struct {
+	gen    uint64
+	list   []MachineVersion            // by name, oldest version first
+	byName map[string][]MachineVersion // by name, oldest version first
+}
+
+// changed marks the registry files changed, so the machine index is rebuilt
+// on next use.
+func (r *Registry) changed() { r.gen.Add(1) }
+
+// machines returns the machine index, building it from List when the
+// registry changed since it was last built.
+func (r *Registry) machines() *machineIndex {
+	r.machinesMu.Lock()
+	defer r.machinesMu.Unlock()
+	gen := r.gen.Load()
+	if r.index != nil && r.index.gen == gen {
+		return r.index
+	}
+	idx := &machineIndex{gen: gen, byName: make(map[string][]MachineVersion)}
+	for _, item := range r.List() {
+		if item.Type != "statechart" || !item.Active || item.StatechartAugmented == nil {
+			continue
+		}
+		name, version := specID(item.Filename, item.StatechartAugmented.Spec.Version)
+		idx.list = append(idx.list, MachineVersion{Name: name, Version: version, Filename: item.Filename, Machine: item.StatechartAugmented})
+	}
+	slices.SortFunc(idx.list, func(a, b MachineVersion) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		if c := compareVersions(a.Version, b.Version); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Filename, b.Filename)
+	})
+	for _, m := range idx.list {
+		idx.byName[m.Name] = append(idx.byName[m.Name], m)
+	}
+	r.index = idx
+	return idx
+}
+
+// MachineVersions lists the active statecharts by name, oldest version first.
+func (r *Registry) MachineVersions() []MachineVersion {
+	return slices.Clone(r.machines().list)
+}
+
+// Machine resolves "name", "name@latest" or "name@version" to an active
+// statechart. The name is the file name without its version and extension.
+func (r *Registry) Machine(ref string) (MachineVersion, error) {
+	name, version := ParseMachineRef(ref)
+	versions := r.machines().byName[name]
+	switch version {
+	case "", LatestVersion:
+		if len(versions) > 0 {
+			return versions[len(versions)-1], nil
+		}
+	default:
+		for _, m := range versions {
+			if m.Version == version {
+				return m, nil
+			}
+		}
+	}
+	return MachineVersion{}, fmt.Errorf("machine %q not found", ref)
+}
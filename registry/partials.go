@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PartialsDir is the directory of the registry dir that holds the partials
+// templates include, e.g. {{include "partials/tone.tmpl" .}}.
+const PartialsDir = "partials"
+
+// Partial returns the source of a partial by its path relative to the registry
+// dir. Partials are cached on first use and kept current by the watcher.
+func (r *Registry) Partial(name string) (string, error) {
+	clean := path.Clean(name)
+	base := strings.TrimPrefix(clean, PartialsDir+"/")
+	if base == clean || base == "" || strings.Contains(base, "/") || strings.HasPrefix(base, ".") {
+		return "", fmt.Errorf("invalid partial %q: must be a file in %s/", name, PartialsDir)
+	}
+	r.partialsMu.RLock()
+	src, ok := r.partials[base]
+	r.partialsMu.RUnlock()
+	if ok {
+		return src, nil
+	}
+	b, err := os.ReadFile(filepath.Join(r.dir, PartialsDir, base))
+	if err != nil {
+		return "", err
+	}
+	r.setPartial(base, string(b))
+	return string(b), nil
+}
+
+func (r *Registry) setPartial(base, src string) {
+	r.partialsMu.Lock()
+	defer r.partialsMu.Unlock()
+	if r.partials == nil {
+		r.partials = make(map[string]string)
+	}
+	r.partials[base] = src
+}
+
+// watchPartials adds the partials dir to the watcher if it exists.
+func (r *Registry) watchPartials() {
+	dir := filepath.Join(r.dir, PartialsDir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return
+	}
+	if err := r.watcher.Add(dir); err != nil {
+		slog.Warn("watch partials failed", "dir", dir, "err", err)
+	}
+}
+
+// partialChanged reloads or drops the cached partial at file after a watcher event.
+func (r *Registry) partialChanged(file string, removed bool) {
+	base := filepath.Base(file)
+	if removed {
+		r.partialsMu.Lock()
+		delete(r.partials, base)
+		r.partialsMu.Unlock()
+		r.changed()
+		slog.Info("partial removed", "file", base)
+		return
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		slog.Error("read partial failed", "file", file, "err", err)
+		return
+	}
+	r.setPartial(base, string(b))
+	r.changed()
+	slog.Info("partial reloaded", "file", base)
+}
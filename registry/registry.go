@@ -2,33 +2,32 @@ package registry
 
 import (
 	"errors"
-	"fmt"
 	"log/slog"
-	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/comalice/maelstrom/config"
+	"github.com/comalice/maelstrom/internal/llm"
+	"github.com/comalice/maelstrom/internal/store"
 	"github.com/comalice/maelstrom/internal/tools"
 	"github.com/comalice/maelstrom/registry/statechart"
 	"github.com/comalice/maelstrom/registry/yaml"
 	"github.com/fsnotify/fsnotify"
-	"github.com/google/uuid"
-	"github.com/comalice/maelstrom/internal/llm"
 	yamlv3 "gopkg.in/yaml.v3"
-	"strings"
 )
 
 type YAMLImport struct {
-	Content             map[string]any             `json:"content"`
-	Version             string                    `json:"version"`
-	Active              bool                      `json:"active"`
-	Filename            string                    `json:"filename"`
-	Type                string                    `json:"type,omitempty"`
-	Tools               []tools.ToolSchema        `json:"tools,omitempty"`
+	Content             map[string]any               `json:"content"`
+	Version             string                       `json:"version"`
+	Active              bool                         `json:"active"`
+	Filename            string                       `json:"filename"`
+	Type                string                       `json:"type,omitempty"`
+	Tools               []tools.ToolSchema           `json:"tools,omitempty"`
+	Diagnostics         []statechart.Diagnostic      `json:"diagnostics,omitempty"`
 	StatechartAugmented *statechart.AugmentedMachine `json:"-"`
-	Raw                 string                    `json:"-"`
+	Raw                 string                       `json:"-"`
 }
 
 type RawYAML struct {
@@ -38,34 +37,54 @@ type RawYAML struct {
 }
 
 type Registry struct {
-	mu       sync.RWMutex
-	items    map[string]*YAMLImport
-	watcher  *fsnotify.Watcher
-	stop     chan struct{}
-	dir      string                          // Track watch dir
-	Config   *config.AppConfig               `json:"-"`
-	Env      map[string]string               `json:"-"`
-	resolver *config.ConfigHierarchyResolver `json:"-"`
-	AgentsDir    string                           `json:"agents_dir"`
-	RuntimeDir   string                           `json:"runtime_dir"`
-	MaxAgents    int                              `json:"max_agents"`
-	CostPerHour  float64                          `json:"cost_per_hour"`
-	NumAgents      atomic.Int32                     `json:"num_agents"`
-	MaxLLMCalls    atomic.Int32                     `json:"max_llm_calls"`
-	Machines       map[string]*statechart.AugmentedMachine `json:"-"`
-	Tools          *tools.ToolRegistry                    `json:"tools"`
+	mu          sync.RWMutex
+	items       map[string]*YAMLImport
+	watcher     *fsnotify.Watcher
+	stop        chan struct{}
+	dir         string                                  // Track watch dir
+	Config      *config.AppConfig                       `json:"-"`
+	Env         map[string]string                       `json:"-"`
+	resolver    *config.ConfigHierarchyResolver         `json:"-"`
+	AgentsDir   string                                  `json:"agents_dir"`
+	RuntimeDir  string                                  `json:"runtime_dir"`
+	MaxAgents   int                                     `json:"max_agents"`
+	CostPerHour float64                                 `json:"cost_per_hour"`
+	NumAgents   atomic.Int32                            `json:"num_agents"`
+	MaxLLMCalls atomic.Int32                            `json:"max_llm_calls"`
+	Machines    map[string]*statechart.AugmentedMachine `json:"-"`
+	Tools       *tools.ToolRegistry                     `json:"tools"`
+
+	agents      map[string]*Agent      // hired agents by ID
+	agentsStore store.InstanceStore    // agents persisted under RuntimeDir, see agentStore
+	hourlyCost  float64                // summed cost_per_hour of the hired agents
+	supervisors map[string]*supervisor // restart history by supervisor target
+	partialsMu  sync.RWMutex           // guards partials, apart from mu as List renders under mu
+	partials    map[string]string      // partial sources by file name, see Partial
+	gen         atomic.Uint64          // bumped whenever files, partials or config change
+	machinesMu  sync.Mutex             // guards index
+	index       *machineIndex          // active statecharts, see machines
+
+	// Supervision is how the root supervisor restarts the agents hired over
+	// HTTP or with HireAgent.
+	Supervision statechart.Supervision `json:"supervision"`
+	// NotifyInstance delivers supervision events to the instance that hired
+	// a failed agent.
+	NotifyInstance func(mid, iid, event string, data any) error `json:"-"`
 }
 
 var ErrMaxAgents = errors.New("max agents reached")
+var ErrBudgetExceeded = errors.New("agent budget exceeded")
+var ErrAgentNotFound = errors.New("agent not found")
 var ErrMaxLLMCalls = errors.New("max llm calls reached")
 
 var GlobalRegistry *Registry
 
 func New() *Registry {
 	return &Registry{
-		items:    make(map[string]*YAMLImport),
-		Machines: make(map[string]*statechart.AugmentedMachine),
-		stop:     make(chan struct{}),
+		items:     make(map[string]*YAMLImport),
+		Machines:  make(map[string]*statechart.AugmentedMachine),
+		agents:    make(map[string]*Agent),
+		stop:      make(chan struct{}),
 		MaxAgents: 5,
 		NumAgents: atomic.Int32{},
 	}
@@ -75,8 +94,21 @@ func (r *Registry) SetDir(dir string) { r.dir = dir }
 
 func (r *Registry) SetConfig(cfg *config.AppConfig) {
 	r.Config = cfg
+	if r.AgentsDir == "" {
+		r.AgentsDir = cfg.AgentsDir
+	}
+	if r.RuntimeDir == "" {
+		r.RuntimeDir = cfg.RuntimeDir
+	}
+	if cfg.MaxAgents > 0 {
+		r.MaxAgents = cfg.MaxAgents
+	}
+	if cfg.CostPerHour > 0 {
+		r.CostPerHour = cfg.CostPerHour
+	}
 	slog.Info("registry config set")
 	r.resolver = config.NewResolver(r.Config)
+	r.changed()
 }
 
 func (r *Registry) scanDir() error {
@@ -114,6 +146,7 @@ func (r *Registry) InitWatcher(dir string) error {
 		slog.Warn("scan dir failed", "err", err)
 	}
 	r.watcher = w
+	r.watchPartials()
 	GlobalRegistry = r
 	go r.watch()
 	return nil
@@ -127,6 +160,14 @@ func (r *Registry) watch() {
 			if !ok {
 				return
 			}
+			if filepath.Dir(event.Name) == filepath.Join(r.dir, PartialsDir) {
+				r.partialChanged(event.Name, event.Op&(fsnotify.Remove|fsnotify.Rename) != 0)
+				continue
+			}
+			if event.Name == filepath.Join(r.dir, PartialsDir) && event.Op&fsnotify.Create != 0 {
+				r.watchPartials()
+				continue
+			}
 			name := filepath.Base(event.Name)
 			matchYAML, _ := filepath.Match("*.yaml", name)
 			matchYML, _ := filepath.Match("*.yml", name)
@@ -142,6 +183,7 @@ func (r *Registry) watch() {
 				r.mu.Lock()
 				r.items[name] = &YAMLImport{Raw: raw, Version: ver, Active: true, Filename: name}
 				r.mu.Unlock()
+				r.changed()
 				slog.Info("imported raw", "file", name, "ver", ver)
 			} else if event.Op&fsnotify.Remove != 0 || event.Op&fsnotify.Rename != 0 {
 				r.mu.Lock()
@@ -150,6 +192,7 @@ func (r *Registry) watch() {
 					slog.Info("deactivated", "file", name)
 				}
 				r.mu.Unlock()
+				r.changed()
 			}
 		case err, ok := <-r.watcher.Errors:
 			if !ok {
@@ -166,43 +209,86 @@ func (r *Registry) Stop() {
 	close(r.stop)
 }
 
+// renderData is what registry files are rendered with at load time. Templates
+// using runtime data (.Context, .Event, ...) are kept and rendered each time
+// their action runs.
+type renderData struct {
+	App *config.AppConfig `json:"-"`
+	Env map[string]string `json:"-"`
+}
+
+// render returns the content and source of a registry file rendered with the
+// config; ok is false if it failed to render, leaving the raw source.
+func (r *Registry) render(item *YAMLImport) (content map[string]any, source []byte, ok bool) {
+	content, source = map[string]any{}, []byte(item.Raw)
+	if item.Raw == "" {
+		return content, source, false
+	}
+	if r.Config == nil {
+		if err := yamlv3.Unmarshal(source, &content); err != nil {
+			content = map[string]any{}
+		}
+		return content, source, false
+	}
+	data := renderData{App: r.Config, Env: r.Config.Variables}
+	content, err := yaml.RenderWith(item.Raw, data, r.Partial)
+	if err != nil {
+		slog.Warn("render failed", "file", item.Version, "err", err)
+		return map[string]any{}, source, false
+	}
+	source, _ = yaml.RenderBytesWith(item.Raw, data, r.Partial)
+	return content, source, true
+}
+
+// composer renders the registry files and returns them with a composer for
+// their extends and $refs. Callers hold r.mu.
+func (r *Registry) composer() (*composer, map[string]map[string]any, map[string]bool) {
+	sources := make(map[string][]byte, len(r.items))
+	contents := make(map[string]map[string]any, len(r.items))
+	rendered := make(map[string]bool, len(r.items))
+	var targets []string
+	for name, item := range r.items {
+		contents[name], sources[name], rendered[name] = r.render(item)
+		if item.Active {
+			targets = append(targets, name)
+		}
+	}
+	return newComposer(sources, targets), contents, rendered
+}
+
 func (r *Registry) List() []*YAMLImport {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	c, contents, rendered := r.composer()
 	list := make([]*YAMLImport, 0, len(r.items))
-	for _, item := range r.items {
+	for name, item := range r.items {
 		newItem := &YAMLImport{
 			Version:  item.Version,
 			Active:   item.Active,
 			Filename: item.Filename,
 			Raw:      item.Raw,
-			Content:  map[string]any{},
+			Content:  contents[name],
 		}
-		var renderErr error
-		if newItem.Raw != "" {
-			if r.Config != nil {
-				type renderData struct {
-					App     *config.AppConfig `json:"-"`
-					Env     map[string]string `json:"-"`
-					Context any               `json:"-"`
-					Event   any               `json:"-"`
-				}
-				data := renderData{
-					App:     r.Config,
-					Env:     r.Config.Variables,
-					Context: map[string]any{"history": []any{}},     // Dummy for static YAML render (.Context.history); runtime: rt.EmbedContext()
-					Event:   map[string]any{"Data": map[string]string{"message": "[no message]"}}, // Dummy for static render (.Event.Data.message in prompts); runtime Event passed to actions
-				}
-				newItem.Content, renderErr = yaml.Render(newItem.Raw, data)
-				if renderErr != nil {
-					slog.Warn("render failed", "file", item.Version, "err", renderErr)
-					newItem.Content = map[string]any{}
-				}
-			} else {
-				if err := yamlv3.Unmarshal([]byte(newItem.Raw), &newItem.Content); err != nil {
-					newItem.Content = map[string]any{}
+
+		// Compose extends and $refs; the composed nodes keep the lines of
+		// their files, so diagnostics point at the right place.
+		var spec *statechart.YamlMachineSpec
+		var perr error
+		if doc, cerr := c.compose(name); cerr != nil {
+			if _, parsed := c.parsed[name]; parsed {
+				newItem.Active = false
+				newItem.Diagnostics = append(newItem.Diagnostics, composeDiagnostic(name, cerr))
+				slog.Warn("compose failed, not activated", "file", newItem.Filename, "err", cerr)
+			}
+			perr = cerr
+		} else {
+			if rendered[name] {
+				composed := map[string]any{}
+				if err := doc.Decode(&composed); err == nil {
+					newItem.Content = composed
 				}
 			}
+			spec, perr = statechart.DecodeSpec(doc, c.origins)
 		}
 
 		if r.resolver != nil && newItem.Content != nil && len(newItem.Content) > 0 {
@@ -210,25 +296,33 @@ func (r *Registry) List() []*YAMLImport {
 			newItem.Content["resolved"] = config.ToResolvedMap(res)
 		}
 
-		// Attempt to parse as statechart
-		var parseBytes []byte
-		if renderErr == nil {
-			renderedBytes, _ := yamlv3.Marshal(newItem.Content)
-			parseBytes = renderedBytes
-		} else {
-			parseBytes = []byte(newItem.Raw)
-		}
-		spec, perr := statechart.ParseSpec(parseBytes)
 		if perr == nil && spec.Machine.ID != "" {
 			newItem.Type = "statechart"
 			if r.resolver != nil {
 				resolved := r.resolver.Resolve(newItem.Content, nil, nil)
 				spec.LLM = toLLMConfig(resolved)
 			}
-			aug, merr := spec.ToAugmentedMachine(r)
-			if merr == nil {
+			spec.App = r.Config
+			spec.Partials = r.Partial
+			newItem.Diagnostics = statechart.Validate(spec)
+			for i := range newItem.Diagnostics {
+				if newItem.Diagnostics[i].File == name {
+					newItem.Diagnostics[i].File = ""
+				}
+			}
+			if verr := statechart.ValidationError(newItem.Diagnostics); verr != nil {
+				// Invalid specs are listed with their diagnostics but never activated.
+				newItem.Active = false
+				slog.Warn("statechart invalid, not activated", "file", newItem.Filename, "err", verr)
+			} else if aug, merr := spec.ToAugmentedMachine(r); merr == nil {
 				newItem.StatechartAugmented = aug
 			} else {
+				newItem.Active = false
+				newItem.Diagnostics = append(newItem.Diagnostics, statechart.Diagnostic{
+					Severity: statechart.SeverityError,
+					Path:     "machine",
+					Message:  merr.Error(),
+				})
 				slog.Warn("statechart ToAugmentedMachine failed", "file", newItem.Filename, "err", merr)
 			}
 		} else {
@@ -281,107 +375,13 @@ func toLLMConfig(res *config.ResolvedMachineConfig) llm.LLMConfig {
 		tokens = *res.MaxTokens
 	}
 	return llm.LLMConfig{
-		Provider:   res.Provider,
-		Model:      res.Model,
-		APIKey:     res.APIKey,
-		Endpoint:   endpoint,
-		Temp:       temp,
-		MaxTokens:  tokens,
-	}
-}
-
-func (r *Registry) HireAgent(template string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if int(r.NumAgents.Load()) >= r.MaxAgents {
-		return ErrMaxAgents
-	}
-
-	if r.AgentsDir == "" {
-		return fmt.Errorf("AgentsDir not set")
-	}
-
-	agentPath := filepath.Join(r.AgentsDir, template+".yaml")
-	dataBytes, err := os.ReadFile(agentPath)
-	if err != nil {
-		return fmt.Errorf("read agent template %q: %w", agentPath, err)
-	}
-
-	agentRaw := string(dataBytes)
-
-	type renderData struct {
-		App *config.AppConfig `json:"-"`
-		Env map[string]string `json:"-"`
-	}
-	data := renderData{App: r.Config, Env: r.Config.Variables}
-	content, renderErr := yaml.Render(agentRaw, data)
-
-	var parseBytes []byte
-	if renderErr == nil {
-		renderedBytes, _ := yamlv3.Marshal(content)
-		parseBytes = renderedBytes
-		slog.Info("agent template rendered", "template", template)
-	} else {
-		parseBytes = []byte(agentRaw)
-		slog.Warn("agent template render failed, using raw", "template", template, "err", renderErr)
-	}
-
-	spec, err := statechart.ParseSpec(parseBytes)
-	if err != nil {
-		return fmt.Errorf("parse agent spec %q: %w", template, err)
-	}
-
-	aug, err := spec.ToAugmentedMachine(r)
-	if err != nil {
-		return fmt.Errorf("augment agent machine %q: %w", template, err)
-	}
-
-	id := uuid.New().String()
-	r.Machines[id] = aug
-	r.NumAgents.Add(1)
-
-	slog.Info("hired agent", "id", id, "template", template)
-	return nil
-}
-
-func (r *Registry) RetireAgent(id string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if _, ok := r.Machines[id]; ok {
-		delete(r.Machines, id)
-		r.NumAgents.Add(-1)
-		slog.Info("retired agent", "id", id)
-	} else {
-		return fmt.Errorf("agent %q not found", id)
-	}
-	return nil
-}
-
-func (r *Registry) SendMessage(toID string, msg map[string]any) error {
-	r.mu.RLock()
-	_, ok := r.Machines[toID]
-	r.mu.RUnlock()
-	if !ok {
-		return fmt.Errorf("agent %q not found", toID)
-	}
-	// Stub: log message, dispatch event later
-	slog.Info("SendMessage stubbed", "toID", toID, "msg", msg)
-	return nil
-}
-
-func (r *Registry) QueryAgents() map[string]statechart.AgentInfo {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	m := make(map[string]statechart.AgentInfo)
-	for id, aug := range r.Machines {
-		m[id] = statechart.AgentInfo{
-			ID:      id,
-			Current: aug.Current(),
-			History: aug.History(),
-		}
+		Provider:  res.Provider,
+		Model:     res.Model,
+		APIKey:    res.APIKey,
+		Endpoint:  endpoint,
+		Temp:      temp,
+		MaxTokens: tokens,
 	}
-	return m
 }
 
 func (r *Registry) Import(filename string) error {
@@ -393,6 +393,7 @@ func (r *Registry) Import(filename string) error {
 	r.mu.Lock()
 	r.items[filename] = &YAMLImport{Raw: raw, Version: ver, Active: true, Filename: filename}
 	r.mu.Unlock()
+	r.changed()
 	slog.Info("manual import raw", "file", filename, "ver", ver)
 	return nil
 }
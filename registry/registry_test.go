@@ -1,11 +1,16 @@
 package registry
 
 import (
+	"errors"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/comalice/maelstrom/config"
+	"github.com/comalice/maelstrom/registry/statechart"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -78,7 +83,7 @@ func TestList_Resolves(t *testing.T) {
 
 	r.items = map[string]*YAMLImport{
 		"test.yaml": {
-			Raw:     `llm:
+			Raw: `llm:
   model: yaml-model
   provider: yaml-provider
   api_key: yaml-key
@@ -135,10 +140,12 @@ machine:
 	r.AgentsDir = dir
 	cfg := &config.AppConfig{Variables: map[string]string{}}
 	r.SetConfig(cfg)
-	err := r.HireAgent("simple")
+	id, err := r.HireAgent("simple")
 	assert.NoError(t, err)
 	assert.Equal(t, 1, int(r.NumAgents.Load()))
 	assert.Len(t, r.Machines, 1)
+	assert.Contains(t, r.Machines, id)
+	assert.Equal(t, "simple.idle", r.QueryAgents()[id].Current)
 }
 
 func TestMaxAgents(t *testing.T) {
@@ -154,11 +161,11 @@ machine:
 	cfg := &config.AppConfig{Variables: map[string]string{}}
 	r.SetConfig(cfg)
 	for range make([]struct{}, 5) {
-		err := r.HireAgent("simple")
+		_, err := r.HireAgent("simple")
 		assert.NoError(t, err)
 	}
-	err := r.HireAgent("simple")
-	assert.Error(t, err)
+	_, err := r.HireAgent("simple")
+	assert.ErrorIs(t, err, ErrMaxAgents)
 	assert.Equal(t, 5, int(r.NumAgents.Load()))
 }
 
@@ -174,15 +181,10 @@ machine:
 	r.AgentsDir = dir
 	cfg := &config.AppConfig{Variables: map[string]string{}}
 	r.SetConfig(cfg)
-	err := r.HireAgent("simple")
+	id, err := r.HireAgent("simple")
 	assert.NoError(t, err)
 	assert.Equal(t, 1, int(r.NumAgents.Load()))
 	assert.Len(t, r.Machines, 1)
-	id := ""
-	for k := range r.Machines {
-		id = k
-		break
-	}
 	require.NotEmpty(t, id)
 	err = r.RetireAgent(id)
 	assert.NoError(t, err)
@@ -190,4 +192,413 @@ machine:
 	assert.Len(t, r.Machines, 0)
 	err = r.RetireAgent(id)
 	assert.Error(t, err)
-}
\ No newline at end of file
+}
+
+const counterAgent = `name: counter
+machine:
+  id: counter
+  initial: counting
+  states:
+    counting:
+      on:
+        add:
+          target: counting
+          action:
+            assign:
+              total: (ctx.total ?? 0) + evt.n
+        stop: {target: stopped}
+    stopped: {type: final}`
+
+func TestSendMessage_DeliversInOrderAndPersists(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "counter.yaml"), []byte(counterAgent), 0644))
+	runtimeDir := t.TempDir()
+	newRegistry := func() *Registry {
+		r := New()
+		r.AgentsDir = dir
+		r.RuntimeDir = runtimeDir
+		r.SetConfig(&config.AppConfig{Variables: map[string]string{}})
+		return r
+	}
+	r := newRegistry()
+	id, err := r.HireAgent("counter")
+	require.NoError(t, err)
+	for _, n := range []int{1, 2, 3} {
+		require.NoError(t, r.SendMessage(id, map[string]any{"event": "add", "data": map[string]any{"n": n}}))
+	}
+	require.NoError(t, r.SendMessage(id, map[string]any{"event": "unknown"}))
+	assert.Error(t, r.SendMessage("nobody", map[string]any{"event": "add"}))
+	require.Eventually(t, func() bool { return r.QueryAgents()[id].Pending == 0 }, time.Second, 5*time.Millisecond)
+	info := r.QueryAgents()[id]
+	assert.Equal(t, "counter.counting", info.Current)
+	assert.Len(t, info.History, 3, "messages without a transition are not in the history")
+	assert.Equal(t, 6, r.agents[id].rt.Ctx().Get("total"))
+
+	// Each message is logged once on arrival and once more when handled.
+	inst, err := r.agentStore().Load("counter", id)
+	require.NoError(t, err)
+	assert.Len(t, inst.Events, 8)
+	assert.JSONEq(t, `{"delivered":3,"error":"event \"unknown\" has no transition"}`, string(inst.Events[7]))
+
+	// A restarted registry resumes the agent from its mailbox.
+	r2 := newRegistry()
+	require.NoError(t, r2.RestoreAgents())
+	assert.Equal(t, 1, int(r2.NumAgents.Load()))
+	assert.EqualValues(t, 6, r2.agents[id].rt.Ctx().Get("total"))
+	restored, err := r2.Agent(id)
+	require.NoError(t, err)
+	handled := restored.Handled()
+	require.Len(t, handled, 4)
+	assert.Equal(t, "add", handled[0].Event)
+	assert.Contains(t, handled[3].Error, "has no transition")
+	require.NoError(t, r2.SendMessage(id, map[string]any{"event": "stop"}))
+	require.Eventually(t, func() bool { return r2.QueryAgents()[id].Current == "counter.stopped" }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, r2.RetireAgent(id))
+	r3 := newRegistry()
+	require.NoError(t, r3.RestoreAgents())
+	assert.Empty(t, r3.QueryAgents())
+}
+
+func TestHireAgent_RejectsTimersAndChildren(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waiter.yaml"), []byte(`name: waiter
+machine:
+  id: waiter
+  initial: waiting
+  states:
+    waiting:
+      timeout: 1m
+      entry: {send: {event: ping, delay: 5s}}
+      invoke: {machine: helper}
+      on:
+        timeout: {target: done}
+    done: {}`), 0644))
+	r := New()
+	r.AgentsDir = dir
+	r.SetConfig(&config.AppConfig{Variables: map[string]string{}})
+	_, err := r.HireAgent("waiter")
+	if assert.Error(t, err) {
+		for _, construct := range []string{"timeout", "send", "invoke"} {
+			assert.Contains(t, err.Error(), construct+" is not supported in agent templates")
+		}
+	}
+	assert.Equal(t, 0, int(r.NumAgents.Load()))
+}
+
+func TestHireAgentWith_InitialContextAndBudget(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "worker.yaml"), []byte(`name: worker
+cost_per_hour: 1.5
+machine:
+  id: worker
+  initial: idle
+  states:
+    idle: {}`), 0644))
+	r := New()
+	r.AgentsDir = dir
+	r.SetConfig(&config.AppConfig{Variables: map[string]string{}, CostPerHour: 3})
+	id, err := r.HireAgentWith("worker", map[string]any{"task": "triage"})
+	require.NoError(t, err)
+	a, err := r.Agent(id)
+	require.NoError(t, err)
+	assert.Equal(t, "triage", a.Context()["task"])
+
+	_, err = r.HireAgent("worker")
+	require.NoError(t, err)
+	_, err = r.HireAgent("worker")
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+	assert.Equal(t, 2, int(r.NumAgents.Load()))
+
+	require.NoError(t, r.RetireAgent(id))
+	_, err = r.HireAgent("worker")
+	assert.NoError(t, err, "retiring frees the agent's share of the budget")
+	assert.ErrorIs(t, r.RetireAgent("nobody"), ErrAgentNotFound)
+	_, err = r.HireAgent("../worker")
+	assert.Error(t, err)
+}
+
+const fragileAgent = `name: fragile
+machine:
+  id: fragile
+  initial: working
+  states:
+    working:
+      on:
+        add:
+          target: working
+          action:
+            assign:
+              total: ctx.total + evt.n`
+
+const bossAgent = `name: boss
+machine:
+  id: boss
+  initial: watching
+  states:
+    watching:
+      on:
+        error.agent:
+          target: watching
+          action:
+            assign:
+              failures: (ctx.failures ?? 0) + 1
+        error.agent.escalated: {target: gave_up}
+    gave_up: {}`
+
+func TestSupervision_RestartsFromSnapshotThenEscalates(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "fragile.yaml"), []byte(fragileAgent), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "boss.yaml"), []byte(bossAgent), 0644))
+	r := New()
+	r.AgentsDir = dir
+	r.RuntimeDir = t.TempDir()
+	r.SetConfig(&config.AppConfig{Variables: map[string]string{}})
+	bossID, err := r.HireAgent("boss")
+	require.NoError(t, err)
+	boss, err := r.Agent(bossID)
+	require.NoError(t, err)
+
+	id, err := r.hireAgent("fragile", map[string]any{"total": 1}, statechart.Supervisor{
+		Target:      "agent:" + bossID,
+		Supervision: statechart.Supervision{MaxRestarts: 2, Within: "1m"},
+	})
+	require.NoError(t, err)
+	a, err := r.Agent(id)
+	require.NoError(t, err)
+	handled := func(n int) func() bool {
+		return func() bool { return len(a.Handled()) == n }
+	}
+	require.NoError(t, r.SendMessage(id, map[string]any{"event": "add", "data": map[string]any{"n": 2}}))
+	require.NoError(t, r.SendMessage(id, map[string]any{"event": "add", "data": map[string]any{"n": "x"}}))
+	require.NoError(t, r.SendMessage(id, map[string]any{"event": "add", "data": map[string]any{"n": 4}}))
+	require.Eventually(t, handled(3), time.Second, 5*time.Millisecond)
+	history := a.Handled()
+	assert.Empty(t, history[0].Error)
+	assert.Contains(t, history[1].Error, "crashed")
+	assert.Equal(t, 7, a.Context()["total"], "the restarted agent resumes from before the crash")
+	require.Eventually(t, func() bool { return boss.Context()["failures"] == 1 }, time.Second, 5*time.Millisecond)
+
+	// The third failure within the window exceeds max_restarts.
+	for range 2 {
+		require.NoError(t, r.SendMessage(id, map[string]any{"event": "add", "data": map[string]any{"n": "x"}}))
+	}
+	require.Eventually(t, func() bool { _, err := r.Agent(id); return errors.Is(err, ErrAgentNotFound) }, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool { return boss.Current() == "boss.gave_up" }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, boss.Context()["failures"])
+	assert.Equal(t, 1, int(r.NumAgents.Load()))
+}
+
+func TestList_RefusesInvalidStatechart(t *testing.T) {
+	r := New()
+	r.SetConfig(&config.AppConfig{Variables: map[string]string{"TARGET": "busy"}})
+	r.items = map[string]*YAMLImport{
+		"bad.yaml": {Raw: `name: bad
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go: {target: nowhere}`, Version: "1.0", Active: true, Filename: "bad.yaml"},
+		"good.yaml": {Raw: `name: good
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go: {target: {{ .Env.TARGET }}}
+    busy: {}`, Version: "1.0", Active: true, Filename: "good.yaml"},
+	}
+	byName := map[string]*YAMLImport{}
+	for _, item := range r.List() {
+		byName[item.Filename] = item
+	}
+
+	bad := byName["bad.yaml"]
+	require.NotNil(t, bad)
+	assert.False(t, bad.Active)
+	assert.Nil(t, bad.StatechartAugmented)
+	require.Len(t, bad.Diagnostics, 1)
+	assert.Equal(t, 8, bad.Diagnostics[0].Line)
+	assert.Contains(t, bad.Diagnostics[0].Message, `unknown state "nowhere"`)
+
+	good := byName["good.yaml"]
+	require.NotNil(t, good)
+	assert.True(t, good.Active)
+	assert.NotNil(t, good.StatechartAugmented)
+	assert.Empty(t, good.Diagnostics)
+}
+
+func TestPartials_IncludedAndWatched(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, PartialsDir), 0o755))
+	tone := filepath.Join(dir, PartialsDir, "tone.tmpl")
+	require.NoError(t, os.WriteFile(tone, []byte("terse"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.yaml"), []byte(`tone: {{include "partials/tone.tmpl" .}}`), 0o644))
+
+	r := New()
+	r.SetConfig(&config.AppConfig{})
+	require.NoError(t, r.InitWatcher(dir))
+	defer r.Stop()
+	toneOf := func() any { return r.List()[0].Content["tone"] }
+	assert.Equal(t, "terse", toneOf())
+
+	require.NoError(t, os.WriteFile(tone, []byte("friendly"), 0o644))
+	require.Eventually(t, func() bool { return toneOf() == "friendly" }, 2*time.Second, 10*time.Millisecond)
+
+	for _, name := range []string{"tone.tmpl", "partials/../app.yaml", "partials/sub/x.tmpl", "../secret"} {
+		_, err := r.Partial(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestList_ComposesExtendsAndRefs(t *testing.T) {
+	r := New()
+	r.SetConfig(&config.AppConfig{})
+	r.items = map[string]*YAMLImport{
+		"base-agent.yaml": {Raw: `name: base-agent
+version: "1.0"
+description: Base agent
+cost_per_hour: 2
+migrations:
+  - from: "*"
+llm:
+  provider: openai
+  model: base-model
+guards:
+  ready: "ctx.ready == true"
+actions:
+  greet: "Say hello"
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go: {target: busy, guard: ready}
+    busy: {}`, Active: true, Filename: "base-agent.yaml"},
+		"shared.yaml": {Raw: `name: shared
+actions:
+  summarize: "Summarize the conversation"
+states:
+  done:
+    on:
+      reset: {target: idle}`, Active: true, Filename: "shared.yaml"},
+		"researcher.yaml": {Raw: `name: researcher
+extends: base-agent@1.0
+llm:
+  model: research-model
+actions:
+  summarize: {$ref: "shared#/actions/summarize"}
+machine:
+  id: root
+  initial: idle
+  states:
+    busy:
+      on:
+        finish: {target: done, action: summarize}
+    done: {$ref: "shared#/states/done"}`, Active: true, Filename: "researcher.yaml"},
+		"a.yaml": {Raw: "name: a\nextends: b\nmachine: {id: a, initial: s, states: {s: {}}}", Active: true, Filename: "a.yaml"},
+		"b.yaml": {Raw: "name: b\nextends: a\nmachine: {id: b, initial: s, states: {s: {}}}", Active: true, Filename: "b.yaml"},
+		"broken-base.yaml": {Raw: `name: broken-base
+actions:
+  x: {$ref: "shared#/actions/missing"}`, Active: true, Filename: "broken-base.yaml"},
+		"child.yaml": {Raw: "name: child\nextends: broken-base\nmachine: {id: c, initial: s, states: {s: {}}}", Active: true, Filename: "child.yaml"},
+	}
+	byName := map[string]*YAMLImport{}
+	for _, item := range r.List() {
+		byName[item.Filename] = item
+	}
+
+	res := byName["researcher.yaml"]
+	require.NotNil(t, res)
+	require.Empty(t, res.Diagnostics)
+	require.True(t, res.Active)
+	require.NotNil(t, res.StatechartAugmented)
+	spec := res.StatechartAugmented.Spec
+	assert.Equal(t, "openai", spec.LLM.Provider)
+	assert.Equal(t, "research-model", spec.LLM.Model)
+	assert.Equal(t, "ctx.ready == true", spec.Guards["ready"])
+	assert.Equal(t, "Say hello", spec.Actions["greet"])
+	assert.Equal(t, "Summarize the conversation", spec.Actions["summarize"])
+	assert.Contains(t, res.StatechartAugmented.StateIDByPath, "root.done")
+	assert.NotContains(t, res.Content, "extends")
+	// Only llm, guards, actions and machine states are inherited.
+	assert.Equal(t, "researcher", spec.Name)
+	assert.Empty(t, spec.Version)
+	assert.Empty(t, spec.Description)
+	assert.Zero(t, spec.CostPerHour)
+	assert.Empty(t, spec.Migrations)
+
+	// Composing leaves the parsed sources alone.
+	sources := map[string][]byte{}
+	for name, item := range r.items {
+		sources[name] = []byte(item.Raw)
+	}
+	c := newComposer(sources, slices.Collect(maps.Keys(sources)))
+	_, err := c.compose("researcher.yaml")
+	require.NoError(t, err)
+	parsed := mapping(c.parsed["researcher.yaml"])
+	assert.NotNil(t, value(parsed, extendsKey))
+	assert.NotNil(t, value(value(value(parsed, "actions"), "summarize"), refKey))
+
+	for _, name := range []string{"a.yaml", "b.yaml"} {
+		require.Len(t, byName[name].Diagnostics, 1, name)
+		assert.False(t, byName[name].Active)
+		assert.Contains(t, byName[name].Diagnostics[0].Message, "composition cycle")
+	}
+
+	child := byName["child.yaml"]
+	require.Len(t, child.Diagnostics, 1)
+	d := child.Diagnostics[0]
+	assert.False(t, child.Active)
+	assert.Equal(t, "broken-base.yaml", d.File)
+	assert.Equal(t, "actions.x.$ref", d.Path)
+	assert.Equal(t, 3, d.Line)
+	assert.Contains(t, d.Message, "shared.yaml has no actions.missing")
+}
+
+func TestMachine_ResolvesVersions(t *testing.T) {
+	machine := func(id string) string {
+		return "machine:\n  id: " + id + "\n  initial: idle\n  states:\n    idle: {}\n"
+	}
+	r := New()
+	r.SetConfig(&config.AppConfig{})
+	r.items = map[string]*YAMLImport{
+		"research-agent-v1.9.yaml":  {Raw: "name: research-agent\n" + machine("old"), Active: true, Filename: "research-agent-v1.9.yaml"},
+		"research-agent-v1.10.yaml": {Raw: "name: research-agent\n" + machine("new"), Active: true, Filename: "research-agent-v1.10.yaml"},
+		"chat.yaml":                 {Raw: "name: chat-agent\nversion: 1.0\n" + machine("chat"), Active: true, Filename: "chat.yaml"},
+		"gone-v2.0.yaml":            {Raw: machine("gone"), Active: false, Filename: "gone-v2.0.yaml"},
+	}
+
+	var refs []string
+	for _, m := range r.MachineVersions() {
+		refs = append(refs, m.Ref())
+	}
+	assert.Equal(t, []string{"chat@1.0", "research-agent@1.9", "research-agent@1.10"}, refs)
+
+	for ref, file := range map[string]string{
+		"research-agent":        "research-agent-v1.10.yaml",
+		"research-agent@latest": "research-agent-v1.10.yaml",
+		"research-agent@1.9":    "research-agent-v1.9.yaml",
+		"chat@1.0":              "chat.yaml",
+	} {
+		m, err := r.Machine(ref)
+		require.NoError(t, err, ref)
+		assert.Equal(t, file, m.Filename, ref)
+	}
+	for _, ref := range []string{"research-agent@2.0", "gone", "nope", "chat-agent"} {
+		_, err := r.Machine(ref)
+		assert.Error(t, err, ref)
+	}
+
+	// Lookups share one index until the registry changes.
+	a, _ := r.Machine("research-agent")
+	b, _ := r.Machine("research-agent@1.10")
+	assert.Same(t, a.Machine, b.Machine)
+	r.changed()
+	c, _ := r.Machine("research-agent")
+	assert.NotSame(t, a.Machine, c.Machine)
+}
@@ -0,0 +1,90 @@
+package statechart
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/comalice/statechartx"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// assignExpr is one compiled `assign:` entry.
+type assignExpr struct {
+	key   string
+	prog  *vm.Program // nil for a literal value
+	value any
+}
+
+// compileAssign compiles an `assign:` map of context keys to expressions.
+// String values are expr expressions over ctx and evt, like guards, and any
+// other name fails to compile: a string literal is quoted inside the YAML
+// string (`status: "'done'"`), a bare `status: done` is an error. Other YAML
+// scalars (numbers, booleans, null) are assigned as they are.
+func compileAssign(spec any) ([]assignExpr, error) {
+	fields, ok := spec.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("assign must be a map of context keys to expressions, got %T", spec)
+	}
+	var out []assignExpr
+	for _, key := range sortedKeys(fields) {
+		src, isExpr := fields[key].(string)
+		if !isExpr {
+			out = append(out, assignExpr{key: key, value: fields[key]})
+			continue
+		}
+		prog, err := compileAssignExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("assign %q: %w", key, err)
+		}
+		out = append(out, assignExpr{key: key, prog: prog})
+	}
+	return out, nil
+}
+
+// compileAssignExpr compiles one assign expression against guardEnv.
+func compileAssignExpr(src string) (*vm.Program, error) {
+	return expr.Compile(src, expr.Env(guardEnv{}))
+}
+
+// evalAssign evaluates exprs against the same ctx and evt data and returns the
+// resulting key values. Errors name the failing key.
+func evalAssign(exprs []assignExpr, ctxData map[string]any, evtData any) (map[string]any, error) {
+	env := guardEnv{Ctx: ctxData, Evt: evtData}
+	out := make(map[string]any, len(exprs))
+	for _, a := range exprs {
+		if a.prog == nil {
+			out[a.key] = a.value
+			continue
+		}
+		v, err := expr.Run(a.prog, env)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", a.key, err)
+		}
+		out[a.key] = v
+	}
+	return out, nil
+}
+
+// assignAction returns the action for an `assign:` map. Every expression sees
+// the context as it was before the action, then the results are merged at
+// once; assign actions are deterministic, so replay simply runs them again.
+func assignAction(label string, spec any) statechartx.Action {
+	exprs, err := compileAssign(spec)
+	if err != nil {
+		slog.Warn("assign compile failed", "name", label, "err", err)
+		return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+			return fmt.Errorf("action %q: %w", label, err)
+		}
+	}
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		patch, err := evalAssign(exprs, getContextData(ctx), eventData(evt))
+		if err != nil {
+			return fmt.Errorf("action %q: assign %w", label, err)
+		}
+		mergeContextData(ctx, patch)
+		slog.Info("Action assign merged patch", "name", label, "patch", patch)
+		return nil
+	}
+}
@@ -0,0 +1,215 @@
+package statechart
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+
+	"github.com/comalice/statechartx"
+)
+
+// StateTypeFinal marks a YamlState as final (`type: final`).
+const StateTypeFinal = "final"
+
+// DoneEventPrefix prefixes the event raised when a compound state reaches a final
+// child or all regions of a parallel state are final: done.state.<full path>.
+const DoneEventPrefix = "done.state."
+
+// maxDoneCascade bounds the done events raised after one event.
+const maxDoneCascade = 100
+
+// doneCond describes when a compound or parallel state is done: every region
+// (one for a compound state) must have one of its final states active.
+type doneCond struct {
+	path    string
+	depth   int
+	regions [][]statechartx.StateID
+}
+
+// collectDoneConds walks the spec and records a doneCond for every state that can complete.
+func (s *YamlMachineSpec) collectDoneConds(b *statechartx.MachineBuilder) []doneCond {
+	var conds []doneCond
+	var walk func(path string, states map[string]YamlState, parallel bool, depth int)
+	walk = func(path string, states map[string]YamlState, parallel bool, depth int) {
+		var regions [][]statechartx.StateID
+		if parallel {
+			for id, st := range states {
+				regionPath := path + "." + id
+				if st.Type == StateTypeFinal {
+					regions = append(regions, []statechartx.StateID{b.GetID(regionPath)})
+					continue
+				}
+				regions = append(regions, finalChildren(b, regionPath, st.States))
+			}
+		} else {
+			regions = append(regions, finalChildren(b, path, states))
+		}
+		complete := len(regions) > 0
+		for _, r := range regions {
+			complete = complete && len(r) > 0
+		}
+		if complete {
+			conds = append(conds, doneCond{path: path, depth: depth, regions: regions})
+		}
+		for id, st := range states {
+			if len(st.States) > 0 {
+				walk(path+"."+id, st.States, st.IsParallel, depth+1)
+			}
+		}
+	}
+	walk(s.Machine.ID, s.Machine.States, false, 0)
+	// Innermost first, as done events bubble outwards.
+	sort.Slice(conds, func(i, j int) bool {
+		if conds[i].depth != conds[j].depth {
+			return conds[i].depth > conds[j].depth
+		}
+		return conds[i].path < conds[j].path
+	})
+	return conds
+}
+
+func finalChildren(b *statechartx.MachineBuilder, path string, states map[string]YamlState) []statechartx.StateID {
+	var ids []statechartx.StateID
+	for id, st := range states {
+		if st.Type == StateTypeFinal {
+			ids = append(ids, b.GetID(path+"."+id))
+		}
+	}
+	return ids
+}
+
+func (c doneCond) holds(rt *statechartx.Runtime) bool {
+	for _, finals := range c.regions {
+		active := false
+		for _, id := range finals {
+			if rt.IsInState(id) {
+				active = true
+				break
+			}
+		}
+		if !active {
+			return false
+		}
+	}
+	return true
+}
+
+// DoneStates returns the paths of the compound and parallel states that are currently done.
+func (a *AugmentedMachine) DoneStates(rt *statechartx.Runtime) map[string]bool {
+	done := make(map[string]bool)
+	for _, c := range a.doneConds {
+		if c.holds(rt) {
+			done[c.path] = true
+		}
+	}
+	return done
+}
+
+// Completed reports whether rt has reached a final state at the machine root.
+func (a *AugmentedMachine) Completed(rt *statechartx.Runtime) bool {
+	for _, c := range a.doneConds {
+		if c.path == a.Spec.Machine.ID {
+			return c.holds(rt)
+		}
+	}
+	return false
+}
+
+// Start starts rt and raises done events for states that are done on entry.
+// Without a HistoryMemory in ctx the runtime gets a fresh one. Runtimes
+// started here should be stopped with Stop.
+func (a *AugmentedMachine) Start(ctx context.Context, rt *statechartx.Runtime) error {
+	if historyMemoryFrom(ctx) == nil {
+		ctx = WithHistoryMemory(ctx, NewHistoryMemory())
+	}
+	q := &eventQueue{}
+	a.queues.Store(rt, q)
+	if err := rt.Start(withEventQueue(ctx, q)); err != nil {
+		a.queues.Delete(rt)
+		return err
+	}
+	rt.EmbedContext()
+	a.settle(rt, map[string]bool{})
+	for _, f := range a.takeFailures(rt) {
+		slog.Warn("failure while starting", "event", f.Event, "guard", f.Guard, "action", f.Action, "error", f.Error)
+	}
+	return nil
+}
+
+// resumingKey marks the context of a runtime started by Resume.
+type resumingKey struct{}
+
+// Resume starts rt in its current state as a state the instance has already
+// entered, e.g. after a migration to another machine version: the `entry:`
+// actions of its configuration do not run again, so no LLM call or assign is
+// repeated, and no done events are raised for it. State timeouts are armed and
+// invoked children started as on entry, since they belong to the state rather
+// than to the visit.
+func (a *AugmentedMachine) Resume(ctx context.Context, rt *statechartx.Runtime) error {
+	if historyMemoryFrom(ctx) == nil {
+		ctx = WithHistoryMemory(ctx, NewHistoryMemory())
+	}
+	resuming := new(atomic.Bool)
+	resuming.Store(true)
+	q := &eventQueue{}
+	a.queues.Store(rt, q)
+	if err := rt.Start(withEventQueue(context.WithValue(ctx, resumingKey{}, resuming), q)); err != nil {
+		a.queues.Delete(rt)
+		return err
+	}
+	resuming.Store(false)
+	rt.EmbedContext()
+	return nil
+}
+
+// entryAction wraps a state's `entry:` actions so Resume can skip them; nil
+// stays nil.
+func entryAction(act statechartx.Action) statechartx.Action {
+	if act == nil {
+		return nil
+	}
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if r, _ := ctx.Value(resumingKey{}).(*atomic.Bool); r != nil && r.Load() {
+			return nil
+		}
+		return act(ctx, evt, from, to)
+	}
+}
+
+// Step processes evt and then, synchronously, the done.state.* events of the
+// states it completed, innermost first, and the events its actions raised,
+// until no further state completes and no raised event is left. It returns
+// the guards, actions and tool calls that failed on the way.
+func (a *AugmentedMachine) Step(rt *statechartx.Runtime, evt statechartx.Event) []Failure {
+	before := a.DoneStates(rt)
+	rt.ProcessEvent(evt)
+	a.settle(rt, before)
+	return a.takeFailures(rt)
+}
+
+func (a *AugmentedMachine) raiseDone(rt *statechartx.Runtime, seen map[string]bool) {
+	for i := 0; i < maxDoneCascade; i++ {
+		done := a.DoneStates(rt)
+		var next string
+		for _, c := range a.doneConds {
+			if done[c.path] && !seen[c.path] {
+				next = c.path
+				break
+			}
+		}
+		if next == "" {
+			return
+		}
+		// A state that stops being done may complete again later in the cascade.
+		for path := range seen {
+			if !done[path] {
+				delete(seen, path)
+			}
+		}
+		seen[next] = true
+		if eid, ok := a.EventIDByName[DoneEventPrefix+next]; ok {
+			rt.ProcessEvent(statechartx.Event{ID: eid, Data: map[string]any{"state": next}})
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package statechart
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// Error events raised when a guard or an action fails; evt.Data is the Failure.
+const (
+	ErrorExecutionEvent = "error.execution" // guards, assign, system actions
+	ErrorLLMEvent       = "error.llm"       // LLM calls and unusable LLM answers
+	ErrorToolEvent      = "error.tool"      // tool calls made by llm_with_tools
+)
+
+// Guard failure policies (`failure_policy:`): a guard that cannot be evaluated
+// passes (fail_open, the default) or blocks its transition (fail_closed).
+const (
+	FailOpen   = "fail_open"
+	FailClosed = "fail_closed"
+)
+
+// Failure is a guard, action or tool call that failed while an event was processed.
+type Failure struct {
+	Event  string `json:"event"` // the error event raised for it
+	Guard  string `json:"guard,omitempty"`
+	Action string `json:"action,omitempty"`
+	Tool   string `json:"tool,omitempty"`
+	Error  string `json:"error"`
+}
+
+// data is the payload of the error event raised for f.
+func (f Failure) data() map[string]any {
+	d := map[string]any{"error": f.Error}
+	if f.Guard != "" {
+		d["guard"] = f.Guard
+	}
+	if f.Action != "" {
+		d["action"] = f.Action
+	}
+	if f.Tool != "" {
+		d["tool"] = f.Tool
+	}
+	return d
+}
+
+// failureError is an action error that raises a more specific error event
+// than error.execution, with the tool calls made before it failed.
+type failureError struct {
+	event string
+	err   error
+	tools []ToolRecord
+}
+
+func (e *failureError) Error() string { return e.err.Error() }
+func (e *failureError) Unwrap() error { return e.err }
+
+func llmFailure(err error, toolRecs []ToolRecord) error {
+	return &failureError{event: ErrorLLMEvent, err: err, tools: toolRecs}
+}
+
+// errorEvent returns the error event an action error raises.
+func errorEvent(err error) string {
+	var fe *failureError
+	if errors.As(err, &fe) && fe.event != "" {
+		return fe.event
+	}
+	return ErrorExecutionEvent
+}
+
+func failureTools(err error) []ToolRecord {
+	var fe *failureError
+	if errors.As(err, &fe) {
+		return fe.tools
+	}
+	return nil
+}
+
+// fail reports f for the event being processed and, if raiseEvent is set,
+// raises its error event after the event.
+func fail(ctx context.Context, f Failure, raiseEvent bool) {
+	q := eventQueueFrom(ctx)
+	if q == nil {
+		slog.Warn("failure outside a started machine", "event", f.Event, "error", f.Error)
+		return
+	}
+	q.fail(f)
+	if raiseEvent {
+		q.push(raisedEvent{name: f.Event, data: f.data()})
+	}
+}
+
+// toolFailures reports the failed tool calls of action.
+func toolFailures(ctx context.Context, action string, toolRecs []ToolRecord) {
+	for _, t := range toolRecs {
+		if t.Error != "" {
+			fail(ctx, Failure{Event: ErrorToolEvent, Action: action, Tool: t.Name, Error: t.Error}, true)
+		}
+	}
+}
+
+// guardFailed reports a guard that could not be evaluated and returns its
+// result under the spec's failure policy.
+func (s *YamlMachineSpec) guardFailed(ctx context.Context, guard string, err error) bool {
+	pass := s.FailurePolicy != FailClosed
+	slog.Warn("Guard failed", "guard", guard, "err", err, "pass", pass)
+	fail(ctx, Failure{Event: ErrorExecutionEvent, Guard: guard, Error: err.Error()}, true)
+	return pass
+}
@@ -0,0 +1,203 @@
+package statechart
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/comalice/statechartx"
+)
+
+// History pseudo-state kinds (`history: shallow|deep`).
+const (
+	HistoryShallow = "shallow"
+	HistoryDeep    = "deep"
+)
+
+// HistoryMemory holds the remembered configuration of one running instance:
+// history state path -> the state a transition to it resumes (the direct child
+// of its parent for shallow history, the innermost state for deep history).
+// One HistoryMemory belongs to one runtime; it travels in the Runtime.Start context.
+type HistoryMemory struct {
+	mu   sync.Mutex
+	last map[string]string
+}
+
+// NewHistoryMemory returns an empty HistoryMemory.
+func NewHistoryMemory() *HistoryMemory {
+	return &HistoryMemory{last: make(map[string]string)}
+}
+
+type historyMemoryKey struct{}
+
+// WithHistoryMemory returns a context whose history states remember into (and resume from) h.
+func WithHistoryMemory(ctx context.Context, h *HistoryMemory) context.Context {
+	return context.WithValue(ctx, historyMemoryKey{}, h)
+}
+
+func historyMemoryFrom(ctx context.Context) *HistoryMemory {
+	if ctx == nil {
+		return nil
+	}
+	h, _ := ctx.Value(historyMemoryKey{}).(*HistoryMemory)
+	return h
+}
+
+// Snapshot returns a copy of the remembered configuration, or nil if nothing is remembered.
+func (h *HistoryMemory) Snapshot() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.last) == 0 {
+		return nil
+	}
+	return maps.Clone(h.last)
+}
+
+// Restore replaces the remembered configuration with a persisted snapshot.
+func (h *HistoryMemory) Restore(snapshot map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = make(map[string]string, len(snapshot))
+	maps.Copy(h.last, snapshot)
+}
+
+func (h *HistoryMemory) remember(history, state string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last[history] = state
+}
+
+func (h *HistoryMemory) recall(history string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last[history]
+}
+
+// historyWatch asks the states below a history state's parent to remember
+// themselves on exit.
+type historyWatch struct {
+	history string
+	deep    bool
+}
+
+// childHistoryWatches returns the watches that apply to the children of the
+// compound state at path: its own history children plus the deep watches of
+// its ancestors.
+func childHistoryWatches(path string, parent YamlState, inherited []historyWatch) []historyWatch {
+	watches := append([]historyWatch(nil), inherited...)
+	for _, id := range parent.childIDs() {
+		if st := parent.States[id]; st.History != "" {
+			watches = append(watches, historyWatch{history: path + "." + id, deep: st.History == HistoryDeep})
+		}
+	}
+	return watches
+}
+
+// deepWatches keeps the watches that reach below a child; parallel states are
+// remembered as a whole, so nothing passes into their regions.
+func deepWatches(watches []historyWatch, st YamlState) []historyWatch {
+	if st.IsParallel {
+		return nil
+	}
+	var deep []historyWatch
+	for _, w := range watches {
+		if w.deep {
+			deep = append(deep, w)
+		}
+	}
+	return deep
+}
+
+// historyExitActions returns the exit actions of the state at path that record
+// it for the watches of its parent.
+func historyExitActions(path string, st YamlState, watches []historyWatch) []statechartx.Action {
+	var actions []statechartx.Action
+	for _, w := range watches {
+		if w.deep && len(st.States) > 0 && !st.IsParallel {
+			// Deep history remembers the innermost state, recorded by a descendant.
+			continue
+		}
+		history := w.history
+		actions = append(actions, func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+			if h := historyMemoryFrom(ctx); h != nil {
+				h.remember(history, path)
+			}
+			return nil
+		})
+	}
+	return actions
+}
+
+// validateHistoryState rejects history pseudo-states that carry behaviour of their own.
+func validateHistoryState(path string, st YamlState) error {
+	if st.History != HistoryShallow && st.History != HistoryDeep {
+		return fmt.Errorf("state %q: unknown history %q (want %q or %q)", path, st.History, HistoryShallow, HistoryDeep)
+	}
+	if st.Type != "" || st.IsParallel || len(st.States) > 0 || len(st.On) > 0 ||
+		st.Entry != nil || st.Exit != nil || st.Timeout != "" {
+		return fmt.Errorf("history state %q cannot have a type, child states, transitions, actions or a timeout", path)
+	}
+	return nil
+}
+
+// wireHistoryStates gives every history pseudo-state its eventless
+// transitions: one per state it can resume, guarded on the instance's
+// HistoryMemory, and a fallback to the parent's initial state. Eventless
+// transitions do not descend into compound targets, so they point at the
+// target's innermost initial state.
+func (s *YamlMachineSpec) wireHistoryStates(m *statechartx.Machine, b *statechartx.MachineBuilder) {
+	var walk func(path string, parent YamlState)
+	walk = func(path string, parent YamlState) {
+		for _, id := range parent.childIDs() {
+			st := parent.States[id]
+			if st.History == "" {
+				if len(st.States) > 0 {
+					walk(path+"."+id, st)
+				}
+				continue
+			}
+			historyPath := path + "." + id
+			hs := m.GetState(b.GetID(historyPath))
+			for _, target := range historyTargets(path, parent, st.History == HistoryDeep) {
+				hs.Transitions = append(hs.Transitions, &statechartx.Transition{
+					Event:  statechartx.NO_EVENT,
+					Source: hs,
+					Target: m.FindDeepestInitial(b.GetID(target)),
+					Guard:  rememberedGuard(historyPath, target),
+				})
+			}
+			hs.Transitions = append(hs.Transitions, &statechartx.Transition{
+				Event:  statechartx.NO_EVENT,
+				Source: hs,
+				Target: m.FindDeepestInitial(m.GetState(b.GetID(path)).Initial),
+			})
+		}
+	}
+	walk(s.Machine.ID, s.Machine.root())
+}
+
+// historyTargets lists the states a history child of parent (at prefix) can resume.
+func historyTargets(prefix string, parent YamlState, deep bool) []string {
+	var targets []string
+	for _, id := range parent.childIDs() {
+		st := parent.States[id]
+		if st.History != "" {
+			continue
+		}
+		path := prefix + "." + id
+		if deep && len(st.States) > 0 && !st.IsParallel {
+			targets = append(targets, historyTargets(path, st, true)...)
+			continue
+		}
+		targets = append(targets, path)
+	}
+	return targets
+}
+
+func rememberedGuard(history, target string) statechartx.Guard {
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) (bool, error) {
+		h := historyMemoryFrom(ctx)
+		return h != nil && h.recall(history) == target, nil
+	}
+}
@@ -0,0 +1,34 @@
+package statechart
+
+import "context"
+
+// InstanceRef identifies the instance or hired agent an action runs in.
+type InstanceRef struct {
+	Machine string // machine ID, or the template of an agent
+	ID      string // instance or agent ID
+	Agent   bool
+}
+
+// Target addresses the instance like send targets do: "mid/iid" or "agent:<id>".
+func (r InstanceRef) Target() string {
+	if r.Agent {
+		return "agent:" + r.ID
+	}
+	return r.Machine + "/" + r.ID
+}
+
+type instanceKey struct{}
+
+// WithInstance returns a context whose actions run on behalf of ref: prompts
+// see its IDs and hire_agent hires agents it supervises.
+func WithInstance(ctx context.Context, ref InstanceRef) context.Context {
+	return context.WithValue(ctx, instanceKey{}, ref)
+}
+
+func instanceFrom(ctx context.Context) (InstanceRef, bool) {
+	if ctx == nil {
+		return InstanceRef{}, false
+	}
+	ref, ok := ctx.Value(instanceKey{}).(InstanceRef)
+	return ref, ok
+}
@@ -0,0 +1,103 @@
+package statechart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/comalice/statechartx"
+)
+
+// DoneInvokeEventPrefix prefixes the event delivered to an instance when a
+// child it invoked completes: done.invoke.<invoke id>, with the child's
+// final context as data.
+const DoneInvokeEventPrefix = "done.invoke."
+
+// YamlInvoke starts a child instance of another registered machine when its
+// state is entered and cancels it when the state is exited.
+type YamlInvoke struct {
+	ID      string         `yaml:"id,omitempty"`   // defaults to the state's full path
+	Machine string         `yaml:"machine"`        // registered machine to start
+	Data    map[string]any `yaml:"data,omitempty"` // child initial context: key -> expr over ctx/evt, like assign
+}
+
+// invokeID returns the ID the invoke of the state at path runs under.
+func (inv YamlInvoke) invokeID(path string) string {
+	if inv.ID != "" {
+		return inv.ID
+	}
+	return path
+}
+
+// Invoker starts and cancels the child instances of one running instance.
+// The owning instance carries it in the context passed to Runtime.Start.
+type Invoker interface {
+	// Invoke starts a child instance of machine with data as its initial
+	// context. When the child completes, the instance receives
+	// done.invoke.<id>. Invoking an ID again replaces the previous child.
+	Invoke(id, machine string, data map[string]any) error
+	// CancelInvoke stops and removes the child started under id, if any.
+	CancelInvoke(id string)
+}
+
+type invokerKey struct{}
+
+// WithInvoker returns a context whose state entry/exit actions start and cancel children on inv.
+func WithInvoker(ctx context.Context, inv Invoker) context.Context {
+	return context.WithValue(ctx, invokerKey{}, inv)
+}
+
+func invokerFrom(ctx context.Context) Invoker {
+	if ctx == nil {
+		return nil
+	}
+	inv, _ := ctx.Value(invokerKey{}).(Invoker)
+	return inv
+}
+
+// invokeEntryAction starts the child on entry, after the state's entry
+// actions. A child that cannot be started raises error.execution.
+func invokeEntryAction(id string, inv YamlInvoke) statechartx.Action {
+	label := "invoke:" + id
+	exprs, compileErr := compileAssign(inv.Data)
+	if compileErr == nil && inv.Machine == "" {
+		compileErr = errors.New("no machine")
+	}
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		invoker := invokerFrom(ctx)
+		if invoker == nil {
+			slog.Warn("invoke outside an instance, child not started", "invoke", id, "machine", inv.Machine)
+			return nil
+		}
+		err := compileErr
+		if err == nil {
+			err = startChild(ctx, invoker, id, inv.Machine, exprs, evt)
+		}
+		if err != nil {
+			slog.Error("invoke failed", "invoke", id, "machine", inv.Machine, "err", err)
+			fail(ctx, Failure{Event: ErrorExecutionEvent, Action: label, Error: err.Error()}, true)
+			return fmt.Errorf("action %q: %w", label, err)
+		}
+		slog.Info("invoked child", "invoke", id, "machine", inv.Machine)
+		return nil
+	}
+}
+
+func startChild(ctx context.Context, invoker Invoker, id, machine string, exprs []assignExpr, evt *statechartx.Event) error {
+	data, err := evalAssign(exprs, getContextData(ctx), eventData(evt))
+	if err != nil {
+		return fmt.Errorf("data %w", err)
+	}
+	return invoker.Invoke(id, machine, data)
+}
+
+// invokeExitAction cancels the child on exit, after the state's exit actions.
+func invokeExitAction(id string) statechartx.Action {
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if invoker := invokerFrom(ctx); invoker != nil {
+			invoker.CancelInvoke(id)
+		}
+		return nil
+	}
+}
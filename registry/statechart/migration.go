@@ -0,0 +1,139 @@
+package statechart
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// AnyVersion as a migration's `from:` migrates instances of any older version.
+const AnyVersion = "*"
+
+// Migration moves running instances of an older version of a machine onto
+// the spec that declares it (`migrations:`).
+type Migration struct {
+	From string `yaml:"from" json:"from"` // version migrated from, or "*"
+	// States maps old state paths to new ones. A mapped compound state carries
+	// its descendants along when the new state has children of the same name.
+	// States whose path exists in both versions need no entry.
+	States map[string]string `yaml:"states,omitempty" json:"states,omitempty"`
+	// Context sets context keys like `assign:`; expressions see the old
+	// context as ctx.
+	Context map[string]any `yaml:"context,omitempty" json:"context,omitempty"`
+	Drop    []string       `yaml:"drop,omitempty" json:"drop,omitempty"` // context keys removed
+}
+
+// MigrationFrom returns the migration of s for instances of version, the
+// first with that exact `from:` or else the first for any version; nil if
+// there is none.
+func (s *YamlMachineSpec) MigrationFrom(version string) *Migration {
+	var fallback *Migration
+	for i := range s.Migrations {
+		m := &s.Migrations[i]
+		if m.From == version {
+			return m
+		}
+		if m.From == AnyVersion && fallback == nil {
+			fallback = m
+		}
+	}
+	return fallback
+}
+
+// MigrationPlan is what migrating one instance does. Unmapped lists every
+// state of the old machine with no counterpart in the new one, so a dry run
+// shows what a migration still misses; only the instance's own state has to
+// be mapped for it to migrate. Remembered is the instance's history memory
+// mapped onto the new machine; Forgotten lists the history states whose
+// memory does not map, which resume their initial state instead.
+type MigrationPlan struct {
+	FromState  string            `json:"fromState"`
+	ToState    string            `json:"toState,omitempty"`
+	Unmapped   []string          `json:"unmapped,omitempty"`
+	Context    map[string]any    `json:"context"`
+	Remembered map[string]string `json:"remembered,omitempty"`
+	Forgotten  []string          `json:"forgotten,omitempty"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// Ready reports whether the instance can be migrated as planned.
+func (p MigrationPlan) Ready() bool {
+	return p.ToState != "" && len(p.Errors) == 0
+}
+
+// PlanMigration maps an instance of old in state fromState with context ctx
+// and history memory remembered onto a, using m (which may be nil for a
+// migration of unchanged paths).
+func (a *AugmentedMachine) PlanMigration(old *AugmentedMachine, m *Migration, fromState string, ctx map[string]any, remembered map[string]string) MigrationPlan {
+	if m == nil {
+		m = &Migration{}
+	}
+	plan := MigrationPlan{FromState: fromState, Context: maps.Clone(ctx)}
+	if plan.Context == nil {
+		plan.Context = map[string]any{}
+	}
+	for _, path := range slices.Sorted(maps.Keys(old.StateIDByPath)) {
+		if _, ok := a.migrateState(m, path); !ok {
+			plan.Unmapped = append(plan.Unmapped, path)
+		}
+	}
+	if to, ok := a.migrateState(m, fromState); ok {
+		plan.ToState = to
+	} else {
+		plan.Errors = append(plan.Errors, fmt.Sprintf("state %q is not mapped", fromState))
+	}
+
+	for _, history := range slices.Sorted(maps.Keys(remembered)) {
+		to, ok := a.migrateState(m, history)
+		target, targetOK := a.migrateState(m, remembered[history])
+		// The remembered state must still be a descendant of the history state's parent.
+		if !ok || !targetOK || !strings.HasPrefix(target, parentPath(to)+".") {
+			plan.Forgotten = append(plan.Forgotten, history)
+			continue
+		}
+		if plan.Remembered == nil {
+			plan.Remembered = map[string]string{}
+		}
+		plan.Remembered[to] = target
+	}
+
+	exprs, err := compileAssign(m.Context)
+	if err != nil {
+		plan.Errors = append(plan.Errors, fmt.Sprintf("context: %v", err))
+		return plan
+	}
+	patch, err := evalAssign(exprs, ctx, nil)
+	if err != nil {
+		plan.Errors = append(plan.Errors, fmt.Sprintf("context %v", err))
+		return plan
+	}
+	maps.Copy(plan.Context, patch)
+	for _, key := range m.Drop {
+		delete(plan.Context, key)
+	}
+	return plan
+}
+
+// migrateState returns the path of a that the old state path maps to: its
+// own mapping, else the mapping of its closest mapped ancestor with the rest
+// of the path appended (or the mapped ancestor itself if a lacks that
+// descendant), else the same path if a has it.
+func (a *AugmentedMachine) migrateState(m *Migration, path string) (string, bool) {
+	for prefix, rest := path, ""; prefix != ""; {
+		if to, ok := m.States[prefix]; ok {
+			if _, exists := a.StateIDByPath[to+rest]; exists {
+				return to + rest, true
+			}
+			_, exists := a.StateIDByPath[to]
+			return to, exists
+		}
+		i := strings.LastIndex(prefix, ".")
+		if i < 0 {
+			break
+		}
+		prefix, rest = prefix[:i], prefix[i:]+rest
+	}
+	_, ok := a.StateIDByPath[path]
+	return path, ok
+}
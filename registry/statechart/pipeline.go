@@ -0,0 +1,153 @@
+package statechart
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/comalice/statechartx"
+)
+
+// On-error policies of an action list step (`on_error:`). The default is abort.
+const (
+	OnErrorAbort    = "abort"
+	OnErrorContinue = "continue"
+	OnErrorGoto     = "goto"
+)
+
+// parseOnError splits an on_error value into its policy and, for
+// `goto <state>`, the target state as written.
+func parseOnError(v string) (policy, target string, err error) {
+	switch v {
+	case "":
+		return OnErrorAbort, "", nil
+	case OnErrorAbort, OnErrorContinue:
+		return v, "", nil
+	}
+	if t, ok := strings.CutPrefix(v, OnErrorGoto+" "); ok && strings.TrimSpace(t) != "" {
+		return OnErrorGoto, strings.TrimSpace(t), nil
+	}
+	return "", "", fmt.Errorf("unknown on_error %q (want %q, %q or \"%s <state>\")", v, OnErrorContinue, OnErrorAbort, OnErrorGoto)
+}
+
+// actionScope is the state an action list belongs to, which goto targets are
+// resolved against like transition targets, and the goto targets seen so far.
+type actionScope struct {
+	prefix string
+	path   string
+	gotos  map[string]struct{}
+}
+
+// parseStep splits one step of an action list into the action spec to
+// resolve, the label its outputs are recorded under and its on_error value.
+// A step is a named, system or inline action, an inline map (assign, raise,
+// send, cancel, llm_with_tools) or {action: name} to give a named action an on_error.
+func parseStep(spec any) (content any, label, onError string) {
+	m, ok := spec.(map[string]any)
+	if !ok {
+		name, _ := spec.(string)
+		return spec, name, ""
+	}
+	onError, _ = m["on_error"].(string)
+	if name, ok := m["action"].(string); ok {
+		return name, name, onError
+	}
+	return m, actionKind(m), onError
+}
+
+// actionKind labels an inline action map the way its outputs are recorded.
+func actionKind(m map[string]any) string {
+	switch {
+	case m["assign"] != nil:
+		return "assign"
+	case m["raise"] != nil:
+		return "raise"
+	case m["send"] != nil:
+		return "send"
+	case m["cancel"] != nil:
+		return "cancel"
+	case m["llm_with_tools"] != nil, m["type"] == "llm":
+		return "llm_with_tools"
+	}
+	return "action"
+}
+
+// deterministic reports whether an action only depends on the context and
+// the event, so replay can run it again instead of using recorded outputs.
+func (s *YamlMachineSpec) deterministic(content any) bool {
+	if name, ok := content.(string); ok {
+		content = s.Actions[name]
+	}
+	m, ok := content.(map[string]any)
+	if !ok {
+		return false
+	}
+	switch actionKind(m) {
+	case "assign", "raise", "send", "cancel":
+		return true
+	}
+	return false
+}
+
+// resolveActionList resolves an action spec, one action or a list of steps,
+// into a single action running the steps in order; later steps see the
+// context patched by earlier ones.
+func (s *YamlMachineSpec) resolveActionList(hirer AgentHirer, spec any, scope actionScope) statechartx.Action {
+	var steps []statechartx.Action
+	for _, a := range actionList(spec) {
+		steps = append(steps, s.resolveStep(hirer, a, scope))
+	}
+	return sequenceActions(steps)
+}
+
+// resolveStep resolves one step and applies its on_error policy: abort stops
+// the rest of the list, continue goes on with the next step and goto stops
+// the list and then moves the machine to the given state, with the failure in
+// evt.Data. Abort and continue raise the failure's error event instead.
+// Failures are recorded, so replay fails the same step again.
+func (s *YamlMachineSpec) resolveStep(hirer AgentHirer, spec any, scope actionScope) statechartx.Action {
+	content, label, onError := parseStep(spec)
+	act := s.resolveAction(hirer, content)
+	if act == nil {
+		return nil
+	}
+	policy, target, err := parseOnError(onError)
+	if err != nil {
+		slog.Warn("on_error ignored", "action", label, "err", err)
+		policy = OnErrorAbort
+	}
+	if policy == OnErrorGoto {
+		target = s.resolveTarget(scope.prefix, scope.path, target)
+		scope.gotos[target] = struct{}{}
+	}
+	recorded := !s.deterministic(content)
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		var err error
+		if recorded {
+			err = replayFailure(ctx, label)
+		}
+		if err == nil {
+			if err = act(ctx, evt, from, to); err == nil {
+				return nil
+			}
+			if recorded {
+				recordAction(ctx, ActionRecord{Action: label, Error: err.Error(), ErrorEvent: errorEvent(err), Tools: failureTools(err)})
+			}
+		}
+		f := Failure{Event: errorEvent(err), Action: label, Error: err.Error()}
+		// A goto step handles its failure itself; otherwise the error event is raised.
+		fail(ctx, f, policy != OnErrorGoto)
+		switch policy {
+		case OnErrorContinue:
+			slog.Warn("action failed, continuing", "action", label, "err", err)
+			return nil
+		case OnErrorGoto:
+			slog.Warn("action failed, going to error state", "action", label, "target", target, "err", err)
+			raise(ctx, raisedEvent{gotoPath: target, data: f.data()})
+		default:
+			slog.Error("action failed, aborting action list", "action", label, "err", err)
+		}
+		return fmt.Errorf("action %q: %w", label, err)
+	}
+}
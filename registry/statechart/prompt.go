@@ -0,0 +1,92 @@
+package statechart
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"text/template"
+
+	"github.com/comalice/maelstrom/config"
+	regyaml "github.com/comalice/maelstrom/registry/yaml"
+	"github.com/comalice/statechartx"
+)
+
+// PromptData is what action prompts (`system:`, `prompt:` and inline prompt
+// actions) are rendered with, each time the action runs. Load-time rendering
+// leaves the templates that use these fields alone (see yaml.RuntimeFields).
+type PromptData struct {
+	Context  map[string]any // the live context
+	Event    PromptEvent    // the event being processed
+	From     string         // source state path
+	To       string         // target state path
+	Machine  string         // machine ID, or the template of an agent
+	Instance string         // instance or agent ID
+	App      *config.AppConfig
+	Env      map[string]string
+}
+
+// PromptEvent is the event a prompt is rendered for.
+type PromptEvent struct {
+	Name string
+	Data any
+}
+
+// promptTemplate is a prompt parsed once and rendered per invocation.
+type promptTemplate struct {
+	text string
+	tmpl *template.Template // nil if text has no template actions
+	err  error              // parse error, reported when the action runs
+}
+
+// newPromptTemplate parses a prompt with the registry template functions;
+// include reads s.Partials when the prompt is rendered.
+func (s *YamlMachineSpec) newPromptTemplate(name, text string) promptTemplate {
+	p := promptTemplate{text: text}
+	if strings.Contains(text, "{{") {
+		p.tmpl, p.err = template.New(name).Funcs(regyaml.FuncMap(s.partial)).Parse(text)
+	}
+	return p
+}
+
+func (s *YamlMachineSpec) partial(name string) (string, error) {
+	if s.Partials == nil {
+		return "", errors.New("no partials")
+	}
+	return s.Partials(name)
+}
+
+func (p promptTemplate) render(data PromptData) (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	if p.tmpl == nil {
+		return p.text, nil
+	}
+	var b strings.Builder
+	if err := p.tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// promptData returns what the prompts of an action see when it runs for evt.
+func (s *YamlMachineSpec) promptData(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) PromptData {
+	d := PromptData{
+		Context: getContextData(ctx),
+		Event:   PromptEvent{Data: eventData(evt)},
+		From:    s.statePaths[from],
+		To:      s.statePaths[to],
+		Machine: s.Machine.ID,
+		App:     s.App,
+	}
+	if evt != nil {
+		d.Event.Name = s.eventNames[evt.ID]
+	}
+	if s.App != nil {
+		d.Env = s.App.Variables
+	}
+	if inst, ok := instanceFrom(ctx); ok {
+		d.Machine, d.Instance = inst.Machine, inst.ID
+	}
+	return d
+}
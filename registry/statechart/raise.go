@@ -0,0 +1,169 @@
+package statechart
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/comalice/statechartx"
+)
+
+// maxRaisedEvents bounds the internal events processed after one event.
+const maxRaisedEvents = 100
+
+// gotoEventPrefix names the internal events behind `on_error: goto <state>`.
+// They are not in EventIDByName, so they cannot be sent from outside.
+const gotoEventPrefix = "goto:"
+
+// raisedEvent is an internal event queued by an action: a `raise` step, or
+// the jump of a failed step with `on_error: goto <state>` (gotoPath set).
+type raisedEvent struct {
+	name     string
+	gotoPath string
+	data     any
+}
+
+// eventQueue holds the internal events of one runtime until AugmentedMachine
+// processes them, after the event that raised them.
+// It also collects the failures reported while processing an event.
+type eventQueue struct {
+	mu       sync.Mutex
+	events   []raisedEvent
+	failures []Failure
+}
+
+type eventQueueKey struct{}
+
+func withEventQueue(ctx context.Context, q *eventQueue) context.Context {
+	return context.WithValue(ctx, eventQueueKey{}, q)
+}
+
+func eventQueueFrom(ctx context.Context) *eventQueue {
+	if ctx == nil {
+		return nil
+	}
+	q, _ := ctx.Value(eventQueueKey{}).(*eventQueue)
+	return q
+}
+
+func (q *eventQueue) push(e raisedEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.events = append(q.events, e)
+}
+
+func (q *eventQueue) pop() (raisedEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events) == 0 {
+		return raisedEvent{}, false
+	}
+	e := q.events[0]
+	q.events = q.events[1:]
+	return e, true
+}
+
+func (q *eventQueue) fail(f Failure) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failures = append(q.failures, f)
+}
+
+func (q *eventQueue) takeFailures() []Failure {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := q.failures
+	q.failures = nil
+	return out
+}
+
+func (q *eventQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.events = nil
+}
+
+// raise queues e on the context's event queue, if any.
+func raise(ctx context.Context, e raisedEvent) {
+	q := eventQueueFrom(ctx)
+	if q == nil {
+		slog.Warn("raise outside a started machine, event dropped", "event", e.name, "goto", e.gotoPath)
+		return
+	}
+	q.push(e)
+}
+
+// raiseAction returns the action of a `raise:` step, either an event name or
+// {event: name, data: {...}}. The event is processed once the current one is
+// done, before the next external event.
+func raiseAction(spec any) statechartx.Action {
+	name, data := raiseSpec(spec)
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if name == "" {
+			return errors.New("raise: no event name")
+		}
+		raise(ctx, raisedEvent{name: name, data: data})
+		return nil
+	}
+}
+
+func raiseSpec(spec any) (string, any) {
+	switch v := spec.(type) {
+	case string:
+		return v, nil
+	case map[string]any:
+		name, _ := v["event"].(string)
+		return name, v["data"]
+	}
+	return "", nil
+}
+
+// takeFailures returns the failures reported by rt since the last call.
+func (a *AugmentedMachine) takeFailures(rt *statechartx.Runtime) []Failure {
+	if v, ok := a.queues.Load(rt); ok {
+		return v.(*eventQueue).takeFailures()
+	}
+	return nil
+}
+
+// Stop stops rt and forgets its event queue.
+func (a *AugmentedMachine) Stop(rt *statechartx.Runtime) error {
+	a.queues.Delete(rt)
+	return rt.Stop()
+}
+
+// settle processes what an event left behind: the done.state.* events of the
+// states it completed and the events raised by its actions, until neither is left.
+func (a *AugmentedMachine) settle(rt *statechartx.Runtime, seen map[string]bool) {
+	v, _ := a.queues.Load(rt)
+	q, _ := v.(*eventQueue)
+	for i := 0; i < maxRaisedEvents; i++ {
+		a.raiseDone(rt, seen)
+		if q == nil {
+			return
+		}
+		e, ok := q.pop()
+		if !ok {
+			return
+		}
+		a.processRaised(rt, e)
+	}
+	q.clear()
+	slog.Warn("too many raised events, dropped the rest", "limit", maxRaisedEvents)
+}
+
+func (a *AugmentedMachine) processRaised(rt *statechartx.Runtime, e raisedEvent) {
+	id, ok := a.EventIDByName[e.name]
+	if e.gotoPath != "" {
+		id, ok = a.gotoEventIDs[e.gotoPath]
+	}
+	if !ok {
+		if !strings.HasPrefix(e.name, "error.") {
+			slog.Warn("raised event has no transition, dropped", "event", e.name, "goto", e.gotoPath)
+		}
+		return
+	}
+	rt.ProcessEvent(statechartx.Event{ID: id, Data: e.data})
+}
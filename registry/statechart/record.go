@@ -0,0 +1,175 @@
+package statechart
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// ToolRecord captures one tool invocation made by an action.
+type ToolRecord struct {
+	Name   string         `json:"name"`
+	Params map[string]any `json:"params,omitempty"`
+	Result any            `json:"result,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// ActionRecord captures the output of one non-deterministic action (LLM call,
+// tool loop, system action) so that replay can apply it instead of re-running it.
+// Error and ErrorEvent are set when the action failed; replay then fails the same way.
+type ActionRecord struct {
+	Action     string         `json:"action"`
+	Patch      map[string]any `json:"patch,omitempty"`
+	Tools      []ToolRecord   `json:"tools,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	ErrorEvent string         `json:"error_event,omitempty"`
+}
+
+// Recorder collects ActionRecords for the event being processed and, while
+// replaying, hands previously recorded outputs back to the actions.
+// One Recorder belongs to one runtime; it travels in the Runtime.Start context.
+type Recorder struct {
+	mu        sync.Mutex
+	replaying bool
+	pending   []ActionRecord
+	recorded  []ActionRecord
+}
+
+// NewRecorder returns a Recorder in live mode.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+type recorderKey struct{}
+
+// WithRecorder returns a context whose actions record into (and replay from) r.
+func WithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+func recorderFrom(ctx context.Context) *Recorder {
+	if ctx == nil {
+		return nil
+	}
+	r, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return r
+}
+
+// Live switches to live mode: actions execute and their outputs are recorded.
+func (r *Recorder) Live() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replaying = false
+	r.pending = nil
+	r.recorded = nil
+}
+
+// Replay switches to replay mode for one event: actions consume records
+// in order instead of calling the LLM or performing side effects.
+func (r *Recorder) Replay(records []ActionRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replaying = true
+	r.pending = append([]ActionRecord(nil), records...)
+	r.recorded = nil
+}
+
+// Take returns the records produced since the last Live/Replay call and clears them.
+func (r *Recorder) Take() []ActionRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := r.recorded
+	r.recorded = nil
+	return out
+}
+
+func (r *Recorder) record(rec ActionRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded = append(r.recorded, rec)
+}
+
+// nextFailure pops the first pending record for action if it is a recorded failure.
+func (r *Recorder) nextFailure(action string) (ActionRecord, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.replaying {
+		return ActionRecord{}, false
+	}
+	for i, p := range r.pending {
+		if p.Action != action {
+			continue
+		}
+		if p.Error == "" {
+			return ActionRecord{}, false
+		}
+		r.pending = append(r.pending[:i], r.pending[i+1:]...)
+		return p, true
+	}
+	return ActionRecord{}, false
+}
+
+// next pops the first pending record for action. replaying is false in live mode.
+func (r *Recorder) next(action string) (rec ActionRecord, found, replaying bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.replaying {
+		return ActionRecord{}, false, false
+	}
+	for i, p := range r.pending {
+		if p.Action == action {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			return p, true, true
+		}
+	}
+	return ActionRecord{}, false, true
+}
+
+// recordAction stores rec on the context's Recorder, if any.
+func recordAction(ctx context.Context, rec ActionRecord) {
+	if r := recorderFrom(ctx); r != nil {
+		r.record(rec)
+	}
+}
+
+// replayAction reports whether the action must not execute because the
+// runtime is replaying. A recorded patch is merged into the context first.
+func replayAction(ctx context.Context, action string) bool {
+	r := recorderFrom(ctx)
+	if r == nil {
+		return false
+	}
+	rec, found, replaying := r.next(action)
+	if !replaying {
+		return false
+	}
+	if !found {
+		slog.Warn("replay: no recorded output, skipping action", "action", action)
+		return true
+	}
+	if len(rec.Patch) > 0 {
+		mergeContextData(ctx, rec.Patch)
+	}
+	toolFailures(ctx, action, rec.Tools)
+	r.record(rec)
+	slog.Info("replay: applied recorded action output", "action", action, "patch", rec.Patch, "tools", len(rec.Tools))
+	return true
+}
+
+// replayFailure returns the recorded error if the next recorded output of
+// action is a failure; the action must then not execute.
+func replayFailure(ctx context.Context, action string) error {
+	r := recorderFrom(ctx)
+	if r == nil {
+		return nil
+	}
+	rec, failed := r.nextFailure(action)
+	if !failed {
+		return nil
+	}
+	r.record(rec)
+	toolFailures(ctx, action, rec.Tools)
+	slog.Info("replay: applied recorded action failure", "action", action, "err", rec.Error)
+	return &failureError{event: rec.ErrorEvent, err: errors.New(rec.Error), tools: rec.Tools}
+}
@@ -0,0 +1,90 @@
+package statechart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/comalice/statechartx"
+	"github.com/google/uuid"
+)
+
+// sendSpec is a `send:` action: an event name, or {event, data, delay,
+// target, id}. Without a target the event goes to the instance itself, as an
+// external event; target is an instance ID, "<machine>/<instance>" or
+// "agent:<id>". The id names a delayed send for `cancel:`.
+type sendSpec struct {
+	ID     string
+	Target string
+	Event  string
+	Data   any
+	Delay  time.Duration
+}
+
+func parseSend(spec any) (sendSpec, error) {
+	var s sendSpec
+	switch v := spec.(type) {
+	case string:
+		s.Event = v
+	case map[string]any:
+		s.Event, _ = v["event"].(string)
+		s.Target, _ = v["target"].(string)
+		s.ID, _ = v["id"].(string)
+		s.Data = v["data"]
+		if delay, ok := v["delay"]; ok {
+			str, _ := delay.(string)
+			d, err := time.ParseDuration(str)
+			if err != nil {
+				return s, fmt.Errorf("send: invalid delay %v: %w", delay, err)
+			}
+			if d < 0 {
+				return s, fmt.Errorf("send: delay %q must not be negative", str)
+			}
+			s.Delay = d
+		}
+	default:
+		return s, fmt.Errorf("send must be an event name or a map, got %T", spec)
+	}
+	if s.Event == "" {
+		return s, errors.New("send: no event name")
+	}
+	return s, nil
+}
+
+// sendAction returns the action of a `send:` step; the instance's
+// TimerScheduler delivers the event, so delayed sends survive restarts.
+func sendAction(spec any) statechartx.Action {
+	s, err := parseSend(spec)
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if err != nil {
+			return err
+		}
+		ts := timerSchedulerFrom(ctx)
+		if ts == nil {
+			slog.Warn("send outside an instance, event dropped", "event", s.Event, "target", s.Target)
+			return nil
+		}
+		id := s.ID
+		if id == "" {
+			id = uuid.NewString()
+		}
+		ts.ScheduleSend(id, s.Target, s.Event, s.Data, s.Delay)
+		return nil
+	}
+}
+
+// cancelAction returns the action of a `cancel: <send id>` step.
+func cancelAction(spec any) statechartx.Action {
+	id, _ := spec.(string)
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if id == "" {
+			return errors.New("cancel: no send id")
+		}
+		if ts := timerSchedulerFrom(ctx); ts != nil {
+			ts.CancelSend(id)
+		}
+		return nil
+	}
+}
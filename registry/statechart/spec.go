@@ -6,101 +6,264 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/comalice/maelstrom/config"
 	"github.com/comalice/maelstrom/internal/llm"
 	"github.com/comalice/maelstrom/internal/tools"
+	regyaml "github.com/comalice/maelstrom/registry/yaml"
+	"github.com/comalice/statechartx"
 	"github.com/expr-lang/expr"
 	"gopkg.in/yaml.v3"
-	"github.com/comalice/statechartx"
 )
 
 type AgentHirer interface {
-	HireAgent(template string) error
+	HireAgent(template string) (string, error)
+	// HireSupervisedAgent hires an agent that sup restarts when it fails.
+	HireSupervisedAgent(template string, sup Supervisor) (string, error)
 	RetireAgent(id string) error
 	SendMessage(toID string, msg map[string]any) error
 	QueryAgents() map[string]AgentInfo
 }
 
 type AgentInfo struct {
-	ID string `json:"id"`
-	Current string `json:"current"`
-	History []statechartx.Event `json:"history"`
+	ID       string              `json:"id"`
+	Template string              `json:"template"`
+	Current  string              `json:"current"`
+	Pending  int                 `json:"pending"` // messages not handled yet
+	History  []statechartx.Event `json:"history"`
 }
 
-
-
-
-
-
 // YamlMachineSpec top-level YAML structure (matches example traffic-light YAML).
 type YamlMachineSpec struct {
-	Name        string            `yaml:"name"`
-	Version     string            `yaml:"version"`
-	Description string            `yaml:"description,omitempty"`
-	Machine     YamlMachine       `yaml:"machine"`
-	LLM         llm.LLMConfig `yaml:"llm,omitempty"`
-	Actions     map[string]any `yaml:"actions,omitempty"` // name -> expr/code/ref/map[llm_with_tools]
-	Guards      map[string]string `yaml:"guards,omitempty"`  // name -> expr/code/ref
+	Name          string            `yaml:"name"`
+	Version       string            `yaml:"version"`
+	Description   string            `yaml:"description,omitempty"`
+	Machine       YamlMachine       `yaml:"machine"`
+	LLM           llm.LLMConfig     `yaml:"llm,omitempty"`
+	Actions       map[string]any    `yaml:"actions,omitempty"`        // name -> expr/code/ref/map[llm_with_tools]
+	Guards        map[string]string `yaml:"guards,omitempty"`         // name -> expr/code/ref
+	FailurePolicy string            `yaml:"failure_policy,omitempty"` // guards that fail: fail_open (default) or fail_closed
+	CostPerHour   float64           `yaml:"cost_per_hour,omitempty"`  // hourly cost of an agent hired from this spec
+	Supervision   *Supervision      `yaml:"supervision,omitempty"`    // how the agents this machine hires are restarted
+	Migrations    []Migration       `yaml:"migrations,omitempty"`     // how instances of older versions move onto this one
+	App           *config.AppConfig `yaml:"-"`                        // .App of prompts rendered per invocation
+	Partials      regyaml.Partials  `yaml:"-"`                        // partials prompts include per invocation
+
+	node       *yaml.Node                     // parsed source, for Validate diagnostics
+	origins    Origins                        // files of composed nodes, for Validate diagnostics
+	statePaths map[statechartx.StateID]string // .From/.To of prompts, set by ToAugmentedMachine
+	eventNames map[statechartx.EventID]string // .Event.Name of prompts, set by ToAugmentedMachine
 }
 
 // YamlMachine root.
 type YamlMachine struct {
-	ID      string            `yaml:"id"`
-	Initial string            `yaml:"initial"`
+	ID      string               `yaml:"id"`
+	Initial string               `yaml:"initial"`
 	States  map[string]YamlState `yaml:"states"`
+
+	order []string // document order of States
 }
 
 // YamlState recursive for hierarchy/compound/parallel.
 type YamlState struct {
-	Description string                   `yaml:"description,omitempty"`
-	Initial     string                   `yaml:"initial,omitempty"`
-	Timeout     string                   `yaml:"timeout,omitempty"` // e.g. "30s" -> timer event
-	IsParallel  bool                     `yaml:"parallel,omitempty"`
-	On          map[string]YamlTransition `yaml:"on,omitempty"`
-	States      map[string]YamlState      `yaml:"states,omitempty"` // Compound/children
+	Description  string                     `yaml:"description,omitempty"`
+	Type         string                     `yaml:"type,omitempty"` // "final" for final states
+	Initial      string                     `yaml:"initial,omitempty"`
+	Timeout      string                     `yaml:"timeout,omitempty"`       // e.g. "30s" -> timer event
+	TimeoutEvent string                     `yaml:"timeout_event,omitempty"` // event fired on timeout (default "timeout")
+	IsParallel   bool                       `yaml:"parallel,omitempty"`
+	History      string                     `yaml:"history,omitempty"` // "shallow" or "deep" makes this a history pseudo-state
+	Entry        any                        `yaml:"entry,omitempty"`   // action or list of actions run on entry
+	Exit         any                        `yaml:"exit,omitempty"`    // action or list of actions run on exit
+	Invoke       *YamlInvoke                `yaml:"invoke,omitempty"`  // child machine run while the state is active
+	On           map[string]YamlTransitions `yaml:"on,omitempty"`
+	States       map[string]YamlState       `yaml:"states,omitempty"` // Compound/children
+
+	order   []string // document order of States
+	onOrder []string // document order of On
+}
+
+// UnmarshalYAML decodes a machine and records the document order of its states.
+func (m *YamlMachine) UnmarshalYAML(node *yaml.Node) error {
+	type plain YamlMachine
+	if err := node.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	m.order = mappingKeys(node, "states")
+	return nil
+}
+
+// UnmarshalYAML decodes a state and records the document order of its child
+// states and transitions, which decoding into maps loses.
+func (st *YamlState) UnmarshalYAML(node *yaml.Node) error {
+	type plain YamlState
+	if err := node.Decode((*plain)(st)); err != nil {
+		return err
+	}
+	st.order = mappingKeys(node, "states")
+	st.onOrder = mappingKeys(node, "on")
+	return nil
+}
+
+// root returns the machine as the compound state holding the top-level states.
+func (m YamlMachine) root() YamlState {
+	return YamlState{Initial: m.Initial, States: m.States, order: m.order}
+}
+
+// childIDs returns the child state IDs in document order.
+func (st YamlState) childIDs() []string {
+	return orderedKeys(st.States, st.order)
+}
+
+// eventNames returns the events of st.On in document order.
+func (st YamlState) eventNames() []string {
+	return orderedKeys(st.On, st.onOrder)
+}
+
+// initialChild returns the initial child: Initial if set, otherwise the
+// first child in document order that is not a history state.
+func (st YamlState) initialChild() string {
+	if st.Initial != "" {
+		return st.Initial
+	}
+	for _, id := range st.childIDs() {
+		if st.States[id].History == "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// mappingKeys returns the keys of the mapping under key in node, in document order.
+func mappingKeys(node *yaml.Node, key string) []string {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != key {
+			continue
+		}
+		val := node.Content[i+1]
+		if val.Kind != yaml.MappingNode {
+			return nil
+		}
+		keys := make([]string, 0, len(val.Content)/2)
+		for j := 0; j < len(val.Content); j += 2 {
+			keys = append(keys, val.Content[j].Value)
+		}
+		return keys
+	}
+	return nil
+}
+
+// orderedKeys returns the keys of m in the recorded order, falling back to
+// sorted order for specs built in code rather than decoded.
+func orderedKeys[V any](m map[string]V, order []string) []string {
+	if len(order) == len(m) {
+		complete := true
+		for _, k := range order {
+			if _, ok := m[k]; !ok {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return order
+		}
+	}
+	return sortedKeys(m)
 }
 
 // YamlTransition event config.
 type YamlTransition struct {
 	Target string `yaml:"target"`
 	Guard  string `yaml:"guard,omitempty"`
-	Action any `yaml:"action,omitempty"`
+	Action any    `yaml:"action,omitempty"`
+}
+
+// YamlTransitions are the transitions of one event, tried in order: the first
+// whose guard passes is taken, so a final guard-less entry acts as the default.
+// In YAML it is either a single transition object or a list of them.
+type YamlTransitions []YamlTransition
+
+// UnmarshalYAML accepts a single transition object or a list.
+func (ts *YamlTransitions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var list []YamlTransition
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*ts = list
+		return nil
+	}
+	var t YamlTransition
+	if err := node.Decode(&t); err != nil {
+		return err
+	}
+	*ts = YamlTransitions{t}
+	return nil
+}
+
+// MarshalYAML writes a single transition as an object, like it is usually written.
+func (ts YamlTransitions) MarshalYAML() (any, error) {
+	if len(ts) == 1 {
+		return ts[0], nil
+	}
+	return []YamlTransition(ts), nil
 }
 
 // ParseSpec unmarshals YAML bytes to spec.
 func ParseSpec(data []byte) (*YamlMachineSpec, error) {
-	var spec YamlMachineSpec
-	if err := yaml.Unmarshal(data, &spec); err != nil {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
 		return nil, fmt.Errorf("yaml unmarshal: %w", err)
 	}
-	return &spec, nil
+	return DecodeSpec(&root, nil)
 }
 
-type AugmentedMachine struct {
-	Spec           *YamlMachineSpec
-	Machine        *statechartx.Machine
-	StatePathByID  map[statechartx.StateID]string
-	StateIDByPath  map[string]statechartx.StateID
-	EventIDByName  map[string]statechartx.EventID
-	EventNameByID  map[statechartx.EventID]string
-}
+// Origins maps the nodes of a spec composed from several registry files
+// (extends, $ref) to the file each comes from, for diagnostics.
+type Origins map[*yaml.Node]string
 
-func (a *AugmentedMachine) Current() string {
-	return "idle"
+// DecodeSpec decodes a parsed or composed spec; origins may be nil.
+func DecodeSpec(root *yaml.Node, origins Origins) (*YamlMachineSpec, error) {
+	var spec YamlMachineSpec
+	if root.Kind != 0 {
+		if err := root.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("yaml unmarshal: %w", err)
+		}
+		spec.node, spec.origins = root, origins
+	}
+	return &spec, nil
 }
 
-func (a *AugmentedMachine) History() []statechartx.Event {
-	return []statechartx.Event{}
+type AugmentedMachine struct {
+	Spec          *YamlMachineSpec
+	Machine       *statechartx.Machine
+	StatePathByID map[statechartx.StateID]string
+	StateIDByPath map[string]statechartx.StateID
+	EventIDByName map[string]statechartx.EventID
+	EventNameByID map[statechartx.EventID]string
+
+	doneConds    []doneCond
+	gotoEventIDs map[string]statechartx.EventID // on_error goto target -> internal event
+	queues       sync.Map                       // *statechartx.Runtime -> *eventQueue
 }
 
 // ToAugmentedMachine builds statechartx.Machine from spec and adds ID/name mappings.
 // Resolves guards/actions as stubs (extend with expr eval, registry, LLM).
 func (s *YamlMachineSpec) ToAugmentedMachine(hirer AgentHirer) (*AugmentedMachine, error) {
-	if _, ok := s.Machine.States[s.Machine.Initial]; !ok {
+	if st, ok := s.Machine.States[s.Machine.Initial]; !ok {
 		return nil, fmt.Errorf("initial state %q not found", s.Machine.Initial)
+	} else if st.History != "" {
+		return nil, fmt.Errorf("initial state %q is a history state", s.Machine.Initial)
+	}
+
+	if p := s.FailurePolicy; p != "" && p != FailOpen && p != FailClosed {
+		return nil, fmt.Errorf("unknown failure_policy %q", p)
 	}
 
 	initialFullpath := s.Machine.ID + "." + s.Machine.Initial
@@ -110,19 +273,30 @@ func (s *YamlMachineSpec) ToAugmentedMachine(hirer AgentHirer) (*AugmentedMachin
 	statesSeen := make(map[string]struct{})
 	statesSeen[s.Machine.ID] = struct{}{}
 	eventsSeen := make(map[string]struct{})
+	gotos := make(map[string]struct{})
 
-	if err := s.declareRecursive(b, s.Machine.States, s.Machine.ID, &statesSeen); err != nil {
+	if err := s.declareRecursive(b, s.Machine.root(), s.Machine.ID, &statesSeen); err != nil {
 		return nil, fmt.Errorf("declareRecursive: %w", err)
 	}
 	statesSeen[initialFullpath] = struct{}{}
-	if err := s.configureRecursive(b, s.Machine.States, s.Machine.ID, &eventsSeen, hirer); err != nil {
+	if err := s.configureRecursive(b, s.Machine.root(), s.Machine.ID, nil, &eventsSeen, gotos, hirer); err != nil {
 		return nil, fmt.Errorf("configureRecursive: %w", err)
 	}
+	// on_error goto jumps are transitions of the root, so they leave any state.
+	gotoEventIDs := make(map[string]statechartx.EventID, len(gotos))
+	for _, target := range sortedKeys(gotos) {
+		if _, ok := statesSeen[target]; !ok {
+			return nil, fmt.Errorf("on_error goto: state %q not found", target)
+		}
+		b.State(s.Machine.ID).On(gotoEventPrefix+target, target, nil, nil)
+		gotoEventIDs[target] = statechartx.EventID(b.GetID("event:" + gotoEventPrefix + target))
+	}
 
 	m, err := b.Build()
 	if err != nil {
 		return nil, fmt.Errorf("builder build: %w", err)
 	}
+	s.wireHistoryStates(m, b)
 
 	aug := &AugmentedMachine{
 		Spec:          s,
@@ -131,6 +305,8 @@ func (s *YamlMachineSpec) ToAugmentedMachine(hirer AgentHirer) (*AugmentedMachin
 		StateIDByPath: make(map[string]statechartx.StateID),
 		EventIDByName: make(map[string]statechartx.EventID),
 		EventNameByID: make(map[statechartx.EventID]string),
+		doneConds:     s.collectDoneConds(b),
+		gotoEventIDs:  gotoEventIDs,
 	}
 	for path := range statesSeen {
 		id := b.GetID(path)
@@ -143,6 +319,7 @@ func (s *YamlMachineSpec) ToAugmentedMachine(hirer AgentHirer) (*AugmentedMachin
 		aug.EventIDByName[evt] = statechartx.EventID(eid)
 		aug.EventNameByID[statechartx.EventID(eid)] = evt
 	}
+	s.statePaths, s.eventNames = aug.StatePathByID, aug.EventNameByID
 	return aug, nil
 }
 
@@ -155,8 +332,10 @@ func (s *YamlMachineSpec) ToMachine() (*statechartx.Machine, error) {
 }
 
 // declareRecursive declares states recursively using dot-notation hierarchy (e.g. "parent.child").
-func (s *YamlMachineSpec) declareRecursive(b *statechartx.MachineBuilder, states map[string]YamlState, prefix string, statesSeen *map[string]struct{}) error {
-	for id, st := range states {
+// Children are declared in document order, so state IDs are stable across runs.
+func (s *YamlMachineSpec) declareRecursive(b *statechartx.MachineBuilder, parent YamlState, prefix string, statesSeen *map[string]struct{}) error {
+	for _, id := range parent.childIDs() {
+		st := parent.States[id]
 		fullpath := id
 		if prefix != "" {
 			fullpath = prefix + "." + id
@@ -164,12 +343,31 @@ func (s *YamlMachineSpec) declareRecursive(b *statechartx.MachineBuilder, states
 		(*statesSeen)[fullpath] = struct{}{}
 		sb := b.State(fullpath)
 
+		if st.History != "" {
+			if err := validateHistoryState(fullpath, st); err != nil {
+				return err
+			}
+			continue
+		}
+		if st.Type == StateTypeFinal {
+			if len(st.States) > 0 || st.IsParallel {
+				return fmt.Errorf("final state %q cannot have child states", fullpath)
+			}
+			sb.Final(nil)
+		} else if st.Type != "" {
+			return fmt.Errorf("state %q: unknown type %q", fullpath, st.Type)
+		}
+
 		if len(st.States) > 0 {
-			childInitial := st.Initial
-			if childInitial == "" {
-				for childID := range st.States {
-					childInitial = childID
-					break
+			childInitial := st.initialChild()
+			if st.States[childInitial].History != "" {
+				return fmt.Errorf("state %q: initial state %q is a history state", fullpath, childInitial)
+			}
+			if st.IsParallel {
+				for _, childID := range st.childIDs() {
+					if st.States[childID].History != "" {
+						return fmt.Errorf("history state %q cannot be a region of a parallel state", fullpath+"."+childID)
+					}
 				}
 			}
 			sb.Compound(fullpath + "." + childInitial)
@@ -178,51 +376,92 @@ func (s *YamlMachineSpec) declareRecursive(b *statechartx.MachineBuilder, states
 			sb.Parallel()
 		}
 		// Recurse children
-		if err := s.declareRecursive(b, st.States, fullpath, statesSeen); err != nil {
+		if err := s.declareRecursive(b, st, fullpath, statesSeen); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-
-// configureRecursive configures transitions and timeouts recursively.
-func (s *YamlMachineSpec) configureRecursive(b *statechartx.MachineBuilder, states map[string]YamlState, prefix string, eventsSeen *map[string]struct{}, hirer AgentHirer) error {
-	for id, st := range states {
+// configureRecursive configures transitions, timeouts, invokes and history recording recursively.
+// watch holds the deep history watches inherited from the ancestors of parent.
+// Transitions are added in document order, which fixes event IDs and the
+// priority between transitions.
+// gotos collects the targets of on_error goto steps.
+func (s *YamlMachineSpec) configureRecursive(b *statechartx.MachineBuilder, parent YamlState, prefix string, watch []historyWatch, eventsSeen *map[string]struct{}, gotos map[string]struct{}, hirer AgentHirer) error {
+	watch = childHistoryWatches(prefix, parent, watch)
+	for _, id := range parent.childIDs() {
+		st := parent.States[id]
 		fullpath := id
 		if prefix != "" {
 			fullpath = prefix + "." + id
 		}
+		if st.History != "" {
+			// Wired after Build: see wireHistoryStates.
+			continue
+		}
 		sb := b.State(fullpath)
 
+		var entry, exit []statechartx.Action
 		if st.Timeout != "" {
-			if _, err := time.ParseDuration(st.Timeout); err != nil {
+			d, err := time.ParseDuration(st.Timeout)
+			if err != nil {
 				return fmt.Errorf("invalid timeout %q: %w", st.Timeout, err)
 			}
-			slog.Warn("Timeout ignored; add timer logic", "timeout", st.Timeout)
+			evtName := st.TimeoutEvent
+			if evtName == "" {
+				evtName = DefaultTimeoutEvent
+			}
+			entry = append(entry, timeoutEntryAction(fullpath, evtName, d))
+			exit = append(exit, timeoutExitAction(fullpath))
+		}
+		scope := actionScope{prefix: prefix, path: fullpath, gotos: gotos}
+		entry = append(entry, entryAction(s.resolveActionList(hirer, st.Entry, scope)))
+		exit = append(exit, s.resolveActionList(hirer, st.Exit, scope))
+		if st.Invoke != nil {
+			invokeID := st.Invoke.invokeID(fullpath)
+			entry = append(entry, invokeEntryAction(invokeID, *st.Invoke))
+			exit = append(exit, invokeExitAction(invokeID))
+		}
+		exit = append(exit, historyExitActions(fullpath, st, watch)...)
+		if act := sequenceActions(entry); act != nil {
+			sb.Entry(act)
+		}
+		if act := sequenceActions(exit); act != nil {
+			sb.Exit(act)
 		}
 
-		for evt, trans := range st.On {
+		for _, evt := range st.eventNames() {
 			(*eventsSeen)[evt] = struct{}{}
-			targetFull := trans.Target
-			if !strings.HasPrefix(trans.Target, s.Machine.ID+".") {
-				if strings.Contains(trans.Target, ".") {
-					targetFull = s.Machine.ID + "." + trans.Target
-				} else if prefix != "" && trans.Target != fullpath {
-					targetFull = prefix + "." + trans.Target
-				}
+			for _, trans := range st.On[evt] {
+				guard := s.resolveGuard(trans.Guard)
+				action := s.resolveActionList(hirer, trans.Action, scope)
+				sb.On(evt, s.resolveTarget(prefix, fullpath, trans.Target), guard, action)
 			}
-			guard := s.resolveGuard(trans.Guard)
-			action := s.resolveAction(hirer, trans.Action)
-			sb.On(evt, targetFull, guard, action)
 		}
-		if err := s.configureRecursive(b, st.States, fullpath, eventsSeen, hirer); err != nil {
+		if err := s.configureRecursive(b, st, fullpath, deepWatches(watch, st), eventsSeen, gotos, hirer); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// resolveTarget turns a transition target into a full state path: targets
+// with a dot are relative to the machine root, bare names are siblings of the
+// source state.
+func (s *YamlMachineSpec) resolveTarget(prefix, fullpath, target string) string {
+	if strings.HasPrefix(target, s.Machine.ID+".") {
+		return target
+	}
+	if strings.Contains(target, ".") {
+		return s.Machine.ID + "." + target
+	}
+	if prefix != "" && target != fullpath {
+		return prefix + "." + target
+	}
+	return target
+}
+
 // resolveGuard stub: map lookup + expr compiler placeholder.
 // Extend: Use goexpr, otto.js, or maelstrom LLM for dynamic eval.
 func getContextData(ctx context.Context) map[string]any {
@@ -234,7 +473,55 @@ func getContextData(ctx context.Context) map[string]any {
 
 func mergeContextData(ctx context.Context, patch map[string]any) {
 	if c := statechartx.FromContext(ctx); c != nil {
-		c.LoadAll(patch)
+		data := c.GetAll()
+		for k, v := range patch {
+			data[k] = v
+		}
+		c.LoadAll(data)
+	}
+}
+
+// eventData returns the event payload; entry actions of the initial state run without an event.
+func eventData(evt *statechartx.Event) any {
+	if evt == nil {
+		return nil
+	}
+	return evt.Data
+}
+
+// actionList normalises an entry/exit spec: a single action or a list of actions.
+func actionList(spec any) []any {
+	switch v := spec.(type) {
+	case nil:
+		return nil
+	case []any:
+		return v
+	default:
+		return []any{v}
+	}
+}
+
+// sequenceActions runs actions in order and stops at the first error; nil entries are skipped.
+func sequenceActions(actions []statechartx.Action) statechartx.Action {
+	var seq []statechartx.Action
+	for _, a := range actions {
+		if a != nil {
+			seq = append(seq, a)
+		}
+	}
+	switch len(seq) {
+	case 0:
+		return nil
+	case 1:
+		return seq[0]
+	}
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		for _, a := range seq {
+			if err := a(ctx, evt, from, to); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 }
 
@@ -251,9 +538,9 @@ func (s *YamlMachineSpec) resolveGuard(name string) statechartx.Guard {
 	if name == "" {
 		return nil
 	}
-	// Try inline expr first
+	// Try inline expr first, unless a named guard shadows it
 	prog, err := expr.Compile(name, expr.AsBool())
-	if err == nil {
+	if _, named := s.Guards[name]; !named && err == nil {
 		return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) (bool, error) {
 			ctxData := getContextData(ctx)
 			env := map[string]any{
@@ -263,7 +550,7 @@ func (s *YamlMachineSpec) resolveGuard(name string) statechartx.Guard {
 			out, err := expr.Run(prog, env)
 			if err != nil {
 				slog.Warn("Guard run failed (inline)", "name", name, "env", env, "err", err)
-				return true, nil
+				return s.guardFailed(ctx, name, err), nil
 			}
 			if b, ok := out.(bool); ok {
 				slog.Info("Guard (inline)", "name", name, "ctx", ctxData, "evt", evt.Data, "result", b)
@@ -277,15 +564,14 @@ func (s *YamlMachineSpec) resolveGuard(name string) statechartx.Guard {
 	exprStr, ok := s.Guards[name]
 	if !ok {
 		return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) (bool, error) {
-			slog.Info("Guard missing", "name", name, "default", true)
-			return true, nil
+			return s.guardFailed(ctx, name, fmt.Errorf("guard %q is not defined", name)), nil
 		}
 	}
 	prog, err = expr.Compile(exprStr, expr.AsBool())
 	if err != nil {
 		slog.Warn("Guard compile failed", "name", name, "expr", exprStr, "err", err)
 		return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) (bool, error) {
-			return true, nil
+			return s.guardFailed(ctx, name, err), nil
 		}
 	}
 	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) (bool, error) {
@@ -297,7 +583,7 @@ func (s *YamlMachineSpec) resolveGuard(name string) statechartx.Guard {
 		out, err := expr.Run(prog, env)
 		if err != nil {
 			slog.Warn("Guard run failed", "name", name, "env", env, "err", err)
-			return true, nil
+			return s.guardFailed(ctx, name, err), nil
 		}
 		if b, ok := out.(bool); ok {
 			slog.Info("Guard", "name", name, "expr", exprStr, "ctx", ctxData, "evt", evt.Data, "result", b)
@@ -321,7 +607,7 @@ func (s *YamlMachineSpec) resolveAction(hirer AgentHirer, actionSpec any) statec
 			content = act
 		}
 	}
-// System actions dispatch, e.g. hire_agent:simple
+	// System actions dispatch, e.g. hire_agent:simple
 	template, ok := strings.CutPrefix(name, "hire_agent:")
 	if ok {
 		if hirer == nil {
@@ -331,11 +617,24 @@ func (s *YamlMachineSpec) resolveAction(hirer AgentHirer, actionSpec any) statec
 			}
 		}
 		return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
-			if err := hirer.HireAgent(template); err != nil {
+			if replayAction(ctx, name) {
+				return nil
+			}
+			// Agents are supervised by the instance or agent that hires them.
+			var sup Supervisor
+			if inst, ok := instanceFrom(ctx); ok {
+				sup.Target = inst.Target()
+			}
+			if s.Supervision != nil {
+				sup.Supervision = *s.Supervision
+			}
+			id, err := hirer.HireSupervisedAgent(template, sup)
+			if err != nil {
 				slog.Error("hire_agent failed", "template", template, "err", err)
 				return err
 			}
-			slog.Info("hired agent via system action", "template", template)
+			recordAction(ctx, ActionRecord{Action: name})
+			slog.Info("hired agent via system action", "template", template, "id", id)
 			return nil
 		}
 	}
@@ -349,14 +648,37 @@ func (s *YamlMachineSpec) resolveAction(hirer AgentHirer, actionSpec any) statec
 			}
 		}
 		return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+			if replayAction(ctx, name) {
+				return nil
+			}
 			if err := hirer.RetireAgent(id); err != nil {
 				slog.Error("retire_agent failed", "id", id, "err", err)
 				return err
 			}
+			recordAction(ctx, ActionRecord{Action: name})
 			slog.Info("retired agent via system action", "id", id)
 			return nil
 		}
 	}
+	// assign, raise, send and cancel dispatch: deterministic, no LLM
+	if assignMap, ok := content.(map[string]any); ok {
+		if assign, has := assignMap["assign"]; has {
+			label := name
+			if label == "" {
+				label = "assign"
+			}
+			return assignAction(label, assign)
+		}
+		if event, has := assignMap["raise"]; has {
+			return raiseAction(event)
+		}
+		if send, has := assignMap["send"]; has {
+			return sendAction(send)
+		}
+		if id, has := assignMap["cancel"]; has {
+			return cancelAction(id)
+		}
+	}
 	// llm_with_tools dispatch
 	if toolActionMap, ok := content.(map[string]any); ok {
 		// Legacy support for {type: "llm"}
@@ -376,16 +698,32 @@ func (s *YamlMachineSpec) resolveAction(hirer AgentHirer, actionSpec any) statec
 		if has {
 			lwtCfgI, _ := lwtI.(map[string]any)
 			lwtCfg := lwtCfgI
+			label := name
+			if label == "" {
+				label = "llm_with_tools"
+			}
+			systemTmpl := s.newPromptTemplate(label+".system", getString(lwtCfg, "system"))
+			promptTmpl := s.newPromptTemplate(label+".prompt", getString(lwtCfg, "prompt"))
 			return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+				if replayAction(ctx, label) {
+					return nil
+				}
 				ctxData := getContextData(ctx)
 				jsonCtxB, _ := json.Marshal(ctxData)
-				jsonEvtB, _ := json.Marshal(evt.Data)
+				jsonEvtB, _ := json.Marshal(eventData(evt))
 				jsonCtx := string(jsonCtxB)
 				jsonEvt := string(jsonEvtB)
 
-				system := getString(lwtCfg, "system")
-				promptTmpl := getString(lwtCfg, "prompt")
-				userPrompt := fmt.Sprintf("%s\n\nCurrent context: %s\nEvent data: %s", promptTmpl, jsonCtx, jsonEvt)
+				data := s.promptData(ctx, evt, from, to)
+				system, err := systemTmpl.render(data)
+				if err != nil {
+					return fmt.Errorf("action %q: %w", label, err)
+				}
+				prompt, err := promptTmpl.render(data)
+				if err != nil {
+					return fmt.Errorf("action %q: %w", label, err)
+				}
+				userPrompt := fmt.Sprintf("%s\n\nCurrent context: %s\nEvent data: %s", prompt, jsonCtx, jsonEvt)
 
 				var maxIter = 5
 				if miI, ok := lwtCfg["max_iter"]; ok {
@@ -418,9 +756,7 @@ func (s *YamlMachineSpec) resolveAction(hirer AgentHirer, actionSpec any) statec
 
 				var systemPrompt string
 				if hasTools {
-					toolsJSONB, _ := json.MarshalIndent(toolSchemas, "", "  ")
-					toolsJSON := string(toolsJSONB)
-					systemPrompt = fmt.Sprintf("You have access to these tools. To use a tool, output ONLY {\"tool_use\": {\"name\": \"tool_name\", \"params\": {...}}}\n\n%s\n\nTool results provided next message.\n\nWhen finished, output JSON patch for context (no tool_use).", toolsJSON)
+					systemPrompt = `Use the provided tools when they help. When finished, reply with ONLY a JSON object to merge into the context.`
 				} else {
 					systemPrompt = `You are a helpful assistant.
 Reply ONLY with valid JSON: {"response": "your reply here"}. No other text or keys.`
@@ -432,61 +768,49 @@ Reply ONLY with valid JSON: {"response": "your reply here"}. No other text or ke
 					maxIter = 1
 				}
 
-				msgs := []string{systemPrompt, userPrompt}
+				req := llm.ChatRequest{
+					Messages: []llm.Message{
+						{Role: llm.RoleSystem, Content: systemPrompt},
+						{Role: llm.RoleUser, Content: userPrompt},
+					},
+					Tools: chatTools(toolSchemas),
+				}
+				var toolRecs []ToolRecord
 				for iter := 0; iter < maxIter; iter++ {
-					fullPrompt := strings.Join(msgs, "\n\n\n---\n\n")
-					resp, err := llm.DefaultCaller.Call(ctx, s.LLM, fullPrompt)
+					resp, err := llm.Chat(ctx, s.LLM, req)
 					if err != nil {
 						slog.Error("llm_with_tools LLM call failed", "iter", iter, "err", err)
-						return err
+						return llmFailure(err, toolRecs)
 					}
 
-					var respMap map[string]any
-					if err := json.Unmarshal([]byte(resp), &respMap); err != nil {
-						trunc := resp
-						if len(resp) > 300 {
-							trunc = resp[:300] + "..."
-						}
-						slog.Warn("llm_with_tools non-JSON, try patch", "resp", trunc, "err", err)
-						var patch map[string]any
-						if jerr := json.Unmarshal([]byte(resp), &patch); jerr == nil {
-							mergeContextData(ctx, patch)
+					if len(resp.ToolCalls) > 0 {
+						req.Messages = append(req.Messages, llm.Message{Role: llm.RoleAssistant, Content: resp.Content, ToolCalls: resp.ToolCalls})
+						for _, tc := range resp.ToolCalls {
+							toolRec, result := runToolCall(ctx, toolSchemas, tc)
+							toolRecs = append(toolRecs, toolRec)
+							toolFailures(ctx, label, []ToolRecord{toolRec})
+							req.Messages = append(req.Messages, result)
 						}
-						return nil
+						continue
 					}
 
-					if toolUseI, hasTU := respMap["tool_use"]; hasTU && toolUseI != nil {
-						if tuMap, ok := toolUseI.(map[string]any); ok && tuMap != nil {
-							if tnameI, hasName := tuMap["name"]; hasName && tnameI != nil {
-								if tname, tnOK := tnameI.(string); tnOK {
-									if tparamsI, hasParams := tuMap["params"]; hasParams && tparamsI != nil {
-										if tparams, tpOK := tparamsI.(map[string]any); tpOK && tparams != nil {
-											if tool := tools.GlobalTools.Get(tname); tool != nil {
-												toolRes, terr := tool.Execute(ctx, tparams)
-												if terr != nil {
-													msgs = append(msgs, fmt.Sprintf("Tool '%s' failed: %v", tname, terr))
-												} else {
-													res := tools.Result{Content: toolRes}
-													resJSONB, _ := json.MarshalIndent(res, "", "  ")
-													msgs = append(msgs, fmt.Sprintf("Tool '%s' result:\n%s", tname, string(resJSONB)))
-												}
-												continue
-											}
-										}
-									}
-								}
-							}
-						} else {
-							slog.Warn("tool_use not map object", "tool_use", toolUseI)
+					// final
+					respMap, err := parseJSONObject(resp.Content)
+					if err != nil {
+						trunc := resp.Content
+						if len(trunc) > 300 {
+							trunc = trunc[:300] + "..."
 						}
+						slog.Warn("llm_with_tools final answer is not a JSON object", "resp", trunc, "err", err)
+						return llmFailure(fmt.Errorf("final answer is not a JSON object: %w", err), toolRecs)
 					}
-					// final
 					mergeContextData(ctx, respMap)
+					recordAction(ctx, ActionRecord{Action: label, Patch: respMap, Tools: toolRecs})
 					slog.Info("llm_with_tools completed", "final_patch", respMap)
 					return nil
 				}
 				slog.Warn("llm_with_tools max iterations reached without final")
-				return nil
+				return llmFailure(fmt.Errorf("no final answer after %d iterations", maxIter), toolRecs)
 			}
 		}
 	}
@@ -503,23 +827,32 @@ Reply ONLY with valid JSON: {"response": "your reply here"}. No other text or ke
 			return nil
 		}
 	}
+	actionTmpl := s.newPromptTemplate(name, actionStr)
 	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if replayAction(ctx, name) {
+			return nil
+		}
 		ctxData := getContextData(ctx)
 		jsonCtxB, _ := json.Marshal(ctxData)
-		jsonEvtB, _ := json.Marshal(evt.Data)
+		jsonEvtB, _ := json.Marshal(eventData(evt))
+		data := s.promptData(ctx, evt, from, to)
+		instructions, err := actionTmpl.render(data)
+		if err != nil {
+			return fmt.Errorf("action %q: %w", name, err)
+		}
 		prompt := fmt.Sprintf(`Action '%s'.
-State transition from %d to %d.
+State transition from %s to %s.
 Current context: %s
 Event data: %s
 
 %s
 
 Reply ONLY with valid JSON object to merge into context. No other text.
-Example: {"key": "value", "count": 5}`, name, from, to, string(jsonCtxB), string(jsonEvtB), actionStr)
+Example: {"key": "value", "count": 5}`, name, data.From, data.To, string(jsonCtxB), string(jsonEvtB), instructions)
 		resp, err := llm.DefaultCaller.Call(ctx, s.LLM, prompt)
 		if err != nil {
 			slog.Error("Action LLM call failed", "name", name, "err", err)
-			return nil
+			return llmFailure(err, nil)
 		}
 		var patch map[string]any
 		if err := json.Unmarshal([]byte(resp), &patch); err != nil {
@@ -528,9 +861,10 @@ Example: {"key": "value", "count": 5}`, name, from, to, string(jsonCtxB), string
 				trunc = resp[:300] + "..."
 			}
 			slog.Warn("Action JSON parse failed", "name", name, "resp", trunc, "err", err)
-			return nil
+			return llmFailure(fmt.Errorf("answer is not a JSON object: %w", err), nil)
 		}
 		mergeContextData(ctx, patch)
+		recordAction(ctx, ActionRecord{Action: name, Patch: patch})
 		slog.Info("Action simple LLM merged patch", "name", name, "patch", patch)
 		return nil
 	}
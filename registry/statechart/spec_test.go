@@ -2,8 +2,12 @@ package statechart
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/comalice/maelstrom/config"
 	"github.com/comalice/maelstrom/internal/llm"
 	"github.com/comalice/statechartx"
 	"github.com/stretchr/testify/assert"
@@ -73,7 +77,7 @@ machine:
 	require.NoError(t, err)
 	require.NotNil(t, machine)
 
-// Validate runtime starts (implies valid machine)
+	// Validate runtime starts (implies valid machine)
 	rt := statechartx.NewRuntime(machine, nil)
 	bgCtx := context.Background()
 	require.NoError(t, rt.Start(bgCtx))
@@ -216,26 +220,26 @@ states:
 
 func TestResolveAction(t *testing.T) {
 	tests := []struct {
-		name string
-		spec *YamlMachineSpec
-		specIn any
+		name    string
+		spec    *YamlMachineSpec
+		specIn  any
 		wantNil bool
 	}{
 		{
-			name: "nil",
-			specIn: nil,
+			name:    "nil",
+			specIn:  nil,
 			wantNil: true,
 		},
 		{
-			name: "string_fallback",
-			specIn: "simple_string_action",
+			name:    "string_fallback",
+			specIn:  "simple_string_action",
 			wantNil: false, // becomes LLM stub if LLM.Provider==""
 		},
 		{
 			name: "legacy_llm",
 			spec: &YamlMachineSpec{LLM: llm.LLMConfig{Provider: "anthropic"}},
 			specIn: map[string]any{
-				"type": "llm",
+				"type":   "llm",
 				"system": "You are helpful.",
 				"prompt": "Respond to user.",
 			},
@@ -246,7 +250,7 @@ func TestResolveAction(t *testing.T) {
 			spec: &YamlMachineSpec{LLM: llm.LLMConfig{Provider: "anthropic"}},
 			specIn: map[string]any{
 				"llm_with_tools": map[string]any{
-					"tools": []any{},
+					"tools":  []any{},
 					"prompt": "JSON patch please.",
 				},
 			},
@@ -263,8 +267,8 @@ func TestResolveAction(t *testing.T) {
 			wantNil: false,
 		},
 		{
-			name: "invalid_nonstring_nonmap",
-			specIn: map[string]any{"invalid": 123},
+			name:    "invalid_nonstring_nonmap",
+			specIn:  map[string]any{"invalid": 123},
 			wantNil: true,
 		},
 	}
@@ -283,3 +287,1347 @@ func TestResolveAction(t *testing.T) {
 		})
 	}
 }
+
+type fakeTimers struct {
+	scheduled map[string]time.Duration
+	events    map[string]string
+	cancelled []string
+	sends     []scheduledSend
+}
+
+// scheduledSend is a send armed on fakeTimers.
+type scheduledSend struct {
+	ID, Target, Event string
+	Data              any
+	Delay             time.Duration
+}
+
+func (f *fakeTimers) ScheduleTimeout(state, event string, d time.Duration) {
+	f.scheduled[state] = d
+	f.events[state] = event
+}
+
+func (f *fakeTimers) CancelTimeout(state string) {
+	f.cancelled = append(f.cancelled, state)
+}
+
+func (f *fakeTimers) ScheduleSend(id, target, event string, data any, d time.Duration) {
+	f.sends = append(f.sends, scheduledSend{ID: id, Target: target, Event: event, Data: data, Delay: d})
+}
+
+func (f *fakeTimers) CancelSend(id string) {
+	f.cancelled = append(f.cancelled, "send:"+id)
+}
+
+func TestTimeout_ArmOnEntryCancelOnExit(t *testing.T) {
+	yamlStr := `
+name: sla
+machine:
+  id: root
+  initial: waiting
+  states:
+    waiting:
+      timeout: 30s
+      timeout_event: expired
+      on:
+        reply: {target: answered}
+        expired: {target: escalated}
+    answered: {}
+    escalated:
+      timeout: 1m
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+	require.Contains(t, aug.EventIDByName, "expired")
+
+	ft := &fakeTimers{scheduled: map[string]time.Duration{}, events: map[string]string{}}
+	rt := statechartx.NewRuntime(aug.Machine, nil)
+	require.NoError(t, rt.Start(WithTimerScheduler(context.Background(), ft)))
+	defer rt.Stop()
+
+	assert.Equal(t, 30*time.Second, ft.scheduled["root.waiting"])
+	assert.Equal(t, "expired", ft.events["root.waiting"])
+
+	rt.ProcessEvent(statechartx.Event{ID: aug.EventIDByName["expired"]})
+	assert.Equal(t, []string{"root.waiting"}, ft.cancelled)
+	assert.Equal(t, time.Minute, ft.scheduled["root.escalated"])
+	assert.Equal(t, DefaultTimeoutEvent, ft.events["root.escalated"])
+}
+
+type countingCaller struct {
+	calls int
+	resp  string
+}
+
+func (c *countingCaller) Call(ctx context.Context, cfg llm.LLMConfig, prompt string) (string, error) {
+	c.calls++
+	return c.resp, nil
+}
+
+func (c *countingCaller) Chat(ctx context.Context, cfg llm.LLMConfig, req llm.ChatRequest) (*llm.ChatResponse, error) {
+	c.calls++
+	return &llm.ChatResponse{Content: c.resp}, nil
+}
+
+func TestRecorder_ReplayAppliesRecordedPatch(t *testing.T) {
+	orig := llm.DefaultCaller
+	defer func() { llm.DefaultCaller = orig }()
+	caller := &countingCaller{resp: `{"count": 1}`}
+	llm.DefaultCaller = caller
+
+	yamlStr := `
+name: counter
+llm:
+  provider: anthropic
+machine:
+  id: root
+  initial: counting
+  states:
+    counting:
+      on:
+        inc: {target: counting, action: inc_count}
+actions:
+  inc_count: "Increment the counter by 1."
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	spec.LLM = llm.LLMConfig{Provider: "anthropic"}
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+	inc := statechartx.Event{ID: aug.EventIDByName["inc"]}
+
+	live := NewRecorder()
+	rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	require.NoError(t, rt.Start(WithRecorder(context.Background(), live)))
+	defer rt.Stop()
+	rt.EmbedContext()
+	rt.ProcessEvent(inc)
+	records := live.Take()
+	require.Len(t, records, 1)
+	assert.Equal(t, "inc_count", records[0].Action)
+	assert.Equal(t, map[string]any{"count": float64(1)}, records[0].Patch)
+	assert.Equal(t, 1, caller.calls)
+
+	replay := NewRecorder()
+	rt2 := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	require.NoError(t, rt2.Start(WithRecorder(context.Background(), replay)))
+	defer rt2.Stop()
+	rt2.EmbedContext()
+	replay.Replay(records)
+	rt2.ProcessEvent(inc)
+	assert.Equal(t, 1, caller.calls, "replay must not call the LLM")
+	assert.Equal(t, float64(1), rt2.Ctx().Get("count"))
+	assert.Equal(t, records, replay.Take())
+}
+
+// scriptedChat answers Chat with canned turns and keeps every request.
+type scriptedChat struct {
+	turns []*llm.ChatResponse
+	reqs  []llm.ChatRequest
+}
+
+func (c *scriptedChat) Call(ctx context.Context, cfg llm.LLMConfig, prompt string) (string, error) {
+	return "", fmt.Errorf("unexpected Call")
+}
+
+func (c *scriptedChat) Chat(ctx context.Context, cfg llm.LLMConfig, req llm.ChatRequest) (*llm.ChatResponse, error) {
+	c.reqs = append(c.reqs, req)
+	resp := c.turns[0]
+	c.turns = c.turns[1:]
+	return resp, nil
+}
+
+func TestLLMWithTools_NativeToolCalls(t *testing.T) {
+	orig := llm.DefaultCaller
+	defer func() { llm.DefaultCaller = orig }()
+	caller := &scriptedChat{turns: []*llm.ChatResponse{
+		{ToolCalls: []llm.ToolCall{
+			{ID: "call_1", Name: "parse_json", Input: map[string]any{"json": `{"a": 1}`}},
+			{ID: "call_2", Name: "bash_exec", Input: map[string]any{"command": "true"}},
+		}},
+		{Content: "Done. Here is the patch:\n```json\n{\"parsed\": true}\n```"},
+	}}
+	llm.DefaultCaller = caller
+
+	yamlStr := `
+name: tooluser
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go: {target: idle, action: work}
+actions:
+  work:
+    llm_with_tools:
+      prompt: "Parse it."
+      tools: [parse_json]
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	spec.LLM = llm.LLMConfig{Provider: "anthropic"}
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	rec := NewRecorder()
+	rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	require.NoError(t, rt.Start(WithRecorder(context.Background(), rec)))
+	defer rt.Stop()
+	rt.EmbedContext()
+	rt.ProcessEvent(statechartx.Event{ID: aug.EventIDByName["go"]})
+
+	require.Len(t, caller.reqs, 2)
+	require.Len(t, caller.reqs[0].Tools, 1)
+	assert.Equal(t, "parse_json", caller.reqs[0].Tools[0].Name)
+
+	// Both parallel calls are answered; the tool not offered to the action is refused.
+	msgs := caller.reqs[1].Messages
+	require.Len(t, msgs, 5)
+	assert.Equal(t, llm.RoleAssistant, msgs[2].Role)
+	assert.Equal(t, "call_1", msgs[3].ToolCallID)
+	assert.False(t, msgs[3].IsError)
+	assert.Equal(t, "call_2", msgs[4].ToolCallID)
+	assert.True(t, msgs[4].IsError)
+
+	assert.Equal(t, true, rt.Ctx().Get("parsed"))
+	records := rec.Take()
+	require.Len(t, records, 1)
+	require.Len(t, records[0].Tools, 2)
+	assert.Equal(t, "parse_json", records[0].Tools[0].Name)
+	assert.Empty(t, records[0].Tools[0].Error)
+	assert.NotEmpty(t, records[0].Tools[1].Error)
+}
+
+// orderLog records which actions ran, in order, through both the LLM and the hirer.
+type orderLog struct {
+	ran []string
+}
+
+func (o *orderLog) Call(ctx context.Context, cfg llm.LLMConfig, prompt string) (string, error) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(prompt, "Action '"), "'")
+	o.ran = append(o.ran, name)
+	return "{}", nil
+}
+
+func (o *orderLog) Chat(ctx context.Context, cfg llm.LLMConfig, req llm.ChatRequest) (*llm.ChatResponse, error) {
+	return &llm.ChatResponse{Content: "{}"}, nil
+}
+
+func (o *orderLog) HireAgent(template string) (string, error) {
+	o.ran = append(o.ran, "hire:"+template)
+	return template + "-1", nil
+}
+
+func (o *orderLog) HireSupervisedAgent(template string, sup Supervisor) (string, error) {
+	return o.HireAgent(template)
+}
+
+func (o *orderLog) RetireAgent(id string) error { return nil }
+
+func (o *orderLog) SendMessage(toID string, msg map[string]any) error { return nil }
+
+func (o *orderLog) QueryAgents() map[string]AgentInfo { return nil }
+
+func TestEntryExit_HierarchicalOrder(t *testing.T) {
+	orig := llm.DefaultCaller
+	defer func() { llm.DefaultCaller = orig }()
+	log := &orderLog{}
+	llm.DefaultCaller = log
+
+	yamlStr := `
+name: entry-exit
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      entry: enter_idle
+      on:
+        go: {target: work}
+    work:
+      initial: research
+      entry: [enter_work, "hire_agent:helper"]
+      exit: leave_work
+      on:
+        stop: {target: idle}
+      states:
+        research:
+          entry: [enter_research]
+          exit: [leave_research]
+actions:
+  enter_idle: "Note idle."
+  enter_work: "Start work."
+  leave_work: "Stop work."
+  enter_research: "Start research."
+  leave_research: "Stop research."
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	spec.LLM = llm.LLMConfig{Provider: "anthropic"}
+	aug, err := spec.ToAugmentedMachine(log)
+	require.NoError(t, err)
+
+	rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	require.NoError(t, rt.Start(context.Background()))
+	defer rt.Stop()
+	rt.EmbedContext()
+	assert.Equal(t, []string{"enter_idle"}, log.ran)
+
+	log.ran = nil
+	rt.ProcessEvent(statechartx.Event{ID: aug.EventIDByName["go"]})
+	assert.Equal(t, []string{"enter_work", "hire:helper", "enter_research"}, log.ran)
+
+	log.ran = nil
+	rt.ProcessEvent(statechartx.Event{ID: aug.EventIDByName["stop"]})
+	assert.Equal(t, []string{"leave_research", "leave_work", "enter_idle"}, log.ran)
+}
+
+func TestFinalStates_DoneEventsAndCompletion(t *testing.T) {
+	yamlStr := `
+name: done-events
+machine:
+  id: root
+  initial: work
+  states:
+    work:
+      initial: step
+      on:
+        done.state.root.work: {target: end}
+      states:
+        step:
+          on:
+            next: {target: finished}
+        finished:
+          type: final
+    join:
+      parallel: true
+      states:
+        left:
+          initial: left_done
+          states:
+            left_done: {type: final}
+        right:
+          type: final
+    end:
+      type: final
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	var paths []string
+	for _, c := range aug.doneConds {
+		paths = append(paths, c.path)
+	}
+	// Innermost first; the parallel join needs both regions final.
+	assert.Equal(t, []string{"root.join.left", "root.join", "root.work", "root"}, paths)
+
+	rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	require.NoError(t, aug.Start(context.Background(), rt))
+	defer rt.Stop()
+	assert.Equal(t, "root.work.step", aug.StatePathByID[rt.GetCurrentState()])
+	assert.False(t, aug.Completed(rt))
+	assert.Empty(t, aug.DoneStates(rt))
+
+	// finished -> done.state.root.work -> end, final at the root.
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["next"]})
+	assert.Equal(t, "root.end", aug.StatePathByID[rt.GetCurrentState()])
+	assert.True(t, aug.Completed(rt))
+}
+
+func TestFinalStates_RejectChildren(t *testing.T) {
+	yamlStr := `
+name: bad-final
+machine:
+  id: root
+  initial: a
+  states:
+    a:
+      type: final
+      states:
+        b: {}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	_, err = spec.ToAugmentedMachine(nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cannot have child states")
+	}
+}
+
+func TestHistoryStates_ShallowAndDeep(t *testing.T) {
+	yamlStr := `
+name: review-interrupt
+machine:
+  id: root
+  initial: work
+  states:
+    work:
+      initial: draft
+      on:
+        interrupt: {target: review}
+      states:
+        last: {history: shallow}
+        deepest: {history: deep}
+        draft:
+          on:
+            next: {target: edit}
+        edit:
+          initial: a
+          states:
+            a:
+              on:
+                deeper: {target: b}
+            b: {}
+    review:
+      on:
+        resume: {target: work.last}
+        resume_deep: {target: work.deepest}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	mem := NewHistoryMemory()
+	rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	require.NoError(t, aug.Start(WithHistoryMemory(context.Background(), mem), rt))
+	defer rt.Stop()
+	send := func(evt string) string {
+		aug.Step(rt, statechartx.Event{ID: aug.EventIDByName[evt]})
+		return aug.StatePathByID[rt.GetCurrentState()]
+	}
+
+	// Nothing remembered yet: history falls back to the parent's initial state.
+	assert.Equal(t, "root.review", send("interrupt"))
+	mem.Restore(nil)
+	assert.Equal(t, "root.work.draft", send("resume"))
+
+	send("next")
+	send("deeper")
+	assert.Equal(t, "root.review", send("interrupt"))
+	assert.Equal(t, map[string]string{
+		"root.work.last":    "root.work.edit",
+		"root.work.deepest": "root.work.edit.b",
+	}, mem.Snapshot())
+	assert.Equal(t, "root.work.edit.b", send("resume_deep"))
+
+	send("interrupt")
+	assert.Equal(t, "root.work.edit.a", send("resume"))
+
+	// A restored snapshot wins over what the runtime saw itself.
+	send("interrupt")
+	mem.Restore(map[string]string{"root.work.deepest": "root.work.draft"})
+	assert.Equal(t, "root.work.draft", send("resume_deep"))
+}
+
+func TestHistoryStates_RejectBehaviour(t *testing.T) {
+	yamlStr := `
+name: bad-history
+machine:
+  id: root
+  initial: a
+  states:
+    a:
+      states:
+        x: {}
+        h:
+          history: shallow
+          on:
+            go: {target: x}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	_, err = spec.ToAugmentedMachine(nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "history state \"root.a.h\" cannot have")
+	}
+}
+
+func TestValidate_ReportsLocatedDiagnostics(t *testing.T) {
+	yamlStr := `name: broken
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      timeout: soon
+      on:
+        go:
+          target: nowhere
+          guard: is_ready
+          action: do_it
+        check:
+          target: busy
+          guard: ctx.count <
+    busy:
+      states:
+        a: {}
+        b: {}
+    orphan: {}
+actions:
+  search:
+    llm_with_tools:
+      tools: [read_file, no_such_tool]
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+
+	var got []string
+	for _, d := range Validate(spec) {
+		got = append(got, fmt.Sprintf("%d:%d %s %s", d.Line, d.Column, d.Severity, d.Message))
+	}
+	assert.Equal(t, []string{
+		`7:7 error invalid timeout "soon": time: invalid duration "soon"`,
+		`10:11 error transition on "go" targets unknown state "nowhere"`,
+		`11:11 error undefined guard "is_ready"`,
+		`12:11 error undefined action "do_it"`,
+		`15:11 error guard "ctx.count <" does not compile: unexpected token EOF (1:11)`,
+		`16:5 warning compound state "root.busy" has no initial state; defaults to its first child "a"`,
+		`19:9 warning state "root.busy.b" is unreachable`,
+		`20:5 warning state "root.orphan" is unreachable`,
+		`24:26 error tool "no_such_tool" is not registered`,
+	}, got)
+	assert.Error(t, ValidationError(Validate(spec)))
+}
+
+func TestValidate_AcceptsValidSpec(t *testing.T) {
+	yamlStr := `name: ok
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go: {target: busy, guard: ready, action: "Say hello to the user"}
+    busy:
+      initial: a
+      timeout: 30s
+      states:
+        a:
+          on:
+            next: {target: b, guard: "ctx.count < 5"}
+        b: {}
+guards:
+  ready: "ctx.ready == true"
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	assert.Empty(t, Validate(spec))
+}
+
+func TestDocumentOrder_DefaultInitialAndStableIDs(t *testing.T) {
+	yamlStr := `
+name: ordered
+machine:
+  id: root
+  initial: work
+  states:
+    work:
+      on:
+        zulu: {target: done}
+        alpha: {target: done}
+      states:
+        zeta: {}
+        mid: {}
+        alpha: {}
+    done: {}
+`
+	var first *AugmentedMachine
+	for i := 0; i < 20; i++ {
+		spec, err := ParseSpec([]byte(yamlStr))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"zeta", "mid", "alpha"}, spec.Machine.States["work"].childIDs())
+		assert.Equal(t, []string{"zulu", "alpha"}, spec.Machine.States["work"].eventNames())
+		aug, err := spec.ToAugmentedMachine(nil)
+		require.NoError(t, err)
+
+		rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+		require.NoError(t, aug.Start(context.Background(), rt))
+		assert.Equal(t, "root.work.zeta", aug.StatePathByID[rt.GetCurrentState()])
+		rt.Stop()
+
+		if first == nil {
+			first = aug
+			continue
+		}
+		assert.Equal(t, first.StateIDByPath, aug.StateIDByPath)
+		assert.Equal(t, first.EventIDByName, aug.EventIDByName)
+	}
+}
+
+func TestTransitions_OrderedBranchesWithDefault(t *testing.T) {
+	yamlStr := `
+name: triage
+machine:
+  id: root
+  initial: waiting
+  states:
+    waiting:
+      on:
+        reply:
+          - {target: accept, guard: "evt.score > 0.8"}
+          - {target: review, guard: "evt.score > 0.4"}
+          - {target: reject}
+        skip: {target: reject}
+    accept: {}
+    review: {}
+    reject: {}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	require.Len(t, spec.Machine.States["waiting"].On["reply"], 3)
+	require.Len(t, spec.Machine.States["waiting"].On["skip"], 1)
+	assert.Empty(t, Validate(spec))
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	for score, want := range map[float64]string{0.9: "root.accept", 0.5: "root.review", 0.1: "root.reject"} {
+		rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+		require.NoError(t, aug.Start(context.Background(), rt))
+		aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["reply"], Data: map[string]any{"score": score}})
+		assert.Equal(t, want, aug.StatePathByID[rt.GetCurrentState()], "score %v", score)
+		rt.Stop()
+	}
+}
+
+func TestTransitions_WarnsAboutShadowedBranches(t *testing.T) {
+	yamlStr := `
+name: shadowed
+machine:
+  id: root
+  initial: a
+  states:
+    a:
+      on:
+        go:
+          - {target: b}
+          - {target: c, guard: "evt.ok"}
+    b: {}
+    c: {}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	diags := Validate(spec)
+	require.Len(t, diags, 1)
+	assert.Equal(t, SeverityWarning, diags[0].Severity)
+	assert.Equal(t, "machine.states.a.on.go.1", diags[0].Path)
+	assert.Equal(t, 11, diags[0].Line)
+	assert.Contains(t, diags[0].Message, "never taken")
+}
+
+func TestAssign_ExpressionsWithoutLLM(t *testing.T) {
+	yamlStr := `
+name: tally
+machine:
+  id: root
+  initial: open
+  states:
+    open:
+      entry:
+        - assign: {count: 0, label: "'open'"}
+      initial: counting
+      states:
+        counting:
+          on:
+            add:
+              target: counting
+              action: add_score
+      on:
+        close:
+          target: closed
+          action: {assign: {closed_at: "ctx.count", doubled: "ctx.count * 2"}}
+    closed: {}
+actions:
+  add_score:
+    assign:
+      count: ctx.count + evt.points
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	assert.Empty(t, Validate(spec))
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	c := statechartx.NewContext()
+	rt := statechartx.NewRuntime(aug.Machine, c)
+	require.NoError(t, aug.Start(context.Background(), rt))
+	defer rt.Stop()
+	assert.Equal(t, map[string]any{"count": 0, "label": "open"}, c.GetAll())
+
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["add"], Data: map[string]any{"points": 3}})
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["add"], Data: map[string]any{"points": 4}})
+	assert.Equal(t, 7, c.Get("count"))
+
+	// Both expressions see the context from before the action.
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["close"]})
+	assert.Equal(t, "root.closed", aug.StatePathByID[rt.GetCurrentState()])
+	assert.Equal(t, 7, c.Get("closed_at"))
+	assert.Equal(t, 14, c.Get("doubled"))
+}
+
+func TestAssign_ValidateReportsBadExpressions(t *testing.T) {
+	yamlStr := `
+name: tally
+machine:
+  id: root
+  initial: open
+  states:
+    open:
+      entry:
+        assign: {count: "ctx.count +", status: done}
+actions:
+  broken:
+    assign: [count]
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	diags := Validate(spec)
+	require.Len(t, diags, 3)
+	assert.Equal(t, "machine.states.open.entry.assign.count", diags[0].Path)
+	assert.Equal(t, 9, diags[0].Line)
+	assert.Contains(t, diags[0].Message, `assign "count" does not compile`)
+	assert.Equal(t, "machine.states.open.entry.assign.status", diags[1].Path)
+	assert.Contains(t, diags[1].Message, `assign "status" does not compile: unknown name done`)
+	assert.Equal(t, "actions.broken.assign", diags[2].Path)
+	assert.Contains(t, diags[2].Message, "assign must be a map")
+}
+
+func TestAssign_BareWordIsNotALiteral(t *testing.T) {
+	_, err := compileAssign(map[string]any{"status": "done"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `assign "status": unknown name done`)
+	}
+
+	exprs, err := compileAssign(map[string]any{"status": "'done'", "n": "ctx.n + evt.n"})
+	require.NoError(t, err)
+	got, err := evalAssign(exprs, map[string]any{"n": 1}, map[string]any{"n": 2})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"status": "done", "n": 3}, got)
+}
+
+// failingChat fails every LLM call.
+type failingChat struct{ calls int }
+
+func (c *failingChat) Call(ctx context.Context, cfg llm.LLMConfig, prompt string) (string, error) {
+	c.calls++
+	return "", fmt.Errorf("llm unavailable")
+}
+
+func (c *failingChat) Chat(ctx context.Context, cfg llm.LLMConfig, req llm.ChatRequest) (*llm.ChatResponse, error) {
+	c.calls++
+	return nil, fmt.Errorf("llm unavailable")
+}
+
+func TestActionList_OnErrorContinueAndGoto(t *testing.T) {
+	orig := llm.DefaultCaller
+	defer func() { llm.DefaultCaller = orig }()
+	caller := &failingChat{}
+	llm.DefaultCaller = caller
+
+	yamlStr := `
+name: pipeline
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go:
+          target: working
+          action:
+            - assign: {attempts: "(ctx.attempts ?? 0) + 1"}
+            - {action: note, on_error: continue}
+            - {action: summarize, on_error: goto failed}
+            - assign: {summarized: true}
+    working: {}
+    failed:
+      entry:
+        assign: {reason: "evt.action + ': ' + evt.error"}
+actions:
+  note:
+    llm_with_tools: {prompt: "Take a note."}
+  summarize:
+    llm_with_tools: {prompt: "Summarize."}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	assert.Empty(t, Validate(spec))
+	spec.LLM = llm.LLMConfig{Provider: "anthropic"}
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+	goEvt := statechartx.Event{ID: aug.EventIDByName["go"]}
+
+	rec := NewRecorder()
+	c := statechartx.NewContext()
+	rt := statechartx.NewRuntime(aug.Machine, c)
+	require.NoError(t, aug.Start(WithRecorder(context.Background(), rec), rt))
+	defer aug.Stop(rt)
+	aug.Step(rt, goEvt)
+
+	assert.Equal(t, "root.failed", aug.StatePathByID[rt.GetCurrentState()])
+	assert.Equal(t, 1, c.Get("attempts"))
+	assert.Nil(t, c.Get("summarized"), "steps after a failed goto step must not run")
+	assert.Equal(t, "summarize: llm unavailable", c.Get("reason"))
+	assert.Equal(t, 2, caller.calls)
+	records := rec.Take()
+	require.Len(t, records, 2)
+	assert.Equal(t, ActionRecord{Action: "note", Error: "llm unavailable", ErrorEvent: ErrorLLMEvent}, records[0])
+	assert.Equal(t, ActionRecord{Action: "summarize", Error: "llm unavailable", ErrorEvent: ErrorLLMEvent}, records[1])
+
+	// Replay fails the same steps from the records, without calling the LLM.
+	replay := NewRecorder()
+	c2 := statechartx.NewContext()
+	rt2 := statechartx.NewRuntime(aug.Machine, c2)
+	require.NoError(t, aug.Start(WithRecorder(context.Background(), replay), rt2))
+	defer aug.Stop(rt2)
+	replay.Replay(records)
+	aug.Step(rt2, goEvt)
+	assert.Equal(t, 2, caller.calls)
+	assert.Equal(t, "root.failed", aug.StatePathByID[rt2.GetCurrentState()])
+	assert.Equal(t, c.GetAll(), c2.GetAll())
+}
+
+func TestActionList_RaiseRunsAfterTheTransition(t *testing.T) {
+	yamlStr := `
+name: raiser
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go:
+          target: checking
+          action:
+            - assign: {n: "evt.n"}
+            - raise: {event: check, data: {limit: 3}}
+    checking:
+      on:
+        check:
+          - {target: big, guard: "ctx.n > evt.limit"}
+          - {target: small}
+    big: {}
+    small: {}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	assert.Empty(t, Validate(spec))
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	for n, want := range map[int]string{5: "root.big", 2: "root.small"} {
+		rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+		require.NoError(t, aug.Start(context.Background(), rt))
+		aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["go"], Data: map[string]any{"n": n}})
+		assert.Equal(t, want, aug.StatePathByID[rt.GetCurrentState()], "n=%d", n)
+		require.NoError(t, aug.Stop(rt))
+	}
+}
+
+func TestActionList_ValidateSteps(t *testing.T) {
+	yamlStr := `
+name: steps
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      entry:
+        - {action: undefined_step, on_error: retry}
+        - {raise: nobody_listens}
+      on:
+        go:
+          target: idle
+          action: [{raise: {data: {}}, on_error: goto nowhere}]
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	var got []string
+	for _, d := range Validate(spec) {
+		got = append(got, d.Severity+" "+d.Path)
+	}
+	assert.Equal(t, []string{
+		"error machine.states.idle.entry.0.action",
+		"error machine.states.idle.entry.0.on_error",
+		"warning machine.states.idle.entry.1.raise",
+		"error machine.states.idle.on.go.0.action.0.raise",
+		"error machine.states.idle.on.go.0.action.0.on_error",
+	}, got)
+}
+
+func TestFailures_GuardPolicyAndErrorEvents(t *testing.T) {
+	yamlTmpl := `
+name: failing
+failure_policy: %s
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go:
+          - {target: accepted, guard: "ctx.limit > 3"}
+          - {target: waiting}
+    accepted: {}
+    waiting:
+      on:
+        error.execution:
+          target: failed
+          action: {assign: {why: "evt.guard"}}
+    failed: {}
+`
+	for policy, want := range map[string]string{FailOpen: "root.accepted", FailClosed: "root.failed"} {
+		spec, err := ParseSpec([]byte(fmt.Sprintf(yamlTmpl, policy)))
+		require.NoError(t, err)
+		assert.Empty(t, Validate(spec))
+		aug, err := spec.ToAugmentedMachine(nil)
+		require.NoError(t, err)
+
+		c := statechartx.NewContext()
+		rt := statechartx.NewRuntime(aug.Machine, c)
+		require.NoError(t, aug.Start(context.Background(), rt))
+		failures := aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["go"]})
+		assert.Equal(t, want, aug.StatePathByID[rt.GetCurrentState()], policy)
+		require.Len(t, failures, 1, policy)
+		assert.Equal(t, ErrorExecutionEvent, failures[0].Event)
+		assert.Equal(t, "ctx.limit > 3", failures[0].Guard)
+		assert.NotEmpty(t, failures[0].Error)
+		if policy == FailClosed {
+			assert.Equal(t, "ctx.limit > 3", c.Get("why"))
+		}
+		require.NoError(t, aug.Stop(rt))
+	}
+
+	spec, err := ParseSpec([]byte(fmt.Sprintf(yamlTmpl, "fail_sometimes")))
+	require.NoError(t, err)
+	diags := Validate(spec)
+	require.Len(t, diags, 1)
+	assert.Equal(t, "failure_policy", diags[0].Path)
+	_, err = spec.ToAugmentedMachine(nil)
+	assert.Error(t, err)
+}
+
+func TestFailures_LLMErrorEvent(t *testing.T) {
+	orig := llm.DefaultCaller
+	defer func() { llm.DefaultCaller = orig }()
+	llm.DefaultCaller = &failingChat{}
+
+	yamlStr := `
+name: llmfail
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go: {target: working, action: summarize}
+    working:
+      on:
+        error.llm: {target: retrying}
+    retrying: {}
+actions:
+  summarize: "Summarize the conversation."
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	spec.LLM = llm.LLMConfig{Provider: "anthropic"}
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	require.NoError(t, aug.Start(context.Background(), rt))
+	defer aug.Stop(rt)
+	failures := aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["go"]})
+	assert.Equal(t, "root.retrying", aug.StatePathByID[rt.GetCurrentState()])
+	assert.Equal(t, []Failure{{Event: ErrorLLMEvent, Action: "summarize", Error: "llm unavailable"}}, failures)
+}
+
+func TestPrompts_RenderedPerInvocation(t *testing.T) {
+	orig := llm.DefaultCaller
+	defer func() { llm.DefaultCaller = orig }()
+	chat := &scriptedChat{turns: []*llm.ChatResponse{
+		{Content: `{"response": "one"}`},
+		{Content: `{"response": "two"}`},
+	}}
+	llm.DefaultCaller = chat
+
+	yamlStr := `
+name: asker
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        ask: {target: idle, action: answer}
+        broken: {target: idle, action: {llm_with_tools: {prompt: "{{.Event.Data.q | nope}}"}}}
+actions:
+  answer:
+    llm_with_tools:
+      system: "You work for {{.App.CompanyName}} on {{.Machine}}/{{.Instance}}."
+      prompt: "{{.Event.Name}} in {{.From}} -> {{.To}}: {{.Event.Data.q}} (seen: {{.Context.response}})"
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	spec.App = &config.AppConfig{CompanyName: "Acme"}
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+	diags := Validate(spec)
+	require.Len(t, diags, 1)
+	assert.Equal(t, "machine.states.idle.on.broken.0.action.llm_with_tools.prompt", diags[0].Path)
+
+	rt := statechartx.NewRuntime(aug.Machine, statechartx.NewContext())
+	ctx := WithInstance(context.Background(), InstanceRef{Machine: "root", ID: "i1"})
+	require.NoError(t, aug.Start(ctx, rt))
+	defer aug.Stop(rt)
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["ask"], Data: map[string]any{"q": "first"}})
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["ask"], Data: map[string]any{"q": "second"}})
+	require.Len(t, chat.reqs, 2)
+	assert.Contains(t, chat.reqs[0].Messages[0].Content, "You work for Acme on root/i1.")
+	assert.Contains(t, chat.reqs[0].Messages[1].Content, "ask in root.idle -> root.idle: first (seen: <no value>)")
+	assert.Contains(t, chat.reqs[1].Messages[1].Content, "ask in root.idle -> root.idle: second (seen: one)")
+
+	failures := aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["broken"]})
+	require.Len(t, failures, 1)
+	assert.Equal(t, ErrorExecutionEvent, failures[0].Event)
+	assert.Contains(t, failures[0].Error, `template: llm_with_tools.prompt:1: function "nope" not defined`)
+}
+
+func TestSend_DelayedAndCancel(t *testing.T) {
+	yamlStr := `
+name: reminder
+machine:
+  id: root
+  initial: waiting
+  states:
+    waiting:
+      entry:
+        - send: {event: remind, delay: 10m, id: reminder, data: {note: ping}}
+        - send: {event: hello, target: other/i1}
+      on:
+        remind: {target: waiting}
+        reply:
+          target: done
+          action: {cancel: reminder}
+    done: {}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	assert.Empty(t, Validate(spec))
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	ft := &fakeTimers{scheduled: map[string]time.Duration{}, events: map[string]string{}}
+	rt := statechartx.NewRuntime(aug.Machine, nil)
+	require.NoError(t, aug.Start(WithTimerScheduler(context.Background(), ft), rt))
+	defer aug.Stop(rt)
+
+	require.Len(t, ft.sends, 2)
+	assert.Equal(t, scheduledSend{ID: "reminder", Event: "remind", Data: map[string]any{"note": "ping"}, Delay: 10 * time.Minute}, ft.sends[0])
+	assert.Equal(t, "other/i1", ft.sends[1].Target)
+	assert.Equal(t, "hello", ft.sends[1].Event)
+	assert.NotEmpty(t, ft.sends[1].ID, "sends without an id get a generated one")
+	assert.Zero(t, ft.sends[1].Delay)
+
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["reply"]})
+	assert.Equal(t, []string{"send:reminder"}, ft.cancelled)
+
+	bad, err := ParseSpec([]byte(`
+name: bad
+machine:
+  id: root
+  initial: a
+  states:
+    a:
+      entry: [{send: {event: ping, delay: soon}}, {send: nobody}, {cancel: ""}]
+      on:
+        ping: {target: a}
+`))
+	require.NoError(t, err)
+	var got []string
+	for _, d := range Validate(bad) {
+		got = append(got, d.Severity+" "+d.Path)
+	}
+	assert.Equal(t, []string{
+		"error machine.states.a.entry.0.send",
+		"warning machine.states.a.entry.1.send",
+		"error machine.states.a.entry.2.cancel",
+	}, got)
+}
+
+type fakeInvoker struct {
+	invoked   map[string]string
+	data      map[string]map[string]any
+	cancelled []string
+}
+
+func (f *fakeInvoker) Invoke(id, machine string, data map[string]any) error {
+	f.invoked[id] = machine
+	f.data[id] = data
+	return nil
+}
+
+func (f *fakeInvoker) CancelInvoke(id string) {
+	f.cancelled = append(f.cancelled, id)
+}
+
+func TestInvoke_StartsChildOnEntryCancelsOnExit(t *testing.T) {
+	yamlStr := `
+name: team
+machine:
+  id: root
+  initial: working
+  states:
+    working:
+      invoke:
+        id: writer
+        machine: drafter
+        data:
+          topic: ctx.topic
+          words: 300
+      on:
+        done.invoke.writer:
+          target: reviewed
+          action: {assign: {draft: evt.draft}}
+        abort: {target: reviewed}
+    reviewed:
+      invoke: {machine: reviewer}
+`
+	spec, err := ParseSpec([]byte(yamlStr))
+	require.NoError(t, err)
+	assert.Empty(t, Validate(spec))
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+	require.Contains(t, aug.EventIDByName, DoneInvokeEventPrefix+"writer")
+
+	inv := &fakeInvoker{invoked: map[string]string{}, data: map[string]map[string]any{}}
+	initial := statechartx.NewContext()
+	initial.LoadAll(map[string]any{"topic": "otters"})
+	rt := statechartx.NewRuntime(aug.Machine, initial)
+	require.NoError(t, aug.Start(WithInvoker(context.Background(), inv), rt))
+	defer aug.Stop(rt)
+
+	assert.Equal(t, "drafter", inv.invoked["writer"])
+	assert.Equal(t, map[string]any{"topic": "otters", "words": 300}, inv.data["writer"])
+
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName[DoneInvokeEventPrefix+"writer"], Data: map[string]any{"draft": "..."}})
+	assert.Equal(t, []string{"writer"}, inv.cancelled)
+	assert.Equal(t, "...", rt.Ctx().Get("draft"))
+	assert.Equal(t, "reviewer", inv.invoked["root.reviewed"], "the invoke ID defaults to the state path")
+
+	bad, err := ParseSpec([]byte(`
+name: bad
+machine:
+  id: root
+  initial: a
+  states:
+    a:
+      invoke: {data: {n: ctx.n +}}
+`))
+	require.NoError(t, err)
+	var got []string
+	for _, d := range Validate(bad) {
+		got = append(got, d.Severity+" "+d.Path)
+	}
+	assert.Equal(t, []string{
+		"error machine.states.a.invoke",
+		"error machine.states.a.invoke.data.n",
+	}, got)
+}
+
+func TestPlanMigration_MapsStatesAndContext(t *testing.T) {
+	oldSpec, err := ParseSpec([]byte(`
+name: review
+version: "1.0"
+machine:
+  id: root
+  initial: idle
+  states:
+    idle: {on: {go: {target: review}}}
+    review:
+      initial: draft
+      states:
+        draft: {on: {next: {target: check}}}
+        check: {}
+    legacy: {}
+`))
+	require.NoError(t, err)
+	old, err := oldSpec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+	spec, err := ParseSpec([]byte(`
+name: review
+version: "2.0"
+machine:
+  id: root
+  initial: idle
+  states:
+    idle: {on: {go: {target: editing}}}
+    editing:
+      initial: draft
+      states:
+        draft: {}
+    archived: {}
+migrations:
+  - from: "*"
+  - from: "1.0"
+    states:
+      root.review: root.editing
+      root.review.check: root.archived
+    context:
+      attempts: (ctx.tries ?? 0) + 1
+      schema: 2
+    drop: [tries]
+`))
+	require.NoError(t, err)
+	assert.Empty(t, Validate(spec))
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	m := spec.MigrationFrom("1.0")
+	require.NotNil(t, m)
+	assert.Equal(t, "1.0", m.From)
+	assert.Equal(t, AnyVersion, spec.MigrationFrom("0.9").From)
+	assert.Nil(t, oldSpec.MigrationFrom("0.9"))
+
+	ctx := map[string]any{"tries": 2, "topic": "go"}
+	plan := aug.PlanMigration(old, m, "root.review.draft", ctx, nil)
+	assert.True(t, plan.Ready())
+	assert.Equal(t, "root.editing.draft", plan.ToState)
+	assert.Equal(t, []string{"root.legacy"}, plan.Unmapped)
+	assert.Equal(t, map[string]any{"attempts": 3, "schema": 2, "topic": "go"}, plan.Context)
+	assert.Equal(t, 2, ctx["tries"], "the old context is left alone")
+
+	plan = aug.PlanMigration(old, m, "root.review.check", ctx, nil)
+	assert.Equal(t, "root.archived", plan.ToState)
+	// A mapped compound state takes descendants the new one lacks to itself.
+	plan = aug.PlanMigration(old, &Migration{States: map[string]string{"root.review": "root.editing"}}, "root.review.check", ctx, nil)
+	assert.Equal(t, "root.editing", plan.ToState)
+
+	plan = aug.PlanMigration(old, m, "root.legacy", ctx, nil)
+	assert.False(t, plan.Ready())
+	assert.Equal(t, []string{`state "root.legacy" is not mapped`}, plan.Errors)
+
+	// Without a migration only unchanged paths carry over.
+	plan = aug.PlanMigration(old, nil, "root.idle", ctx, nil)
+	assert.True(t, plan.Ready())
+	assert.Equal(t, []string{"root.legacy", "root.review", "root.review.check", "root.review.draft"}, plan.Unmapped)
+	assert.Equal(t, ctx, plan.Context)
+}
+
+func TestPlanMigration_MapsHistoryMemory(t *testing.T) {
+	build := func(src string) *AugmentedMachine {
+		spec, err := ParseSpec([]byte(src))
+		require.NoError(t, err)
+		aug, err := spec.ToAugmentedMachine(nil)
+		require.NoError(t, err)
+		return aug
+	}
+	old := build(`
+name: work
+machine:
+  id: root
+  initial: work
+  states:
+    work:
+      initial: a
+      states:
+        a: {}
+        b: {}
+        hist: {history: shallow}
+    other:
+      initial: x
+      states:
+        x: {}
+        y: {}
+        h: {history: shallow}
+`)
+	aug := build(`
+name: work
+machine:
+  id: root
+  initial: work
+  states:
+    work:
+      initial: a
+      states:
+        a: {}
+        bee: {}
+        hist: {history: shallow}
+    other: {}
+`)
+	m := &Migration{States: map[string]string{"root.work.b": "root.work.bee"}}
+	plan := aug.PlanMigration(old, m, "root.work.a", nil, map[string]string{
+		"root.work.hist": "root.work.b",
+		"root.other.h":   "root.other.y",
+	})
+	assert.True(t, plan.Ready())
+	assert.Equal(t, map[string]string{"root.work.hist": "root.work.bee"}, plan.Remembered)
+	assert.Equal(t, []string{"root.other.h"}, plan.Forgotten)
+}
+
+func TestValidate_Migrations(t *testing.T) {
+	spec, err := ParseSpec([]byte(`name: review
+machine:
+  id: root
+  initial: idle
+  states:
+    idle: {}
+migrations:
+  - states:
+      root.old: root.gone
+    context:
+      n: ctx.n +
+      status: done
+`))
+	require.NoError(t, err)
+	var got []string
+	for _, d := range Validate(spec) {
+		got = append(got, fmt.Sprintf("%d:%d %s", d.Line, d.Column, d.Message))
+	}
+	require.Len(t, got, 4)
+	assert.Equal(t, `8:5 migration has no from version (use "*" for any)`, got[0])
+	assert.Equal(t, `9:7 unknown state "root.gone"`, got[1])
+	assert.Contains(t, got[2], `11:7 migration context "n" does not compile: unexpected token EOF`)
+	assert.Contains(t, got[3], `12:7 migration context "status" does not compile: unknown name done`)
+}
+
+func TestResume_SkipsEntryActionsOfStartState(t *testing.T) {
+	spec, err := ParseSpec([]byte(`name: resume
+machine:
+  id: root
+  initial: idle
+  states:
+    idle:
+      on:
+        go: {target: busy}
+    busy:
+      timeout: 1m
+      entry:
+        - assign: {entered: "(ctx.entered ?? 0) + 1"}
+      on:
+        again: {target: busy}
+        timeout: {target: idle}
+`))
+	require.NoError(t, err)
+	aug, err := spec.ToAugmentedMachine(nil)
+	require.NoError(t, err)
+
+	c := statechartx.NewContext()
+	rt := statechartx.NewRuntime(aug.Machine, c)
+	rt.SetCurrentState(aug.StateIDByPath["root.busy"])
+	timers := &fakeTimers{scheduled: map[string]time.Duration{}, events: map[string]string{}}
+	require.NoError(t, aug.Resume(WithTimerScheduler(context.Background(), timers), rt))
+	defer aug.Stop(rt)
+	assert.Equal(t, "root.busy", aug.StatePathByID[rt.GetCurrentState()])
+	assert.Nil(t, c.Get("entered"), "entry: actions are skipped")
+	assert.Equal(t, map[string]time.Duration{"root.busy": time.Minute}, timers.scheduled, "the state's timeout is armed")
+
+	// Entering the state again after the resume runs its entry actions.
+	aug.Step(rt, statechartx.Event{ID: aug.EventIDByName["again"]})
+	assert.Equal(t, 1, c.Get("entered"))
+}
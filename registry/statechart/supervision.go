@@ -0,0 +1,69 @@
+package statechart
+
+import (
+	"fmt"
+	"time"
+)
+
+// Events delivered to a supervisor when one of its agents fails; evt.Data is
+// {agent, template, error}. error.agent.escalated means the supervisor gave up
+// after too many restarts and retired the agents the strategy covers.
+const (
+	ErrorAgentEvent          = "error.agent"
+	ErrorAgentEscalatedEvent = "error.agent.escalated"
+)
+
+// Restart strategies (`supervision.strategy:`): restart only the failed agent
+// (one_for_one, the default) or every agent of the same supervisor (one_for_all).
+const (
+	OneForOne = "one_for_one"
+	OneForAll = "one_for_all"
+)
+
+// Supervision defaults, as for an Erlang supervisor.
+const (
+	DefaultMaxRestarts   = 3
+	DefaultRestartWindow = time.Minute
+)
+
+// Supervision is how the agents a machine hires are restarted when they fail.
+type Supervision struct {
+	Strategy    string `yaml:"strategy,omitempty" json:"strategy,omitempty"`        // one_for_one (default) or one_for_all
+	MaxRestarts int    `yaml:"max_restarts,omitempty" json:"maxRestarts,omitempty"` // restarts allowed within Within, default 3
+	Within      string `yaml:"within,omitempty" json:"within,omitempty"`            // restart window, default 1m
+}
+
+// StrategyOrDefault returns the restart strategy, one_for_one if unset.
+func (s Supervision) StrategyOrDefault() string {
+	if s.Strategy == "" {
+		return OneForOne
+	}
+	return s.Strategy
+}
+
+// Limit returns how many restarts are allowed within which window.
+func (s Supervision) Limit() (int, time.Duration, error) {
+	max, window := s.MaxRestarts, DefaultRestartWindow
+	if max <= 0 {
+		max = DefaultMaxRestarts
+	}
+	if s.Within != "" {
+		d, err := time.ParseDuration(s.Within)
+		if err != nil {
+			return 0, 0, fmt.Errorf("within: %w", err)
+		}
+		if d <= 0 {
+			return 0, 0, fmt.Errorf("within %q is not positive", s.Within)
+		}
+		window = d
+	}
+	return max, window, nil
+}
+
+// Supervisor identifies who supervises a hired agent and how.
+type Supervisor struct {
+	// Target is the hiring instance ("mid/iid"), the hiring agent
+	// ("agent:<id>"), or empty for the root supervisor.
+	Target      string      `json:"target,omitempty"`
+	Supervision Supervision `json:"supervision,omitempty"`
+}
@@ -0,0 +1,62 @@
+package statechart
+
+import (
+	"context"
+	"time"
+
+	"github.com/comalice/statechartx"
+)
+
+// DefaultTimeoutEvent is delivered when a state's timeout elapses and no timeout_event is set.
+const DefaultTimeoutEvent = "timeout"
+
+// TimerScheduler arms and cancels the timers of one running instance: state
+// timeouts and delayed sends. The owning instance carries it in the context
+// passed to Runtime.Start.
+type TimerScheduler interface {
+	// ScheduleTimeout arms a timer that delivers event to the instance after d.
+	// Re-arming the same state replaces the previous timer.
+	ScheduleTimeout(state, event string, d time.Duration)
+	// CancelTimeout disarms the timer for state, if any.
+	CancelTimeout(state string)
+	// ScheduleSend delivers event with data to target (the instance itself
+	// if empty) after d. Scheduling the same ID again replaces the pending send.
+	ScheduleSend(id, target, event string, data any, d time.Duration)
+	// CancelSend drops the pending send with the given ID, if any.
+	CancelSend(id string)
+}
+
+type timerSchedulerKey struct{}
+
+// WithTimerScheduler returns a context whose state entry/exit actions arm timers on ts.
+func WithTimerScheduler(ctx context.Context, ts TimerScheduler) context.Context {
+	return context.WithValue(ctx, timerSchedulerKey{}, ts)
+}
+
+func timerSchedulerFrom(ctx context.Context) TimerScheduler {
+	if ctx == nil {
+		return nil
+	}
+	ts, _ := ctx.Value(timerSchedulerKey{}).(TimerScheduler)
+	return ts
+}
+
+// timeoutEntryAction arms the state's timer on entry.
+func timeoutEntryAction(statePath, event string, d time.Duration) statechartx.Action {
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if ts := timerSchedulerFrom(ctx); ts != nil {
+			ts.ScheduleTimeout(statePath, event, d)
+		}
+		return nil
+	}
+}
+
+// timeoutExitAction disarms the state's timer on exit.
+func timeoutExitAction(statePath string) statechartx.Action {
+	return func(ctx context.Context, evt *statechartx.Event, from, to statechartx.StateID) error {
+		if ts := timerSchedulerFrom(ctx); ts != nil {
+			ts.CancelTimeout(statePath)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+package statechart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/comalice/maelstrom/internal/llm"
+	"github.com/comalice/maelstrom/internal/tools"
+)
+
+// chatTools converts registry tool schemas into native LLM tool definitions.
+func chatTools(schemas []tools.ToolSchema) []llm.Tool {
+	if len(schemas) == 0 {
+		return nil
+	}
+	out := make([]llm.Tool, 0, len(schemas))
+	for _, ts := range schemas {
+		out = append(out, llm.Tool{Name: ts.Name, Description: ts.Description, InputSchema: ts.InputSchema})
+	}
+	return out
+}
+
+// runToolCall executes one model-requested tool call and returns its record and
+// the tool_result message. Tools not offered to the action are refused.
+func runToolCall(ctx context.Context, offered []tools.ToolSchema, tc llm.ToolCall) (ToolRecord, llm.Message) {
+	rec := ToolRecord{Name: tc.Name, Params: tc.Input}
+	msg := llm.Message{Role: llm.RoleTool, ToolCallID: tc.ID}
+
+	var tool tools.Tool
+	if slices.ContainsFunc(offered, func(ts tools.ToolSchema) bool { return ts.Name == tc.Name }) {
+		tool = tools.GlobalTools.Get(tc.Name)
+	}
+	if tool == nil {
+		rec.Error = fmt.Sprintf("tool %q is not available", tc.Name)
+		msg.Content, msg.IsError = rec.Error, true
+		return rec, msg
+	}
+
+	params := tc.Input
+	if params == nil {
+		params = map[string]any{}
+	}
+	res, err := tool.Execute(ctx, params)
+	rec.Result = res
+	if err != nil {
+		rec.Error = err.Error()
+		msg.Content, msg.IsError = rec.Error, true
+		return rec, msg
+	}
+	resJSON, _ := json.Marshal(tools.Result{Content: res})
+	msg.Content = string(resJSON)
+	return rec, msg
+}
+
+// parseJSONObject decodes a final answer into a context patch, tolerating
+// prose or code fences around the object.
+func parseJSONObject(s string) (map[string]any, error) {
+	var out map[string]any
+	if err := json.Unmarshal([]byte(s), &out); err == nil {
+		return out, nil
+	}
+	start, end := strings.Index(s, "{"), strings.LastIndex(s, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON object in response")
+	}
+	if err := json.Unmarshal([]byte(s[start:end+1]), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,570 @@
+package statechart
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/comalice/maelstrom/internal/tools"
+	"github.com/expr-lang/expr"
+	"gopkg.in/yaml.v3"
+)
+
+// Diagnostic severities. Specs with error diagnostics are not activated.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is one problem found by Validate, located in the YAML source.
+// Line and Column are 1-based; they are 0 when the spec was not parsed from YAML.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path"`
+	File     string `json:"file,omitempty"` // registry file Line and Column are in, if the node was composed from another file
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Message  string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	if d.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s: %s (%s)", d.File, d.Line, d.Column, d.Severity, d.Message, d.Path)
+	}
+	return fmt.Sprintf("%d:%d: %s: %s (%s)", d.Line, d.Column, d.Severity, d.Message, d.Path)
+}
+
+// ValidationError returns an error listing the error diagnostics, or nil if there are none.
+func ValidationError(diags []Diagnostic) error {
+	var errs []error
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			errs = append(errs, errors.New(d.String()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// guardEnv types the variables a guard expression can use, so unknown names fail to compile.
+type guardEnv struct {
+	Ctx map[string]any `expr:"ctx"`
+	Evt any            `expr:"evt"`
+}
+
+// actionNameRe matches strings that name an action rather than being an inline prompt.
+var actionNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate checks spec without building it: unknown transition targets,
+// unreachable states, undefined or uncompilable guards, undefined actions,
+// compound states without an initial state, bad durations, assign and invoke
+// data expressions that do not compile and llm_with_tools tools missing from the tool registry. Diagnostics are ordered by position.
+func Validate(spec *YamlMachineSpec) []Diagnostic {
+	return validate(spec, false)
+}
+
+// ValidateAgent is Validate for an agent template. Agents run outside the
+// instance store and have no timers or children, so state timeouts, send:,
+// cancel: and invoke: are errors instead of being silently dropped.
+func ValidateAgent(spec *YamlMachineSpec) []Diagnostic {
+	return validate(spec, true)
+}
+
+func validate(spec *YamlMachineSpec, agent bool) []Diagnostic {
+	v := &validator{spec: spec, agent: agent, states: make(map[string]YamlState), keys: make(map[string][]string),
+		events: make(map[string]bool), gotos: make(map[string][]string)}
+	v.run()
+	sort.SliceStable(v.diags, func(i, j int) bool {
+		if v.diags[i].Line != v.diags[j].Line {
+			return v.diags[i].Line < v.diags[j].Line
+		}
+		return v.diags[i].Column < v.diags[j].Column
+	})
+	return v.diags
+}
+
+type validator struct {
+	spec   *YamlMachineSpec
+	agent  bool                 // spec is an agent template
+	states map[string]YamlState // full path -> state
+	keys   map[string][]string  // full path -> YAML key path of the state
+	events map[string]bool      // events some transition handles
+	gotos  map[string][]string  // full path -> on_error goto targets of its actions
+	diags  []Diagnostic
+}
+
+func (v *validator) report(severity string, keys []string, format string, args ...any) {
+	line, col, file := locate(v.spec.node, v.spec.origins, keys)
+	v.diags = append(v.diags, Diagnostic{
+		Severity: severity,
+		Path:     strings.Join(keys, "."),
+		File:     file,
+		Line:     line,
+		Column:   col,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// notForAgents reports construct as an error in agent templates and reports
+// whether it did.
+func (v *validator) notForAgents(construct string, keys []string) bool {
+	if v.agent {
+		v.report(SeverityError, keys, "%s is not supported in agent templates", construct)
+	}
+	return v.agent
+}
+
+func (v *validator) run() {
+	m := v.spec.Machine
+	if m.ID == "" {
+		v.report(SeverityError, []string{"machine", "id"}, "machine has no id")
+		return
+	}
+	if p := v.spec.FailurePolicy; p != "" && p != FailOpen && p != FailClosed {
+		v.report(SeverityError, []string{"failure_policy"}, "unknown failure_policy %q (want %q or %q)", p, FailOpen, FailClosed)
+	}
+	if v.spec.CostPerHour < 0 {
+		v.report(SeverityError, []string{"cost_per_hour"}, "cost_per_hour %v is negative", v.spec.CostPerHour)
+	}
+	if sup := v.spec.Supervision; sup != nil {
+		if st := sup.StrategyOrDefault(); st != OneForOne && st != OneForAll {
+			v.report(SeverityError, []string{"supervision", "strategy"}, "unknown strategy %q (want %q or %q)", st, OneForOne, OneForAll)
+		}
+		if sup.MaxRestarts < 0 {
+			v.report(SeverityError, []string{"supervision", "max_restarts"}, "max_restarts %d is negative", sup.MaxRestarts)
+		}
+		if _, _, err := sup.Limit(); err != nil {
+			v.report(SeverityError, []string{"supervision", "within"}, "%v", err)
+		}
+	}
+	v.states[m.ID] = m.root()
+	v.keys[m.ID] = []string{"machine"}
+	v.collect(m.ID, []string{"machine"}, m.States)
+	v.checkMigrations()
+
+	if m.Initial == "" {
+		v.report(SeverityError, []string{"machine", "initial"}, "machine has no initial state")
+	} else if _, ok := m.States[m.Initial]; !ok {
+		v.report(SeverityError, []string{"machine", "initial"}, "initial state %q not found", m.Initial)
+	}
+	v.checkStates(m.ID, m.root())
+
+	names := sortedKeys(v.spec.Guards)
+	for _, name := range names {
+		if _, err := expr.Compile(v.spec.Guards[name], expr.AsBool(), expr.Env(guardEnv{})); err != nil {
+			v.report(SeverityError, []string{"guards", name}, "guard %q does not compile: %v", name, firstLine(err))
+		}
+	}
+	for _, name := range sortedKeys(v.spec.Actions) {
+		v.checkActionContent(v.spec.Actions[name], []string{"actions", name})
+	}
+	v.checkReachable()
+}
+
+func (v *validator) collect(prefix string, keys []string, states map[string]YamlState) {
+	for id, st := range states {
+		path := prefix + "." + id
+		stKeys := append(append([]string(nil), keys...), "states", id)
+		v.states[path] = st
+		v.keys[path] = stKeys
+		for evt := range st.On {
+			v.events[evt] = true
+		}
+		v.collect(path, stKeys, st.States)
+	}
+}
+
+// checkMigrations reports migrations without a from version, targets that are
+// not states of this spec and context expressions that do not compile.
+func (v *validator) checkMigrations() {
+	for i, m := range v.spec.Migrations {
+		at := func(more ...string) []string {
+			return append([]string{"migrations", strconv.Itoa(i)}, more...)
+		}
+		if m.From == "" {
+			v.report(SeverityError, at("from"), "migration has no from version (use %q for any)", AnyVersion)
+		}
+		for _, old := range sortedKeys(m.States) {
+			if _, ok := v.states[m.States[old]]; !ok {
+				v.report(SeverityError, at("states", old), "unknown state %q", m.States[old])
+			}
+		}
+		v.checkExprs(m.Context, at("context"), "migration context")
+	}
+}
+
+func (v *validator) checkStates(prefix string, parent YamlState) {
+	for _, id := range parent.childIDs() {
+		st := parent.States[id]
+		path := prefix + "." + id
+		keys := v.keys[path]
+		at := func(more ...string) []string {
+			return append(append([]string(nil), keys...), more...)
+		}
+		if len(st.States) > 0 && !st.IsParallel {
+			if st.Initial == "" {
+				v.report(SeverityWarning, keys, "compound state %q has no initial state; defaults to its first child %q", path, st.initialChild())
+			} else if _, ok := st.States[st.Initial]; !ok {
+				v.report(SeverityError, at("initial"), "initial state %q of %q not found", st.Initial, path)
+			}
+		}
+		if st.Timeout != "" && !v.notForAgents("timeout", at("timeout")) {
+			if d, err := time.ParseDuration(st.Timeout); err != nil {
+				v.report(SeverityError, at("timeout"), "invalid timeout %q: %v", st.Timeout, err)
+			} else if d <= 0 {
+				v.report(SeverityError, at("timeout"), "timeout %q must be positive", st.Timeout)
+			}
+		}
+		for _, evt := range st.eventNames() {
+			for i, trans := range st.On[evt] {
+				tk := at("on", evt, strconv.Itoa(i))
+				target := v.spec.resolveTarget(prefix, path, trans.Target)
+				if _, ok := v.states[target]; !ok || trans.Target == "" {
+					v.report(SeverityError, append(tk, "target"), "transition on %q targets unknown state %q", evt, trans.Target)
+				}
+				if i > 0 && st.On[evt][i-1].Guard == "" {
+					v.report(SeverityWarning, tk, "transition on %q is never taken: an earlier one has no guard", evt)
+				}
+				v.checkGuard(trans.Guard, append(tk, "guard"))
+				v.checkActionList(trans.Action, append(tk, "action"), prefix, path)
+			}
+		}
+		v.checkActionList(st.Entry, at("entry"), prefix, path)
+		v.checkActionList(st.Exit, at("exit"), prefix, path)
+		if st.Invoke != nil && !v.notForAgents("invoke", at("invoke")) {
+			v.checkInvoke(*st.Invoke, at("invoke"))
+		}
+		v.checkStates(path, st)
+	}
+}
+
+func (v *validator) checkGuard(name string, keys []string) {
+	if name == "" {
+		return
+	}
+	if _, ok := v.spec.Guards[name]; ok {
+		return
+	}
+	if _, err := expr.Compile(name, expr.AsBool(), expr.Env(guardEnv{})); err != nil {
+		if actionNameRe.MatchString(name) {
+			v.report(SeverityError, keys, "undefined guard %q", name)
+			return
+		}
+		v.report(SeverityError, keys, "guard %q does not compile: %v", name, firstLine(err))
+	}
+}
+
+// checkActionList checks the steps of an action list used by the state at path.
+func (v *validator) checkActionList(spec any, keys []string, prefix, path string) {
+	if list, ok := spec.([]any); ok {
+		for i, a := range list {
+			v.checkStep(a, append(append([]string(nil), keys...), strconv.Itoa(i)), prefix, path)
+		}
+		return
+	}
+	v.checkStep(spec, keys, prefix, path)
+}
+
+func (v *validator) checkStep(spec any, keys []string, prefix, path string) {
+	step, ok := spec.(map[string]any)
+	if !ok {
+		v.checkAction(spec, keys)
+		return
+	}
+	at := func(more ...string) []string {
+		return append(append([]string(nil), keys...), more...)
+	}
+	if onError, has := step["on_error"]; has {
+		s, _ := onError.(string)
+		policy, target, err := parseOnError(s)
+		switch {
+		case err != nil:
+			v.report(SeverityError, at("on_error"), "%v", err)
+		case policy == OnErrorGoto:
+			full := v.spec.resolveTarget(prefix, path, target)
+			if _, ok := v.states[full]; !ok {
+				v.report(SeverityError, at("on_error"), "on_error goes to unknown state %q", target)
+			} else {
+				v.gotos[path] = append(v.gotos[path], full)
+			}
+		}
+	}
+	if name, has := step["action"]; has {
+		if _, ok := name.(string); !ok {
+			v.report(SeverityError, at("action"), "action must be the name of an action, got %T", name)
+			return
+		}
+		v.checkAction(name, at("action"))
+		return
+	}
+	v.checkAction(step, keys)
+}
+
+// checkAction checks an action reference; named actions are checked once, from the actions map.
+func (v *validator) checkAction(spec any, keys []string) {
+	name, ok := spec.(string)
+	if !ok {
+		v.checkActionContent(spec, keys)
+		return
+	}
+	if _, defined := v.spec.Actions[name]; defined {
+		return
+	}
+	for _, prefix := range []string{"hire_agent:", "retire_agent:"} {
+		if arg, system := strings.CutPrefix(name, prefix); system {
+			if arg == "" {
+				v.report(SeverityError, keys, "system action %q has no argument", name)
+			}
+			return
+		}
+	}
+	if actionNameRe.MatchString(name) {
+		v.report(SeverityError, keys, "undefined action %q", name)
+		return
+	}
+	// Anything else is an inline prompt.
+	v.checkPrompt(name, keys)
+}
+
+// checkPrompt reports a prompt that cannot be parsed as a template.
+func (v *validator) checkPrompt(text string, keys []string) {
+	if p := v.spec.newPromptTemplate("prompt", text); p.err != nil {
+		v.report(SeverityError, keys, "invalid prompt template: %v", p.err)
+	}
+}
+
+func (v *validator) checkActionContent(content any, keys []string) {
+	switch c := content.(type) {
+	case nil:
+	case string:
+		v.checkPrompt(c, keys)
+	case map[string]any:
+		if assign, has := c["assign"]; has {
+			v.checkAssign(assign, append(append([]string(nil), keys...), "assign"))
+			return
+		}
+		if event, has := c["raise"]; has {
+			v.checkRaise(event, append(append([]string(nil), keys...), "raise"))
+			return
+		}
+		if send, has := c["send"]; has {
+			if v.notForAgents("send", append(append([]string(nil), keys...), "send")) {
+				return
+			}
+			v.checkSend(send, append(append([]string(nil), keys...), "send"))
+			return
+		}
+		if id, has := c["cancel"]; has {
+			if v.notForAgents("cancel", append(append([]string(nil), keys...), "cancel")) {
+				return
+			}
+			if s, _ := id.(string); s == "" {
+				v.report(SeverityError, append(append([]string(nil), keys...), "cancel"), "cancel needs the id of a send")
+			}
+			return
+		}
+		if c["type"] == "llm" {
+			for _, key := range []string{"system", "prompt"} {
+				v.checkPrompt(getString(c, key), append(append([]string(nil), keys...), key))
+			}
+			return
+		}
+		lwt, ok := c["llm_with_tools"].(map[string]any)
+		if !ok {
+			return
+		}
+		for _, key := range []string{"system", "prompt"} {
+			v.checkPrompt(getString(lwt, key), append(append([]string(nil), keys...), "llm_with_tools", key))
+		}
+		list, _ := lwt["tools"].([]any)
+		for i, t := range list {
+			name, _ := t.(string)
+			if tools.GlobalTools != nil && tools.GlobalTools.Get(name) == nil {
+				v.report(SeverityError, append(append([]string(nil), keys...), "llm_with_tools", "tools", strconv.Itoa(i)),
+					"tool %q is not registered", name)
+			}
+		}
+	default:
+		v.report(SeverityWarning, keys, "unsupported action of type %T is ignored", content)
+	}
+}
+
+func (v *validator) checkAssign(spec any, keys []string) {
+	fields, ok := spec.(map[string]any)
+	if !ok {
+		v.report(SeverityError, keys, "assign must be a map of context keys to expressions, got %T", spec)
+		return
+	}
+	v.checkExprs(fields, keys, "assign")
+}
+
+// checkExprs reports the string values of fields that do not compile as
+// assign expressions, such as bare words meant as string literals.
+func (v *validator) checkExprs(fields map[string]any, keys []string, what string) {
+	for _, key := range sortedKeys(fields) {
+		src, isExpr := fields[key].(string)
+		if !isExpr {
+			continue
+		}
+		if _, err := compileAssignExpr(src); err != nil {
+			v.report(SeverityError, append(append([]string(nil), keys...), key), "%s %q does not compile: %v", what, key, firstLine(err))
+		}
+	}
+}
+
+func (v *validator) checkRaise(spec any, keys []string) {
+	name, _ := raiseSpec(spec)
+	if name == "" {
+		v.report(SeverityError, keys, "raise has no event name")
+		return
+	}
+	if !v.events[name] {
+		v.report(SeverityWarning, keys, "raised event %q has no transition", name)
+	}
+}
+
+func (v *validator) checkSend(spec any, keys []string) {
+	s, err := parseSend(spec)
+	if err != nil {
+		v.report(SeverityError, keys, "%v", err)
+		return
+	}
+	if s.Target == "" && !v.events[s.Event] {
+		v.report(SeverityWarning, keys, "sent event %q has no transition", s.Event)
+	}
+}
+
+func (v *validator) checkInvoke(inv YamlInvoke, keys []string) {
+	at := func(more ...string) []string {
+		return append(append([]string(nil), keys...), more...)
+	}
+	if inv.Machine == "" {
+		v.report(SeverityError, keys, "invoke has no machine")
+	}
+	v.checkExprs(inv.Data, at("data"), "invoke data")
+}
+
+// checkReachable warns about states no sequence of transitions can enter,
+// starting from the initial state and the states migrations map to.
+// Only the outermost unreachable state of a subtree is reported.
+func (v *validator) checkReachable() {
+	root := v.spec.Machine.ID
+	reached := map[string]bool{}
+	var queue []string
+	var enter func(path string)
+	enter = func(path string) {
+		st, ok := v.states[path]
+		if !ok || reached[path] {
+			return
+		}
+		reached[path] = true
+		queue = append(queue, path)
+		if parent := parentPath(path); parent != "" {
+			enter(parent)
+		}
+		switch {
+		case st.IsParallel:
+			for id := range st.States {
+				enter(path + "." + id)
+			}
+		case st.History != "":
+			enter(parentPath(path) + "." + v.states[parentPath(path)].initialChild())
+		case len(st.States) > 0:
+			enter(path + "." + st.initialChild())
+		}
+	}
+	enter(root)
+	for _, m := range v.spec.Migrations {
+		for _, old := range sortedKeys(m.States) {
+			enter(m.States[old])
+		}
+	}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		for _, list := range v.states[path].On {
+			for _, trans := range list {
+				enter(v.spec.resolveTarget(parentPath(path), path, trans.Target))
+			}
+		}
+		for _, target := range v.gotos[path] {
+			enter(target)
+		}
+	}
+	for _, path := range sortedKeys(v.states) {
+		if !reached[path] && reached[parentPath(path)] {
+			v.report(SeverityWarning, v.keys[path], "state %q is unreachable", path)
+		}
+	}
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func firstLine(err error) string {
+	msg, _, _ := strings.Cut(err.Error(), "\n")
+	return msg
+}
+
+// locate returns the position of the deepest node on the key path: the key
+// for mapping entries, the element for sequence indexes. An index into a
+// mapping is skipped, as a single transition object stands for a list of one.
+// The file is the origin of that position when the spec was composed.
+func locate(root *yaml.Node, origins Origins, keys []string) (int, int, string) {
+	if root == nil {
+		return 0, 0, ""
+	}
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	line, col, file := n.Line, n.Column, origins[n]
+	for _, key := range keys {
+		var next *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			if _, err := strconv.Atoi(key); err == nil {
+				continue
+			}
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					line, col = n.Content[i].Line, n.Content[i].Column
+					next = n.Content[i+1]
+					if f, ok := origins[n.Content[i]]; ok {
+						file = f
+					}
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(n.Content) {
+				next = n.Content[i]
+				line, col = next.Line, next.Column
+				if f, ok := origins[next]; ok {
+					file = f
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return line, col, file
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/comalice/maelstrom/registry/statechart"
+)
+
+// supervisor tracks the recent restarts of the agents of one supervisor target.
+type supervisor struct {
+	restarts []time.Time
+}
+
+// allow records a restart at now and reports whether it stays within max
+// restarts per window.
+func (s *supervisor) allow(now time.Time, max int, window time.Duration) bool {
+	kept := s.restarts[:0]
+	for _, t := range s.restarts {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
+	}
+	s.restarts = kept
+	if len(s.restarts) >= max {
+		return false
+	}
+	s.restarts = append(s.restarts, now)
+	return true
+}
+
+// agentFailed applies the supervisor's strategy to a failed agent: the failed
+// agent (one_for_one) or all agents of its supervisor (one_for_all) restart
+// from their last saved snapshot and the supervisor receives error.agent.
+// Past max restarts in the window they are retired instead and the
+// supervisor receives error.agent.escalated.
+func (r *Registry) agentFailed(a *Agent, reason string) {
+	sup := a.Supervisor()
+	supervision := sup.Supervision
+	if sup.Target == "" {
+		supervision = r.Supervision
+	}
+	max, window, err := supervision.Limit()
+	if err != nil {
+		slog.Warn("invalid supervision, using defaults", "supervisor", sup.Target, "err", err)
+		max, window, _ = statechart.Supervision{}.Limit()
+	}
+
+	r.mu.Lock()
+	if r.supervisors == nil {
+		r.supervisors = make(map[string]*supervisor)
+	}
+	s, ok := r.supervisors[sup.Target]
+	if !ok {
+		s = &supervisor{}
+		r.supervisors[sup.Target] = s
+	}
+	restart := s.allow(time.Now(), max, window)
+	affected := []*Agent{a}
+	if supervision.StrategyOrDefault() == statechart.OneForAll {
+		affected = affected[:0]
+		for _, other := range r.agents {
+			if other.Supervisor().Target == sup.Target {
+				affected = append(affected, other)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	data := map[string]any{"agent": a.ID, "template": a.Template, "error": reason}
+	event := statechart.ErrorAgentEvent
+	if restart {
+		for _, ag := range affected {
+			ag.requestRestart()
+		}
+		slog.Warn("agent failed, restarting", "id", a.ID, "supervisor", sup.Target, "strategy", supervision.StrategyOrDefault(), "restarting", len(affected), "err", reason)
+	} else {
+		event = statechart.ErrorAgentEscalatedEvent
+		for _, ag := range affected {
+			if err := r.RetireAgent(ag.ID); err != nil {
+				slog.Warn("retire failed agent", "id", ag.ID, "err", err)
+			}
+		}
+		slog.Error("agent failed too often, escalating", "id", a.ID, "supervisor", sup.Target, "max_restarts", max, "within", window, "retired", len(affected), "err", reason)
+	}
+	r.notifySupervisor(sup.Target, event, data)
+}
+
+// notifySupervisor delivers a supervision event to the hiring agent or instance.
+// The root supervisor has no one to escalate to, so its events are only logged.
+func (r *Registry) notifySupervisor(target, event string, data map[string]any) {
+	var err error
+	switch {
+	case target == "":
+		return
+	case strings.HasPrefix(target, "agent:"):
+		err = r.SendMessage(strings.TrimPrefix(target, "agent:"), map[string]any{"event": event, "data": data})
+	default:
+		mid, iid, _ := strings.Cut(target, "/")
+		if r.NotifyInstance == nil {
+			slog.Warn("no instance notifier, supervision event dropped", "supervisor", target, "event", event)
+			return
+		}
+		err = r.NotifyInstance(mid, iid, event, data)
+	}
+	if err != nil {
+		slog.Warn("notify supervisor failed", "supervisor", target, "event", event, "err", err)
+	}
+}
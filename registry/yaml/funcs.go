@@ -0,0 +1,148 @@
+package yaml
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Partials returns the source of a partial template by its path relative to
+// the registry dir, e.g. "partials/tone.tmpl".
+type Partials func(name string) (string, error)
+
+// maxIncludeDepth bounds nested includes, so a partial including itself fails.
+const maxIncludeDepth = 10
+
+// FuncMap returns the functions registry YAML and prompt templates can use.
+// include renders a partial from partials with the given data.
+func FuncMap(partials Partials) template.FuncMap {
+	return funcMap(partials, false, 0)
+}
+
+// funcMap builds FuncMap for templates included depth levels deep; with
+// deferred set, include keeps the partial's runtime templates like
+// RenderBytes does.
+func funcMap(partials Partials, deferred bool, depth int) template.FuncMap {
+	return template.FuncMap{
+		"default":  defaultValue,
+		"required": required,
+		"coalesce": coalesce,
+		"env":      os.Getenv,
+		"toJson":   toJSON,
+		"indent":   indent,
+		"nindent":  func(n int, s string) string { return "\n" + indent(n, s) },
+		"trim":     strings.TrimSpace,
+		"upper":    strings.ToUpper,
+		"lower":    strings.ToLower,
+		"replace":  func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"quote":    func(s string) string { return fmt.Sprintf("%q", s) },
+		"now":      time.Now,
+		"b64enc":   func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":   b64dec,
+		"sha256":   func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+		"include": func(name string, data any) (string, error) {
+			return include(partials, deferred, depth, name, data)
+		},
+	}
+}
+
+// include renders the partial name with data.
+func include(partials Partials, deferred bool, depth int, name string, data any) (string, error) {
+	if partials == nil {
+		return "", fmt.Errorf("include %q: no partials", name)
+	}
+	if depth >= maxIncludeDepth {
+		return "", fmt.Errorf("include %q: nested too deep", name)
+	}
+	src, err := partials(name)
+	if err != nil {
+		return "", fmt.Errorf("include %q: %w", name, err)
+	}
+	if deferred {
+		if src, err = deferRuntime(src); err != nil {
+			return "", fmt.Errorf("include %q: %w", name, err)
+		}
+	}
+	tmpl, err := template.New(name).Funcs(funcMap(partials, deferred, depth+1)).Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("include %q: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// empty reports whether v is nil or the zero value of its type, or an empty
+// slice, map or string.
+func empty(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+// defaultValue returns d if the piped value is empty: {{.Env.MODEL | default "gpt"}}.
+func defaultValue(d any, given ...any) any {
+	if len(given) == 0 || empty(given[0]) {
+		return d
+	}
+	return given[0]
+}
+
+// required fails the render with msg if v is empty.
+func required(msg string, v any) (any, error) {
+	if empty(v) {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+// coalesce returns the first non-empty value.
+func coalesce(vs ...any) any {
+	for _, v := range vs {
+		if !empty(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// indent prefixes every line of s with n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -6,13 +6,28 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"text/template"
+	"text/template/parse"
 
 	"gopkg.in/yaml.v3"
 )
 
 var versionRe = regexp.MustCompile(`(.+?)-?v?([0-9]+\.[0-9]+(?:\.[0-9]+)?)?\.(yaml|yml)$`)
 
+// NameVersion splits a registry file name like research-agent-v1.0.yaml into
+// its name and version; version is empty if the file name has none.
+func NameVersion(filename string) (string, string) {
+	base := filepath.Base(filename)
+	matches := versionRe.FindStringSubmatch(base)
+	if matches == nil {
+		return strings.TrimSuffix(base, filepath.Ext(base)), ""
+	}
+	return matches[1], matches[2]
+}
+
 func ParseFile(path string) (map[string]interface{}, string, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -22,11 +37,9 @@ func ParseFile(path string) (map[string]interface{}, string, error) {
 	if err := yaml.Unmarshal(data, &content); err != nil {
 		return nil, "", err
 	}
-	name := filepath.Base(path)
-	matches := versionRe.FindStringSubmatch(name)
 	ver := "unknown"
-	if len(matches) > 2 && matches[2] != "" {
-		ver = matches[2]
+	if _, v := NameVersion(path); v != "" {
+		ver = v
 	}
 	return content, ver, nil
 }
@@ -36,27 +49,54 @@ func RawParseFile(path string) (string, string, error) {
 	if err != nil {
 		return "", "", err
 	}
-	name := filepath.Base(path)
-	matches := versionRe.FindStringSubmatch(name)
 	ver := "unknown"
-	if len(matches) > 2 && matches[2] != "" {
-		ver = matches[2]
+	if _, v := NameVersion(path); v != "" {
+		ver = v
 	}
 	return string(data), ver, nil
 }
 
 func Render(raw string, data any) (map[string]interface{}, error) {
+	return RenderWith(raw, data, nil)
+}
+
+// RenderWith is Render with partials for include.
+func RenderWith(raw string, data any, partials Partials) (map[string]interface{}, error) {
+	b, err := RenderBytesWith(raw, data, partials)
+	if err != nil {
+		return nil, err
+	}
+	var content map[string]interface{}
+	if err := yaml.Unmarshal(b, &content); err != nil {
+		return nil, fmt.Errorf("yaml unmarshal: %w", err)
+	}
+	return content, nil
+}
+
+// RuntimeFields are the template fields only known when an action runs (see
+// statechart.PromptData). Load-time rendering leaves the templates using them
+// in place, to be rendered per invocation.
+var RuntimeFields = []string{"Context", "Event", "From", "To", "Machine", "Instance"}
+
+// RenderBytes executes raw as a text/template and returns the rendered YAML
+// source, so parse positions match the file wherever templates stay on one line.
+// Template actions and blocks that use RuntimeFields are kept verbatim.
+func RenderBytes(raw string, data any) ([]byte, error) {
+	return RenderBytesWith(raw, data, nil)
+}
+
+// RenderBytesWith is RenderBytes with partials for include; runtime templates
+// in included partials are kept too.
+func RenderBytesWith(raw string, data any, partials Partials) ([]byte, error) {
 	b := []byte(raw)
 	if !bytes.Contains(b, []byte("{{")) {
-		var content map[string]interface{}
-		if err := yaml.Unmarshal(b, &content); err != nil {
-			return nil, fmt.Errorf("yaml unmarshal: %w", err)
-		}
-		return content, nil
+		return b, nil
+	}
+	raw, err := deferRuntime(raw)
+	if err != nil {
+		return nil, fmt.Errorf("template parse: %w", err)
 	}
-	tmpl := template.New("yaml")
-	var err error
-	tmpl, err = tmpl.Parse(raw)
+	tmpl, err := template.New("yaml").Funcs(funcMap(partials, true, 0)).Parse(raw)
 	if err != nil {
 		return nil, fmt.Errorf("template parse: %w", err)
 	}
@@ -64,9 +104,93 @@ func Render(raw string, data any) (map[string]interface{}, error) {
 	if err = tmpl.Execute(&buf, data); err != nil {
 		return nil, fmt.Errorf("template execute: %w", err)
 	}
-	var content map[string]interface{}
-	if err = yaml.Unmarshal(buf.Bytes(), &content); err != nil {
-		return nil, fmt.Errorf("yaml unmarshal: %w", err)
+	return buf.Bytes(), nil
+}
+
+// deferRuntime rewrites the top-level template actions and blocks of raw that
+// use RuntimeFields into string constants of their own source, so executing
+// raw outputs them unchanged.
+func deferRuntime(raw string) (string, error) {
+	t := parse.New("yaml")
+	t.Mode = parse.SkipFuncCheck
+	if _, err := t.Parse(raw, "", "", map[string]*parse.Tree{}); err != nil {
+		return "", err
 	}
-	return content, nil
+	nodes := t.Root.Nodes
+	starts := make([]int, len(nodes)+1)
+	for i, n := range nodes {
+		starts[i] = int(n.Position())
+		if n.Type() != parse.NodeText {
+			starts[i] = strings.LastIndex(raw[:starts[i]], "{{")
+		}
+	}
+	starts[len(nodes)] = len(raw)
+
+	var out strings.Builder
+	out.WriteString(raw[:starts[0]])
+	for i, n := range nodes {
+		src := raw[starts[i]:starts[i+1]]
+		if n.Type() == parse.NodeText || !usesRuntime(n) {
+			out.WriteString(src)
+			continue
+		}
+		if strings.Contains(src, "`") {
+			out.WriteString("{{" + strconv.Quote(src) + "}}")
+		} else {
+			out.WriteString("{{`" + src + "`}}")
+		}
+	}
+	return out.String(), nil
+}
+
+// usesRuntime reports whether n refers to one of RuntimeFields, as .Field or $.Field.
+func usesRuntime(n parse.Node) bool {
+	runtime := func(ident []string) bool {
+		return len(ident) > 0 && slices.Contains(RuntimeFields, ident[0])
+	}
+	switch n := n.(type) {
+	case *parse.FieldNode:
+		return runtime(n.Ident)
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && runtime(n.Ident[1:])
+	case *parse.ChainNode:
+		return usesRuntime(n.Node)
+	case *parse.ActionNode:
+		return usesRuntime(n.Pipe)
+	case *parse.TemplateNode:
+		return n.Pipe != nil && usesRuntime(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if usesRuntime(c) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if usesRuntime(a) {
+				return true
+			}
+		}
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if usesRuntime(c) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return usesRuntime(&n.BranchNode)
+	case *parse.RangeNode:
+		return usesRuntime(&n.BranchNode)
+	case *parse.WithNode:
+		return usesRuntime(&n.BranchNode)
+	case *parse.BranchNode:
+		return usesRuntime(n.Pipe) || usesRuntime(n.List) || usesRuntime(n.ElseList)
+	}
+	return false
 }
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
 	"github.com/comalice/maelstrom/config"
 	"github.com/stretchr/testify/assert"
 )
@@ -41,7 +42,6 @@ func TestRenderAppFoo(t *testing.T) {
 	assert.Equal(t, "bar", content["foo"].(string))
 }
 
-
 func TestRenderInvalidTemplate(t *testing.T) {
 	raw := `{{ invalid syntax }}`
 	_, err := Render(raw, nil)
@@ -53,7 +53,10 @@ func TestTemplateVariableResolution(t *testing.T) {
 company: {{.App.CompanyName}}
 var: {{.Env.VAR_NAME}}`
 	cfg := &config.AppConfig{Environment: "prod", CompanyName: "Acme", Variables: map[string]string{"VAR_NAME": "value"}}
-	rd := struct{App *config.AppConfig; Env map[string]string}{App: cfg, Env: cfg.Variables}
+	rd := struct {
+		App *config.AppConfig
+		Env map[string]string
+	}{App: cfg, Env: cfg.Variables}
 	content, err := Render(raw, rd)
 	assert.NoError(t, err)
 	assert.Equal(t, "prod", content["env"])
@@ -63,13 +66,105 @@ var: {{.Env.VAR_NAME}}`
 
 func TestEnvironmentVariableAccess(t *testing.T) {
 	raw := `env: {{.App.Environment}}`
-	rd := struct{App *config.AppConfig; Env map[string]string}{App: &config.AppConfig{Environment: "prod"}, Env: map[string]string{}}
+	rd := struct {
+		App *config.AppConfig
+		Env map[string]string
+	}{App: &config.AppConfig{Environment: "prod"}, Env: map[string]string{}}
 	content, err := Render(raw, rd)
 	assert.NoError(t, err)
 	assert.Equal(t, "prod", content["env"])
 }
 
 func TestNestedVariableAccess(t *testing.T) {
-	_, err := Render(`{{.Env.FOO.BAR}}`, struct{App *config.AppConfig; Env map[string]string}{Env: map[string]string{}})
-	assert.Error(t, err)  // No nesting support
+	_, err := Render(`{{.Env.FOO.BAR}}`, struct {
+		App *config.AppConfig
+		Env map[string]string
+	}{Env: map[string]string{}})
+	assert.Error(t, err) // No nesting support
+}
+
+func TestRenderBytes_KeepsRuntimeTemplates(t *testing.T) {
+	raw := "llm:\n  model: \"{{.App.DefaultModel}}\"\n" +
+		"prompt: |\n" +
+		"  You work for {{.App.CompanyName}}.\n" +
+		"  {{range .Context.history}}{{.user}}: {{.msg}}\n  {{end}}\n" +
+		"  User: {{ .Event.Data.message }} ({{$.From}} -> {{printf \"%s\" .To}})\n" +
+		"  {{if .Env.DEBUG}}debug{{end}}\n"
+	rd := struct {
+		App *config.AppConfig
+		Env map[string]string
+	}{App: &config.AppConfig{DefaultModel: "m1", CompanyName: "Acme"}, Env: map[string]string{"DEBUG": "1"}}
+	out, err := RenderBytes(raw, rd)
+	assert.NoError(t, err)
+	assert.Equal(t, "llm:\n  model: \"m1\"\n"+
+		"prompt: |\n"+
+		"  You work for Acme.\n"+
+		"  {{range .Context.history}}{{.user}}: {{.msg}}\n  {{end}}\n"+
+		"  User: {{ .Event.Data.message }} ({{$.From}} -> {{printf \"%s\" .To}})\n"+
+		"  debug\n", string(out))
+}
+
+func TestFuncMap(t *testing.T) {
+	t.Setenv("MAELSTROM_TEST_FUNC", "from-os")
+	raw := `provider: {{.Env.PROVIDER | default .App.DefaultProvider | default "anthropic"}}
+model: {{coalesce .Env.MODEL "m1"}}
+os: {{env "MAELSTROM_TEST_FUNC" | upper}}
+json: '{{toJson .Env}}'
+trimmed: {{trim "  x  "}}
+b64: {{b64enc "hi"}}
+sum: {{sha256 "hi"}}
+list:{{"- a\n- b" | nindent 2}}`
+	rd := struct {
+		App *config.AppConfig
+		Env map[string]string
+	}{App: &config.AppConfig{}, Env: map[string]string{"K": "v"}}
+	content, err := Render(raw, rd)
+	assert.NoError(t, err)
+	assert.Equal(t, "anthropic", content["provider"])
+	assert.Equal(t, "m1", content["model"])
+	assert.Equal(t, "FROM-OS", content["os"])
+	assert.Equal(t, `{"K":"v"}`, content["json"])
+	assert.Equal(t, "x", content["trimmed"])
+	assert.Equal(t, "aGk=", content["b64"])
+	assert.Equal(t, "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4", content["sum"])
+	assert.Equal(t, []any{"a", "b"}, content["list"])
+
+	_, err = Render(`key: {{required "API key is required" .Env.API_KEY}}`, rd)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "API key is required")
+	}
+}
+
+func TestRenderBytesWith_Include(t *testing.T) {
+	partials := map[string]string{
+		"partials/tone.tmpl": "Be terse, you work for {{.App.CompanyName}}.\nUser said: {{.Event.Data.message}}",
+		"partials/loop.tmpl": `{{include "partials/loop.tmpl" .}}`,
+	}
+	lookup := func(name string) (string, error) {
+		src, ok := partials[name]
+		if !ok {
+			return "", os.ErrNotExist
+		}
+		return src, nil
+	}
+	rd := struct {
+		App *config.AppConfig
+		Env map[string]string
+	}{App: &config.AppConfig{CompanyName: "Acme"}}
+
+	out, err := RenderBytesWith("prompt: |\n{{include \"partials/tone.tmpl\" . | indent 2}}\n", rd, lookup)
+	assert.NoError(t, err)
+	// Load time inlines the partial and keeps its runtime templates.
+	assert.Equal(t, "prompt: |\n  Be terse, you work for Acme.\n  User said: {{.Event.Data.message}}\n", string(out))
+
+	_, err = RenderBytesWith(`{{include "partials/missing.tmpl" .}}`, rd, lookup)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = RenderBytesWith(`{{include "partials/loop.tmpl" .}}`, rd, lookup)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "nested too deep")
+	}
+	_, err = RenderBytes(`{{include "partials/tone.tmpl" .}}`, rd)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no partials")
+	}
 }